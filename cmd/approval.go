@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pendingUpdatePlan is a plan that waits for an operator to approve (or reject) its changes
+type pendingUpdatePlan struct {
+	ID   string // derived from the changes, so an operator can't accidentally approve a different plan than the one they reviewed
+	Plan *updatePlan
+	Time time.Time
+}
+
+// the pending plan and the decisions about it are kept per target (see grafanaTarget)
+var (
+	approvalMutex sync.Mutex
+	decisionsMade bool // set when an operator made a decision, wakes up the sync loop
+)
+
+// keys identify a change, they include the current (old) state, so a change that was approved
+// becomes invalid as soon as the state in grafana is not the same anymore.
+func (o *grafanaOrganization) key() string {
+	if o.ID == 0 {
+		return fmt.Sprintf("org:new:%v", o.Name)
+	}
+	return fmt.Sprintf("org:%d", o.ID)
+}
+
+func (t *grafanaTeam) key() string {
+	return fmt.Sprintf("team|org:%d|%v", t.OrgID, t.Name)
+}
+
+func (c *userRoleChange) key(email string) string {
+	return fmt.Sprintf("role|%v|%v|%v>%v", email, c.Organization.key(), c.OldRole, c.NewRole)
+}
+
+func (c *teamMembershipChange) key(email string) string {
+	return fmt.Sprintf("teamMember|%v|org:%d|%v|add:%v", email, c.Team.OrgID, c.Team.Name, c.Add)
+}
+
+func (c *grafanaAdminChange) key(email string) string {
+	return fmt.Sprintf("grafanaAdmin|%v|grant:%v", email, c.Grant)
+}
+
+func (c *offboardingChange) key(email string) string {
+	return fmt.Sprintf("offboarding|%v|%v", email, c.action())
+}
+
+func (c *folderPermissionChange) key() string {
+	return fmt.Sprintf("%vPermission|%v|%v|%v|%v>%v", c.Folder.kind(), c.Organization.key(), c.Folder.UID, c.grantee(), c.OldPermission, c.NewPermission)
+}
+
+// keys returns the keys of all changes in the plan (sorted)
+func (p *updatePlan) keys() []string {
+	var keys []string
+	for _, u := range p.NewUsers {
+		keys = append(keys, u.key())
+	}
+	for _, org := range p.NewOrgs {
+		keys = append(keys, org.key())
+	}
+	for _, team := range p.NewTeams {
+		keys = append(keys, team.key())
+	}
+	for _, uu := range p.Users {
+		keys = append(keys, uu.keys()...)
+	}
+	for _, change := range p.FolderChanges {
+		keys = append(keys, change.key())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (uu *userUpdate) keys() []string {
+	var keys []string
+	for _, change := range uu.Changes {
+		keys = append(keys, change.key(uu.Email))
+	}
+	for _, change := range uu.TeamChanges {
+		keys = append(keys, change.key(uu.Email))
+	}
+	if uu.AdminChange != nil {
+		keys = append(keys, uu.AdminChange.key(uu.Email))
+	}
+	if uu.Offboarding != nil {
+		keys = append(keys, uu.Offboarding.key(uu.Email))
+	}
+	return keys
+}
+
+// filter creates a new plan that only contains the changes for which keep() returns true.
+// New orgs and teams are also kept when a kept change needs them.
+func (p *updatePlan) filter(keep func(key string) bool) *updatePlan {
+	result := &updatePlan{RunID: p.RunID, Skipped: p.Skipped}
+	neededOrgs := make(map[*grafanaOrganization]bool)
+	neededTeams := make(map[*grafanaTeam]bool)
+
+	for _, uu := range p.Users {
+		filtered := userUpdate{Email: uu.Email}
+		for _, change := range uu.Changes {
+			if keep(change.key(uu.Email)) {
+				filtered.Changes = append(filtered.Changes, change)
+				neededOrgs[change.Organization] = true
+			}
+		}
+		for _, change := range uu.TeamChanges {
+			if keep(change.key(uu.Email)) {
+				filtered.TeamChanges = append(filtered.TeamChanges, change)
+				neededTeams[change.Team] = true
+			}
+		}
+		if uu.AdminChange != nil && keep(uu.AdminChange.key(uu.Email)) {
+			filtered.AdminChange = uu.AdminChange
+		}
+		if uu.Offboarding != nil && keep(uu.Offboarding.key(uu.Email)) {
+			filtered.Offboarding = uu.Offboarding
+		}
+		if filtered.hasChanges() {
+			result.Users = append(result.Users, filtered)
+		}
+	}
+
+	for _, change := range p.FolderChanges {
+		if keep(change.key()) {
+			result.FolderChanges = append(result.FolderChanges, change)
+			if change.Team != nil {
+				neededTeams[change.Team] = true
+			}
+		}
+	}
+
+	for _, u := range p.NewUsers {
+		if keep(u.key()) {
+			result.NewUsers = append(result.NewUsers, u)
+		}
+	}
+
+	for _, org := range p.NewOrgs {
+		if keep(org.key()) || neededOrgs[org] {
+			result.NewOrgs = append(result.NewOrgs, org)
+		}
+	}
+
+	for _, team := range p.NewTeams {
+		if keep(team.key()) || neededTeams[team] {
+			result.NewTeams = append(result.NewTeams, team)
+		}
+	}
+
+	return result
+}
+
+// handlePlanApproval is used instead of executing plans directly when 'requireApproval' is enabled.
+// The approved changes are taken from the freshly computed plan, so only changes that are still valid get applied.
+// Everything else (that was not rejected) becomes the new pending plan of the target.
+func handlePlanApproval(t *grafanaTarget, fresh *updatePlan) {
+	approvalMutex.Lock()
+	decisionsMade = false
+
+	freshKeys := make(map[string]bool)
+	for _, key := range fresh.keys() {
+		freshKeys[key] = true
+	}
+
+	// forget decisions about changes that are not part of the plan anymore (they have been applied, or are no longer needed)
+	for key := range t.approvedChanges {
+		if !freshKeys[key] {
+			delete(t.approvedChanges, key)
+		}
+	}
+	for key := range t.rejectedChanges {
+		if !freshKeys[key] {
+			delete(t.rejectedChanges, key)
+		}
+	}
+
+	approved := fresh.filter(func(key string) bool { return t.approvedChanges[key] })
+	pending := fresh.filter(func(key string) bool { return !t.approvedChanges[key] && !t.rejectedChanges[key] })
+
+	previousID := ""
+	if t.pendingPlan != nil {
+		previousID = t.pendingPlan.ID
+	}
+	if pending.isEmpty() {
+		t.pendingPlan = nil
+	} else {
+		t.pendingPlan = &pendingUpdatePlan{planID(pending), pending, time.Now()}
+	}
+	pendingPlan := t.pendingPlan
+	approvalMutex.Unlock()
+
+	if pendingPlan != nil && pendingPlan.ID != previousID {
+		printPlan(t, pending)
+		log.Infow("Update plan is waiting for approval, review it at /admin/pending", "target", t.Name, "planId", pendingPlan.ID)
+	}
+
+	if approved.isEmpty() {
+		return
+	}
+
+	log.Infow("Applying approved changes", "target", t.Name)
+	printPlan(t, approved)
+	failed := executePlan(t, approved)
+	if failed == 0 && pendingPlan == nil {
+		recordSuccessfulSync(t)
+	}
+}
+
+func operatorDecisionsMade() bool {
+	approvalMutex.Lock()
+	defer approvalMutex.Unlock()
+	return decisionsMade
+}
+
+func planID(p *updatePlan) string {
+	hash := sha1.New()
+	for _, key := range p.keys() {
+		hash.Write([]byte(key + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// decideOnPendingPlan approves or rejects the changes of the pending plan of a target (or only the changes of one user, if email is not empty)
+func decideOnPendingPlan(t *grafanaTarget, planID string, email string, approve bool) error {
+	approvalMutex.Lock()
+	defer approvalMutex.Unlock()
+
+	pendingPlan := t.pendingPlan
+	if pendingPlan == nil {
+		return fmt.Errorf("there is no pending plan")
+	}
+	if pendingPlan.ID != planID {
+		return fmt.Errorf("planId '%v' does not match the pending plan ('%v'), it has changed since you reviewed it", planID, pendingPlan.ID)
+	}
+
+	var keys []string
+	if email == "" {
+		keys = pendingPlan.Plan.keys()
+	} else {
+		for _, u := range pendingPlan.Plan.NewUsers {
+			if u.Email == email {
+				keys = append(keys, u.key())
+			}
+		}
+		for _, uu := range pendingPlan.Plan.Users {
+			if uu.Email == email {
+				keys = append(keys, uu.keys()...)
+			}
+		}
+		for _, change := range pendingPlan.Plan.FolderChanges {
+			if change.Team == nil && change.UserEmail == email {
+				keys = append(keys, change.key())
+			}
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("the pending plan contains no changes for user '%v'", email)
+		}
+	}
+
+	for _, key := range keys {
+		if approve {
+			t.approvedChanges[key] = true
+			delete(t.rejectedChanges, key)
+		} else {
+			t.rejectedChanges[key] = true
+			delete(t.approvedChanges, key)
+		}
+	}
+	decisionsMade = true
+
+	log.Infow("Operator decided on pending plan", "target", t.Name, "planId", planID, "user", email, "approved", approve, "changes", len(keys))
+	return nil
+}
+
+// pendingPlanForDisplay shows the pending plan of a target, and which of its changes have been approved
+func pendingPlanForDisplay(t *grafanaTarget) map[string]interface{} {
+	approvalMutex.Lock()
+	defer approvalMutex.Unlock()
+
+	pendingPlan := t.pendingPlan
+	if pendingPlan == nil {
+		return map[string]interface{}{"target": t.Name, "pending": false}
+	}
+
+	changes := planForDisplay(pendingPlan.Plan)
+	for _, element := range changes {
+		element["approved"] = t.approvedChanges[element["id"].(string)]
+	}
+
+	return map[string]interface{}{
+		"target":     t.Name,
+		"pending":    true,
+		"planId":     pendingPlan.ID,
+		"computedAt": pendingPlan.Time,
+		"stats":      pendingPlan.Plan.stats(),
+		"changes":    changes,
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rikimaru0345/sdk"
+)
+
+func TestPlanFilter(t *testing.T) {
+	setupTestGrafana(&Config{}, "a@corp.com", "b@corp.com")
+	prod := addTestOrg(2, "Prod", nil)
+	newOrg := &grafanaOrganization{Org: &sdk.Org{Name: "Staging"}}
+	newTeam := &grafanaTeam{0, 2, "SRE", nil}
+
+	plan := &updatePlan{RunID: "run", NewOrgs: []*grafanaOrganization{newOrg}, NewTeams: []*grafanaTeam{newTeam}}
+	plan.Users = []userUpdate{
+		{Email: "a@corp.com", Changes: []*userRoleChange{{newOrg, "", "Viewer", nil}, {prod, "", "Viewer", nil}}},
+		{Email: "b@corp.com", TeamChanges: []*teamMembershipChange{{prod, newTeam, 2, true, nil}}},
+	}
+	plan.FolderChanges = []*folderPermissionChange{{Organization: prod, Folder: &grafanaFolder{UID: "f1"}, UserID: 1, UserEmail: "a@corp.com", NewPermission: "View"}}
+
+	tests := []struct {
+		name      string
+		keep      func(key string) bool
+		wantKeys  []string
+		wantUsers int
+	}{
+		{"nothing", func(string) bool { return false }, nil, 0},
+		{"everything", func(string) bool { return true }, plan.keys(), 2},
+		{
+			"change in a new org keeps the org",
+			func(key string) bool { return key == "role|a@corp.com|org:new:Staging|>Viewer" },
+			[]string{"org:new:Staging", "role|a@corp.com|org:new:Staging|>Viewer"},
+			1,
+		},
+		{
+			"team change keeps the new team",
+			func(key string) bool { return strings.HasPrefix(key, "teamMember|") },
+			[]string{"teamMember|b@corp.com|org:2|SRE|add:true", "team|org:2|SRE"},
+			1,
+		},
+		{
+			"folder change",
+			func(key string) bool { return strings.HasPrefix(key, "folderPermission|") },
+			[]string{"folderPermission|org:2|f1|a@corp.com|>View"},
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filtered := plan.filter(test.keep)
+			if got := filtered.keys(); strings.Join(got, ",") != strings.Join(test.wantKeys, ",") {
+				t.Errorf("filter() keys = %v, want %v", got, test.wantKeys)
+			}
+			if len(filtered.Users) != test.wantUsers {
+				t.Errorf("filter() kept %d users, want %d", len(filtered.Users), test.wantUsers)
+			}
+			if filtered.RunID != plan.RunID {
+				t.Errorf("filter() run id = %v, want %v", filtered.RunID, plan.RunID)
+			}
+		})
+	}
+}
+
+func TestDecideOnPendingPlan(t *testing.T) {
+	setupTestGrafana(&Config{}, "a@corp.com", "b@corp.com")
+	prod := addTestOrg(2, "Prod", nil)
+	plan := &updatePlan{Users: roleChanges(prod, "", "Viewer", "a@corp.com", "b@corp.com"), NewUsers: []*newGrafanaUser{{"new@corp.com", nil}}}
+
+	handlePlanApproval(currentTarget, plan)
+	target := currentTarget
+	if target.pendingPlan == nil {
+		t.Fatal("plan is not pending")
+	}
+	id := target.pendingPlan.ID
+
+	if err := decideOnPendingPlan(target, "outdated", "", true); err == nil {
+		t.Error("approved a plan with the wrong id")
+	}
+	if err := decideOnPendingPlan(target, id, "nobody@corp.com", true); err == nil {
+		t.Error("approved the changes of a user without changes")
+	}
+
+	if err := decideOnPendingPlan(target, id, "a@corp.com", true); err != nil {
+		t.Fatalf("decideOnPendingPlan() error = %v", err)
+	}
+	if err := decideOnPendingPlan(target, id, "b@corp.com", false); err != nil {
+		t.Fatalf("decideOnPendingPlan() error = %v", err)
+	}
+
+	keyA := "role|a@corp.com|org:2|>Viewer"
+	keyB := "role|b@corp.com|org:2|>Viewer"
+	if !target.approvedChanges[keyA] || target.rejectedChanges[keyA] {
+		t.Errorf("change of a@corp.com is not approved")
+	}
+	if !target.rejectedChanges[keyB] || target.approvedChanges[keyB] {
+		t.Errorf("change of b@corp.com is not rejected")
+	}
+
+	// accounts that would be created are decided on per user as well
+	if err := decideOnPendingPlan(target, id, "new@corp.com", true); err != nil {
+		t.Fatalf("decideOnPendingPlan() error = %v", err)
+	}
+	if !target.approvedChanges["user:new:new@corp.com"] || len(target.approvedChanges) != 2 {
+		t.Errorf("approved changes = %v, want the account of new@corp.com and the change of a@corp.com", target.approvedChanges)
+	}
+
+	// changing a decision
+	if err := decideOnPendingPlan(target, id, "a@corp.com", false); err != nil {
+		t.Fatalf("decideOnPendingPlan() error = %v", err)
+	}
+	if target.approvedChanges[keyA] || !target.rejectedChanges[keyA] {
+		t.Errorf("change of a@corp.com is not rejected after it was approved")
+	}
+}
+
+func TestHandlePlanApproval(t *testing.T) {
+	server := newFakeGrafana()
+	defer server.Close()
+	setupTestGrafana(&Config{Grafanas: server.config()}, "a@corp.com", "b@corp.com")
+	prod := addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Viewer", "b@corp.com": "Viewer"})
+
+	handlePlanApproval(currentTarget, &updatePlan{Users: roleChanges(prod, "Viewer", "Editor", "a@corp.com", "b@corp.com")})
+	target := currentTarget
+	if err := decideOnPendingPlan(target, target.pendingPlan.ID, "", true); err != nil {
+		t.Fatalf("decideOnPendingPlan() error = %v", err)
+	}
+
+	// someone made a@corp.com Admin in the meantime, so the approved change (Viewer > Editor) is not valid anymore
+	prod.Users[0].Role = "Admin" // members are sorted, this is a@corp.com
+	handlePlanApproval(currentTarget, &updatePlan{Users: append(roleChanges(prod, "Admin", "Editor", "a@corp.com"), roleChanges(prod, "Viewer", "Editor", "b@corp.com")...)})
+
+	requests := server.receivedRequests()
+	if len(requests) != 1 || requests[0] != "PATCH /api/orgs/2/users/2" {
+		t.Errorf("requests = %v, want only the still valid change of b@corp.com", requests)
+	}
+	if target.approvedChanges["role|a@corp.com|org:2|Viewer>Editor"] {
+		t.Error("outdated approval was not forgotten")
+	}
+	if target.pendingPlan == nil {
+		t.Fatal("the new change of a@corp.com is not pending")
+	}
+	if keys := target.pendingPlan.Plan.keys(); len(keys) != 1 || keys[0] != "role|a@corp.com|org:2|Admin>Editor" {
+		t.Errorf("pending changes = %v, want only the new change of a@corp.com", keys)
+	}
+}
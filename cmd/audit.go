@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/audit"
+	"github.com/rikimaru0345/sdk"
+)
+
+var auditJournal *audit.Journal // nil if no 'auditLogPath' is configured
+
+func setupAuditJournal() error {
+	if config.Settings.AuditLogPath == "" {
+		return nil
+	}
+
+	var err error
+	auditJournal, err = audit.Open(config.Settings.AuditLogPath)
+	return err
+}
+
+func newRunID() string {
+	return fmt.Sprintf("%v-%04x", time.Now().UTC().Format("20060102T150405Z"), rand.Intn(0x10000))
+}
+
+// writeAudit appends an entry to the audit journal (if there is one), and records the result in the metrics.
+// The change failed if there is an error, or if grafana responded with an error status (the sdk does not report those as errors).
+func writeAudit(t *grafanaTarget, e audit.Entry, err error) {
+	e.StatusCode = t.state.takeStatusCode()
+	if err == nil && e.StatusCode > 299 {
+		err = fmt.Errorf("grafana responded with status %d", e.StatusCode)
+	}
+	recordChangeResult(t, e.Action, err)
+
+	if auditJournal == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.Target = t.Name
+	e.Outcome = audit.OutcomeOK
+	if err != nil {
+		e.Outcome = audit.OutcomeFailed
+		e.Error = err.Error()
+	}
+
+	if writeErr := auditJournal.Append(e); writeErr != nil {
+		log.Errorw("unable to write to audit log", "error", writeErr, "entry", e)
+	}
+}
+
+// setAuditReason records the rule responsible for a change (if there is one, changes of a saved plan might have none)
+func setAuditReason(e *audit.Entry, r *Rule) {
+	if r != nil {
+		index := r.Index
+		e.RuleIndex = &index
+		e.RuleNote = r.Note
+	}
+}
+
+func auditRoleChange(t *grafanaTarget, runID string, email string, change *userRoleChange, status sdk.StatusMessage, err error) {
+	e := audit.Entry{
+		RunID:   runID,
+		Action:  change.action(),
+		User:    email,
+		Org:     change.Organization.Name,
+		OrgID:   change.Organization.ID,
+		OldRole: string(change.OldRole),
+		NewRole: string(change.NewRole),
+	}
+	setAuditReason(&e, change.Reason)
+	if status.Message != nil {
+		e.Status = *status.Message
+	}
+	writeAudit(t, e, err)
+}
+
+func auditTeamChange(t *grafanaTarget, runID string, email string, change *teamMembershipChange, err error) {
+	e := audit.Entry{
+		RunID:  runID,
+		Action: change.metricType(),
+		User:   email,
+		Org:    change.Organization.Name,
+		OrgID:  change.Organization.ID,
+		Team:   change.Team.Name,
+	}
+	setAuditReason(&e, change.Reason)
+	writeAudit(t, e, err)
+}
+
+func auditOrgCreation(t *grafanaTarget, runID string, org *grafanaOrganization, err error) {
+	writeAudit(t, audit.Entry{
+		RunID:  runID,
+		Action: "create_org",
+		Org:    org.Name,
+		OrgID:  org.ID,
+	}, err)
+}
+
+func auditTeamCreation(t *grafanaTarget, runID string, team *grafanaTeam, err error) {
+	var orgName string
+	if org := t.state.organizations[team.OrgID]; org != nil {
+		orgName = org.Name
+	}
+	writeAudit(t, audit.Entry{
+		RunID:  runID,
+		Action: "create_team",
+		Org:    orgName,
+		OrgID:  team.OrgID,
+		Team:   team.Name,
+	}, err)
+}
+
+func auditFolderChange(t *grafanaTarget, runID string, change *folderPermissionChange, err error) {
+	e := audit.Entry{
+		RunID:         runID,
+		Action:        change.action(),
+		User:          change.UserEmail,
+		Org:           change.Organization.Name,
+		OrgID:         change.Organization.ID,
+		Folder:        change.Folder.Title,
+		FolderUID:     change.Folder.UID,
+		OldPermission: string(change.OldPermission),
+		NewPermission: string(change.NewPermission),
+	}
+	if change.Team != nil {
+		e.Team = change.Team.Name
+	}
+	setAuditReason(&e, change.Reason)
+	writeAudit(t, e, err)
+}
+
+func auditAdminChange(t *grafanaTarget, runID string, email string, change *grafanaAdminChange, status sdk.StatusMessage, err error) {
+	e := audit.Entry{
+		RunID:  runID,
+		Action: change.action(),
+		User:   email,
+	}
+	setAuditReason(&e, change.Reason)
+	if status.Message != nil {
+		e.Status = *status.Message
+	}
+	writeAudit(t, e, err)
+}
+
+func auditUserCreation(t *grafanaTarget, runID string, u *newGrafanaUser, status sdk.StatusMessage, err error) {
+	e := audit.Entry{
+		RunID:  runID,
+		Action: "create_user",
+		User:   u.Email,
+	}
+	setAuditReason(&e, u.Reason)
+	if status.Message != nil {
+		e.Status = *status.Message
+	}
+	writeAudit(t, e, err)
+}
+
+func auditOffboarding(t *grafanaTarget, runID string, email string, change *offboardingChange, err error) {
+	writeAudit(t, audit.Entry{
+		RunID:  runID,
+		Action: change.action(),
+		User:   email,
+		Reason: change.Why,
+	}, err)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/audit"
+	"github.com/rikimaru0345/sdk"
+)
+
+func TestAuditOutcome(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newFakeGrafana()
+	defer server.Close()
+	server.fail("PATCH /api/orgs/2/users/2", 403)
+	server.fail("POST /api/teams/10/members", 500)
+
+	c := &Config{Grafanas: server.config()}
+	c.Settings.AuditLogPath = filepath.Join(dir, "audit.log")
+	setupTestGrafana(c, "a@corp.com", "b@corp.com")
+	if err := setupAuditJournal(); err != nil {
+		t.Fatalf("setupAuditJournal() error = %v", err)
+	}
+	defer func() {
+		auditJournal.Close()
+		auditJournal = nil
+	}()
+
+	prod := addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Viewer", "b@corp.com": "Viewer"})
+	newOrg := &grafanaOrganization{&sdk.Org{Name: "Staging"}, nil, nil, nil, "", false, false} // was not created
+	team := &grafanaTeam{10, 2, "SRE", nil}
+	plan := &updatePlan{Users: roleChanges(prod, "Viewer", "Editor", "a@corp.com", "b@corp.com")}
+	plan.Users[0].TeamChanges = []*teamMembershipChange{{prod, team, 1, true, &Rule{}}}
+	plan.Users[1].Changes = append(plan.Users[1].Changes, &userRoleChange{newOrg, "", "Viewer", nil})
+	executePlan(currentTarget, plan)
+
+	entries, err := auditJournal.Query(audit.Filter{})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	tests := []struct {
+		user       string
+		action     string
+		org        string
+		outcome    string
+		statusCode int
+	}{
+		{"a@corp.com", "promote", "Prod", audit.OutcomeOK, 200},
+		{"a@corp.com", "team_add", "Prod", audit.OutcomeFailed, 500},
+		{"b@corp.com", "promote", "Prod", audit.OutcomeFailed, 403},
+		{"b@corp.com", "add", "Staging", audit.OutcomeFailed, 0}, // no request was made, the org does not exist
+	}
+	if len(entries) != len(tests) {
+		t.Fatalf("audit log has %d entries, want %d: %+v", len(entries), len(tests), entries)
+	}
+	for i, test := range tests {
+		e := entries[i]
+		if e.User != test.user || e.Action != test.action || e.Org != test.org {
+			t.Errorf("entry %d is %v %v in %v, want %v %v in %v", i, e.Action, e.User, e.Org, test.action, test.user, test.org)
+			continue
+		}
+		if e.Outcome != test.outcome || e.StatusCode != test.statusCode {
+			t.Errorf("%v of %v: outcome %v, status code %d; want %v, %d", e.Action, e.User, e.Outcome, e.StatusCode, test.outcome, test.statusCode)
+		}
+		if (e.Error != "") != (test.outcome == audit.OutcomeFailed) {
+			t.Errorf("%v of %v: error = %q, want an error only if it failed", e.Action, e.User, e.Error)
+		}
+	}
+}
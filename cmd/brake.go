@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the kinds of changes a userRoleChange can be
+const (
+	actionAdd     = "add"
+	actionPromote = "promote"
+	actionDemote  = "demote"
+	actionRemove  = "remove"
+)
+
+// blockedUpdatePlan is a plan that was not executed because it exceeded the limits of the safety brake
+type blockedUpdatePlan struct {
+	ID      string // see planID, an override is only valid for the plan with this id
+	Plan    *updatePlan
+	Stats   planStats
+	Reasons []string
+	Time    time.Time
+}
+
+type planStats struct {
+	AffectedUsers int `json:"affectedUsers"`
+	Additions     int `json:"additions"`
+	Promotions    int `json:"promotions"`
+	Demotions     int `json:"demotions"`
+	Removals      int `json:"removals"` // removals from orgs, teams, and folder permissions, and disabled or deleted users
+}
+
+// the blocked plan and the override are kept per target (see grafanaTarget)
+var brakeMutex sync.Mutex
+
+func (c *userRoleChange) action() string {
+	if c.OldRole == "" {
+		return actionAdd
+	} else if c.NewRole == "" {
+		return actionRemove
+	} else if c.NewRole.isHigherThan(c.OldRole) {
+		return actionPromote
+	}
+	return actionDemote
+}
+
+func (p *updatePlan) stats() planStats {
+	s := planStats{AffectedUsers: len(p.Users)}
+	for _, uu := range p.Users {
+		for _, change := range uu.Changes {
+			switch change.action() {
+			case actionAdd:
+				s.Additions++
+			case actionPromote:
+				s.Promotions++
+			case actionDemote:
+				s.Demotions++
+			case actionRemove:
+				s.Removals++
+			}
+		}
+		for _, change := range uu.TeamChanges {
+			if !change.Add {
+				s.Removals++
+			}
+		}
+		if uu.AdminChange != nil && !uu.AdminChange.Grant {
+			s.Demotions++
+		}
+		if uu.Offboarding != nil && uu.Offboarding.isRemoval() {
+			s.Removals++
+		}
+	}
+	for _, change := range p.FolderChanges {
+		if change.NewPermission == "" {
+			s.Removals++
+		} else if change.OldPermission.isHigherThan(change.NewPermission) {
+			s.Demotions++
+		}
+	}
+	return s
+}
+
+// checkSafetyBrake returns the limits (from the settings) the plan (for the target) exceeds
+func checkSafetyBrake(t *grafanaTarget, plan *updatePlan) (exceeded []string) {
+	s := plan.stats()
+	limits := config.Settings
+
+	if limits.MaxRemovals > 0 && s.Removals > limits.MaxRemovals {
+		exceeded = append(exceeded, fmt.Sprintf("%d removals exceed maxRemovals (%d)", s.Removals, limits.MaxRemovals))
+	}
+	if limits.MaxDemotions > 0 && s.Demotions > limits.MaxDemotions {
+		exceeded = append(exceeded, fmt.Sprintf("%d demotions exceed maxDemotions (%d)", s.Demotions, limits.MaxDemotions))
+	}
+	if allUsers := len(t.state.allUsers); limits.MaxAffectedUsersPercent > 0 && allUsers > 0 {
+		percent := float64(s.AffectedUsers) / float64(allUsers) * 100
+		if percent > limits.MaxAffectedUsersPercent {
+			exceeded = append(exceeded, fmt.Sprintf("%.1f%% affected users exceed maxAffectedUsersPercent (%.1f%%)", percent, limits.MaxAffectedUsersPercent))
+		}
+	}
+
+	return exceeded
+}
+
+// passSafetyBrake decides if a plan may be executed.
+// Plans that exceed a limit are blocked, unless an operator has overridden the brake for exactly this plan (the override is consumed by it).
+// An override for any other plan is dropped, the operator has to review the new plan first.
+func passSafetyBrake(t *grafanaTarget, plan *updatePlan) bool {
+	exceeded := checkSafetyBrake(t, plan)
+
+	brakeMutex.Lock()
+	defer brakeMutex.Unlock()
+
+	if len(exceeded) == 0 {
+		t.blockedPlan = nil
+		t.brakeOverride = ""
+		return true
+	}
+
+	id := planID(plan)
+	if t.brakeOverride != "" && t.brakeOverride == id {
+		t.brakeOverride = ""
+		t.blockedPlan = nil
+		log.Warnw("Safety brake: update plan exceeds limits, but an operator has overridden the brake. Executing it.", "target", t.Name, "planId", id, "exceededLimits", exceeded)
+		return true
+	}
+	if t.brakeOverride != "" {
+		log.Warnw("Safety brake: the plan has changed since the brake was overridden, the override is dropped", "target", t.Name, "overriddenPlanId", t.brakeOverride, "planId", id)
+		t.brakeOverride = ""
+	}
+
+	t.blockedPlan = &blockedUpdatePlan{id, plan, plan.stats(), exceeded, time.Now()}
+	log.Warnw("Safety brake: update plan exceeds limits and will NOT be executed. Review it at /admin/brake and override the brake to apply it.", "target", t.Name, "planId", id, "exceededLimits", exceeded)
+	return false
+}
+
+// addReason adds the rule responsible for a change to its display form (if there is one, changes of a saved plan might have none)
+func addReason(element map[string]interface{}, r *Rule) {
+	if r != nil {
+		element["reasonIndex"] = r.Index
+		element["reasonNote"] = r.Note
+	}
+}
+
+// planForDisplay packages all changes of a plan into an easily serializable format
+func planForDisplay(plan *updatePlan) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0)
+
+	for _, u := range plan.NewUsers {
+		element := map[string]interface{}{
+			"id":     u.key(),
+			"action": "create user",
+			"user":   u.Email,
+			"org":    "(none yet)",
+		}
+		addReason(element, u.Reason)
+		result = append(result, element)
+	}
+
+	for _, org := range plan.NewOrgs {
+		result = append(result, map[string]interface{}{
+			"id":     org.key(),
+			"action": "create org",
+			"org":    org.Name,
+		})
+	}
+
+	for _, team := range plan.NewTeams {
+		result = append(result, map[string]interface{}{
+			"id":     team.key(),
+			"action": "create team",
+			"org":    grafana.organizations[team.OrgID].Name,
+			"team":   team.Name,
+		})
+	}
+
+	for _, uu := range plan.Users {
+		for _, change := range uu.Changes {
+			element := map[string]interface{}{
+				"id":      change.key(uu.Email),
+				"action":  change.action(),
+				"user":    uu.Email,
+				"org":     change.Organization.Name,
+				"oldRole": change.OldRole,
+				"newRole": change.NewRole,
+			}
+			addReason(element, change.Reason)
+			result = append(result, element)
+		}
+
+		for _, change := range uu.TeamChanges {
+			action := "add to team"
+			if !change.Add {
+				action = "remove from team"
+			}
+			element := map[string]interface{}{
+				"id":     change.key(uu.Email),
+				"action": action,
+				"user":   uu.Email,
+				"org":    change.Organization.Name,
+				"team":   change.Team.Name,
+			}
+			addReason(element, change.Reason)
+			result = append(result, element)
+		}
+
+		if change := uu.AdminChange; change != nil {
+			action := "grant grafana admin"
+			if !change.Grant {
+				action = "revoke grafana admin"
+			}
+			element := map[string]interface{}{
+				"id":     change.key(uu.Email),
+				"action": action,
+				"user":   uu.Email,
+				"org":    "(all)",
+			}
+			addReason(element, change.Reason)
+			result = append(result, element)
+		}
+
+		if change := uu.Offboarding; change != nil {
+			result = append(result, map[string]interface{}{
+				"id":     change.key(uu.Email),
+				"action": strings.Replace(change.action(), "_", " ", -1),
+				"user":   uu.Email,
+				"org":    "(all)",
+				"why":    change.Why,
+			})
+		}
+	}
+
+	for _, change := range plan.FolderChanges {
+		element := map[string]interface{}{
+			"id":            change.key(),
+			"action":        strings.Replace(change.action(), "_", " ", -1),
+			"org":           change.Organization.Name,
+			"folder":        change.Folder.Title,
+			"oldPermission": change.OldPermission,
+			"newPermission": change.NewPermission,
+		}
+		addReason(element, change.Reason)
+		if change.Folder.IsDashboard {
+			element["folder"] = "dashboard: " + change.Folder.Title
+		}
+		if change.Team != nil {
+			element["team"] = change.Team.Name
+		} else {
+			element["user"] = change.UserEmail
+		}
+		result = append(result, element)
+	}
+
+	for _, skipped := range plan.Skipped {
+		result = append(result, map[string]interface{}{
+			"id":         "skipped|" + skipped.Change.key(skipped.Email),
+			"action":     "skipped: protected",
+			"user":       skipped.Email,
+			"org":        skipped.Change.Organization.Name,
+			"oldRole":    skipped.Change.OldRole,
+			"newRole":    skipped.Change.NewRole,
+			"protection": skipped.Why,
+		})
+	}
+
+	return result
+}
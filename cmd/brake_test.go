@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+)
+
+// roleChanges creates an update for each of the users, that changes their role in the org (because of a rule with the index 0)
+func roleChanges(org *grafanaOrganization, oldRole Role, newRole Role, emails ...string) []userUpdate {
+	var result []userUpdate
+	for _, email := range emails {
+		result = append(result, userUpdate{Email: email, Changes: []*userRoleChange{{org, oldRole, newRole, &Rule{Index: 0}}}})
+	}
+	return result
+}
+
+func TestPlanStats(t *testing.T) {
+	setupTestGrafana(&Config{}, "a@corp.com", "b@corp.com", "c@corp.com")
+	org := addTestOrg(2, "Prod", nil)
+	team := &grafanaTeam{1, 2, "SRE", nil}
+
+	plan := &updatePlan{}
+	plan.Users = append(plan.Users, roleChanges(org, "", "Viewer", "a@corp.com")...)
+	plan.Users = append(plan.Users, userUpdate{
+		Email:       "b@corp.com",
+		Changes:     []*userRoleChange{{org, "Admin", "Viewer", nil}},
+		TeamChanges: []*teamMembershipChange{{org, team, 2, false, nil}},
+		AdminChange: &grafanaAdminChange{2, false, nil},
+	})
+	plan.Users = append(plan.Users, userUpdate{
+		Email:       "c@corp.com",
+		Changes:     []*userRoleChange{{org, "Editor", "", nil}},
+		Offboarding: &offboardingChange{3, offboardingDisable, "not matched by any rule"},
+	})
+	plan.FolderChanges = []*folderPermissionChange{
+		{Organization: org, Folder: &grafanaFolder{UID: "f1"}, UserID: 1, OldPermission: "Edit", NewPermission: "View"},
+		{Organization: org, Folder: &grafanaFolder{UID: "f1"}, UserID: 2, OldPermission: "View", NewPermission: ""},
+	}
+
+	got := plan.stats()
+	want := planStats{AffectedUsers: 3, Additions: 1, Demotions: 3, Removals: 4}
+	if got != want {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckSafetyBrake(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		newRole  Role
+		affected int
+		exceeded int
+	}{
+		{"no limits", Settings{}, "", 3, 0},
+		{"removals within limit", Settings{MaxRemovals: 3}, "", 3, 0},
+		{"too many removals", Settings{MaxRemovals: 2}, "", 3, 1},
+		{"too many demotions", Settings{MaxDemotions: 2}, "Viewer", 3, 1},
+		{"demotions are not removals", Settings{MaxRemovals: 1}, "Viewer", 3, 0},
+		{"too many affected users", Settings{MaxAffectedUsersPercent: 50}, "Viewer", 3, 1},
+		{"affected users within limit", Settings{MaxAffectedUsersPercent: 50}, "Viewer", 2, 0},
+		{"all limits", Settings{MaxRemovals: 1, MaxDemotions: 1, MaxAffectedUsersPercent: 10}, "", 3, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestGrafana(&Config{Settings: test.settings}, "a@corp.com", "b@corp.com", "c@corp.com", "d@corp.com")
+			org := addTestOrg(2, "Prod", nil)
+			emails := []string{"a@corp.com", "b@corp.com", "c@corp.com"}[:test.affected]
+			plan := &updatePlan{Users: roleChanges(org, "Admin", test.newRole, emails...)}
+
+			if exceeded := checkSafetyBrake(currentTarget, plan); len(exceeded) != test.exceeded {
+				t.Errorf("checkSafetyBrake() = %v, want %d exceeded limits", exceeded, test.exceeded)
+			}
+		})
+	}
+}
+
+func TestPassSafetyBrakeOverride(t *testing.T) {
+	setupTestGrafana(&Config{Settings: Settings{MaxRemovals: 1}}, "a@corp.com", "b@corp.com", "c@corp.com")
+	org := addTestOrg(2, "Prod", nil)
+	reviewed := &updatePlan{Users: roleChanges(org, "Viewer", "", "a@corp.com", "b@corp.com")}
+	other := &updatePlan{Users: roleChanges(org, "Viewer", "", "a@corp.com", "c@corp.com")}
+	harmless := &updatePlan{Users: roleChanges(org, "", "Viewer", "a@corp.com")}
+
+	if passSafetyBrake(currentTarget, reviewed) {
+		t.Fatal("plan exceeding the limits passed the brake")
+	}
+	if currentTarget.blockedPlan == nil || currentTarget.blockedPlan.ID != planID(reviewed) {
+		t.Fatal("plan exceeding the limits was not remembered as blocked")
+	}
+
+	// the override only lets the reviewed plan pass
+	currentTarget.brakeOverride = currentTarget.blockedPlan.ID
+	if passSafetyBrake(currentTarget, other) {
+		t.Error("a different plan passed the brake with the override for the reviewed plan")
+	}
+	if currentTarget.brakeOverride != "" {
+		t.Error("override was not dropped when a different plan was blocked")
+	}
+
+	currentTarget.brakeOverride = planID(reviewed)
+	if !passSafetyBrake(currentTarget, reviewed) {
+		t.Error("reviewed plan did not pass the brake with its override")
+	}
+	if currentTarget.brakeOverride != "" || currentTarget.blockedPlan != nil {
+		t.Error("override was not consumed by the plan")
+	}
+
+	// a plan that passes by itself clears an override, so it can't be used for a later plan
+	currentTarget.brakeOverride = planID(reviewed)
+	if !passSafetyBrake(currentTarget, harmless) {
+		t.Error("plan within the limits did not pass the brake")
+	}
+	if currentTarget.brakeOverride != "" {
+		t.Error("override was not cleared by a plan within the limits")
+	}
+}
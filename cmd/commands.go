@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+func printUsage() {
+	fmt.Fprint(flag.CommandLine.Output(), `Usage: grafana-permission-sync [--configPath=./config.yaml] [command]
+
+Commands:
+  run        keep grafana in sync with the rules, and serve the http api (default)
+  validate   check the config file (including all rules), exit code 1 if it is invalid
+  plan       compute the changes that would be made and print them, without applying them
+             [--target=<name>] the grafana instance to plan for (default: the first one)
+             [--output=table|json|yaml]
+             [--out=<file>] also save the plan (as .json or .yaml), so it can be applied later
+  apply      compute the changes, apply them once, then exit
+             [--target=<name>] the grafana instance to apply to (default: the first one)
+             [--force] apply even if the plan exceeds the limits of the safety brake
+             [--plan-file=<file>] apply exactly the changes of a saved plan (to the instance it was created for), instead of computing new ones
+  explain    show the role a user gets in each org, and the rule (and groups) responsible for it
+             [--target=<name>] [--output=table|json] <email>
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func loadConfigForCommand() bool {
+	config = tryLoadConfig(configPath)
+	if config == nil {
+		fmt.Fprintln(os.Stderr, "error loading config (see log output for details)")
+		return false
+	}
+	return true
+}
+
+// setupCommand prepares what a one-shot command needs. Commands don't watch any files,
+// and only 'apply' opens the audit journal (plan and explain must not have side effects).
+func setupCommand(apply bool) bool {
+	readOnly = !apply
+	setupRateLimits()
+	setupTargets()
+
+	if apply {
+		if err := setupAuditJournal(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open audit log '%v': %v\n", config.Settings.AuditLogPath, err)
+			return false
+		}
+	}
+	if err := setupElevations(); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load elevations '%v': %v\n", config.Settings.ElevationsPath, err)
+		return false
+	}
+	if err := setupGroupProviders(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// selectTarget makes the grafana instance with the given name the current target (the first one if the name is empty)
+func selectTarget(name string) bool {
+	t := findTarget(name)
+	if t == nil {
+		fmt.Fprintf(os.Stderr, "unknown target '%v'\n", name)
+		return false
+	}
+	useTarget(t)
+	return true
+}
+
+// runValidate checks the config, returns the exit code
+func runValidate() int {
+	if !loadConfigForCommand() {
+		return 1
+	}
+	fmt.Printf("config is valid (%d rules, %d grafana instances)\n", len(config.Rules), len(config.Grafanas))
+	return 0
+}
+
+// runPlan computes a single plan and prints it, returns the exit code
+func runPlan(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	output := fs.String("output", "table", "output format: table, json or yaml")
+	outFile := fs.String("out", "", "save the plan to this file, it can be applied later using 'apply --plan-file'")
+	target := fs.String("target", "", "name of the grafana instance (default: the first one)")
+	fs.Parse(args)
+
+	if !loadConfigForCommand() || !setupCommand(false) {
+		return 1
+	}
+	if !selectTarget(*target) {
+		return 1
+	}
+
+	plan, err := createUpdatePlan()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = writePlan(os.Stdout, plan, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *outFile != "" {
+		err = writePlanFile(*outFile, plan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error saving plan: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "plan saved to '%v'\n", *outFile)
+	}
+	return 0
+}
+
+// runApply computes a single plan and executes it, returns the exit code
+func runApply(args []string) int {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	force := fs.Bool("force", false, "apply the plan even if it exceeds the limits of the safety brake")
+	planFilePath := fs.String("plan-file", "", "apply a plan that was saved using 'plan --out'")
+	target := fs.String("target", "", "name of the grafana instance (default: the first one, or the one of the saved plan)")
+	fs.Parse(args)
+
+	if !loadConfigForCommand() || !setupCommand(true) {
+		return 1
+	}
+
+	var plan *updatePlan
+	var err error
+	if *planFilePath != "" {
+		plan, err = loadSavedPlan(*planFilePath, *target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "saved plan can not be applied: %v\n", err)
+			return 1
+		}
+	} else {
+		if !selectTarget(*target) {
+			return 1
+		}
+		plan, err = createUpdatePlan()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if plan.isEmpty() {
+		fmt.Println("no changes")
+		return 0
+	}
+	writePlan(os.Stdout, plan, "table")
+
+	if exceeded := checkSafetyBrake(currentTarget, plan); len(exceeded) > 0 && !*force {
+		fmt.Fprintf(os.Stderr, "plan was not applied, it exceeds the limits of the safety brake (use --force to apply it anyway):\n  %v\n", strings.Join(exceeded, "\n  "))
+		return 1
+	}
+
+	failed := executePlan(currentTarget, plan)
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d changes could not be applied (see log output for details)\n", failed)
+		return 1
+	}
+	fmt.Println("all changes applied")
+	return 0
+}
+
+// runExplain prints the role a user gets in each org, and why; returns the exit code
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	output := fs.String("output", "table", "output format: table or json")
+	target := fs.String("target", "", "name of the grafana instance (default: the first one)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: explain [--target=<name>] [--output=table|json] <email>")
+		return 2
+	}
+	email := fs.Arg(0)
+
+	if !loadConfigForCommand() || !setupCommand(false) {
+		return 1
+	}
+	if !selectTarget(*target) {
+		return 1
+	}
+	// fetches the current state of grafana and all groups
+	if _, err := createUpdatePlan(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	permissions := explainUser(email)
+
+	switch *output {
+	case "json":
+		return writeJSON(os.Stdout, permissions)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ORG\tCURRENT\tCOMPUTED\tRESULTING\tRULE\tVIA")
+		for _, p := range permissions {
+			rule := ""
+			if p.RuleIndex != nil {
+				rule = fmt.Sprintf("#%d %v", *p.RuleIndex, p.RuleNote)
+			}
+			if p.Restricted {
+				rule += " (restriction)"
+			}
+			via := p.Groups
+			if p.ListedInUsers {
+				via = append(via, "(listed in users)")
+			}
+			for _, pattern := range p.UserPatterns {
+				via = append(via, "(matches "+pattern+")")
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", p.Organization, p.CurrentRole, p.ComputedRole, p.ResultingRole, rule, strings.Join(via, ", "))
+		}
+		w.Flush()
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown output format '%v', must be table or json\n", *output)
+	return 2
+}
+
+// loadSavedPlan reads a plan file and checks it against the current state of the grafana instance it was created for
+func loadSavedPlan(path string, target string) (*updatePlan, error) {
+	f, err := readPlanFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if target != "" && f.Target != "" && target != f.Target {
+		return nil, fmt.Errorf("plan was created for target '%v', not '%v'", f.Target, target)
+	}
+	if target == "" {
+		target = f.Target
+	}
+	t := findTarget(target)
+	if t == nil {
+		return nil, fmt.Errorf("plan was created for target '%v', which is not in the config", target)
+	}
+	useTarget(t)
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if err := grafana.fetchState(); err != nil {
+		return nil, err
+	}
+	// the groups are not fetched to apply a plan, so the rules can't be expanded (folder grants are never templated anyway)
+	var rules []*Rule
+	for _, r := range config.Rules {
+		if r.appliesTo(t.Name) {
+			rules = append(rules, r)
+		}
+	}
+	grafana.fetchFolders(rules)
+
+	return f.toUpdatePlan()
+}
+
+// writePlan prints all changes of a plan
+func writePlan(out io.Writer, plan *updatePlan, format string) error {
+	switch format {
+	case "json", "yaml":
+		bytes, err := marshalPlanFile(toPlanFile(plan), format)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(bytes)
+		return err
+	}
+
+	changes := planForDisplay(plan)
+	switch format {
+	case "table":
+		if len(changes) == 0 {
+			fmt.Fprintln(out, "no changes")
+			return nil
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ACTION\tUSER\tORG\tTEAM\tFOLDER\tOLD ROLE\tNEW ROLE\tREASON")
+		for _, c := range changes {
+			reason := ""
+			if index, exists := c["reasonIndex"]; exists {
+				reason = fmt.Sprintf("#%v %v", index, c["reasonNote"])
+			}
+			if why, exists := c["protection"]; exists {
+				reason = fmt.Sprintf("protected (%v)", why)
+			}
+			if why, exists := c["why"]; exists {
+				reason = fmt.Sprint(why)
+			}
+			oldRole, newRole := valueOrEmpty(c, "oldRole"), valueOrEmpty(c, "newRole")
+			if _, isFolderChange := c["folder"]; isFolderChange {
+				oldRole, newRole = valueOrEmpty(c, "oldPermission"), valueOrEmpty(c, "newPermission")
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", c["action"], valueOrEmpty(c, "user"), c["org"], valueOrEmpty(c, "team"), valueOrEmpty(c, "folder"), oldRole, newRole, reason)
+		}
+		return w.Flush()
+	}
+
+	return fmt.Errorf("unknown output format '%v', must be table, json or yaml", format)
+}
+
+func writeJSON(out io.Writer, obj interface{}) int {
+	bytes, err := json.MarshalIndent(obj, "", "    ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintln(out, string(bytes))
+	return 0
+}
+
+func valueOrEmpty(m map[string]interface{}, key string) interface{} {
+	if v, exists := m[key]; exists {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePlan(t *testing.T) {
+	tests := []struct {
+		format  string
+		empty   bool
+		want    []string // parts of the output
+		wantErr bool
+	}{
+		{"table", false, []string{"ACTION", "NEW ROLE", "a@corp.com", "Prod", "#3 ops", "not matched by any rule"}, false},
+		{"table", true, []string{"no changes"}, false},
+		{"json", false, []string{`"runId": "run-1"`, "a@corp.com"}, false},
+		{"yaml", false, []string{"runId: run-1", "a@corp.com"}, false},
+		{"csv", false, nil, true},
+	}
+
+	for _, test := range tests {
+		name := test.format
+		if test.empty {
+			name += " of an empty plan"
+		}
+		t.Run(name, func(t *testing.T) {
+			plan := newTestPlan()
+			if test.empty {
+				plan = &updatePlan{}
+			}
+
+			var out bytes.Buffer
+			err := writePlan(&out, plan, test.format)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("writePlan() error = %v, want error %v", err, test.wantErr)
+			}
+			for _, part := range test.want {
+				if !strings.Contains(out.String(), part) {
+					t.Errorf("writePlan() output does not contain %q:\n%v", part, out.String())
+				}
+			}
+			if test.format == "json" && !json.Valid(out.Bytes()) {
+				t.Errorf("writePlan() output is not valid json:\n%v", out.String())
+			}
+		})
+	}
+}
+
+func TestCommandsExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	validConfig := filepath.Join(dir, "config.yaml")
+	invalidConfig := filepath.Join(dir, "invalid.yaml")
+	if err := ioutil.WriteFile(validConfig, []byte("grafanas:\n  - {name: prod, url: http://prod.test}\nrules:\n  - {users: [a@corp.com], orgs: [Prod], role: Viewer}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(invalidConfig, []byte("rules:\n  - {users: [a@corp.com], orgs: [Prod], role: Owner}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfigPath, oldReadOnly := configPath, readOnly
+	defer func() { configPath, readOnly = oldConfigPath, oldReadOnly }()
+
+	// none of these get far enough to send a request to grafana
+	tests := []struct {
+		name   string
+		config string
+		run    func() int
+		want   int
+	}{
+		{"validate", validConfig, runValidate, 0},
+		{"validate invalid config", invalidConfig, runValidate, 1},
+		{"validate missing config", filepath.Join(dir, "missing.yaml"), runValidate, 1},
+		{"plan invalid config", invalidConfig, func() int { return runPlan(nil) }, 1},
+		{"plan unknown target", validConfig, func() int { return runPlan([]string{"--target=dev"}) }, 1},
+		{"apply missing plan file", validConfig, func() int { return runApply([]string{"--plan-file=" + filepath.Join(dir, "missing.json")}) }, 1},
+		{"apply unknown target", validConfig, func() int { return runApply([]string{"--target=dev"}) }, 1},
+		{"explain without email", validConfig, func() int { return runExplain(nil) }, 2},
+		{"explain several emails", validConfig, func() int { return runExplain([]string{"a@corp.com", "b@corp.com"}) }, 2},
+		{"explain unknown target", validConfig, func() int { return runExplain([]string{"--target=dev", "a@corp.com"}) }, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configPath = test.config
+			if got := test.run(); got != test.want {
+				t.Errorf("exit code = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
 
 	"time"
 
+	"github.com/cloudworkz/grafana-permission-sync/pkg/groups"
 	"gopkg.in/yaml.v2"
 )
 
@@ -19,9 +22,19 @@ type GoogleConfig struct {
 
 // GrafanaConfig -
 type GrafanaConfig struct {
+	Name     string `yaml:"name"` // identifies the grafana instance when there are multiple ('grafanas'), rules select instances by it
 	URL      string `yaml:"url"`
 	User     string `yaml:"user"`
-	Password string `yaml:"-"` // password is retreived from GRAFANA_PASS
+	Password string `yaml:"-"` // password is retreived from GRAFANA_PASS_<NAME> (or GRAFANA_PASS)
+}
+
+// defaultTargetName is the name of the grafana instance configured in 'grafana' (when 'grafanas' is not used)
+const defaultTargetName = "default"
+
+// passwordEnv returns the name of the environment variable the password of the grafana instance is read from
+func (g *GrafanaConfig) passwordEnv() string {
+	name := strings.ToUpper(regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(g.Name, "_"))
+	return "GRAFANA_PASS_" + name
 }
 
 // Settings -
@@ -31,14 +44,84 @@ type Settings struct {
 
 	CanDemote         bool `yaml:"canDemote"` // can demote a user to a lower role, or even completely remove them from an org
 	RemoveFromMainOrg bool `yaml:"removeFromMainOrg"`
+
+	// users (emails or regex) that are never demoted or removed from an org, in addition to grafana server admins and the grafana user of the sync itself
+	ProtectedUsers FlattenedArray `yaml:"protectedUsers"`
+
+	// overrides 'canDemote' for some orgs, the first policy that matches an org is used
+	OrgPolicies []OrgPolicy `yaml:"orgPolicies"`
+
+	// create orgs that are named in a rule (not by a regex) but don't exist in grafana yet
+	CreateMissingOrgs bool `yaml:"createMissingOrgs"`
+
+	// create grafana accounts (login = email, random password) for users that get a role from a rule but never logged in
+	ProvisionUsers bool `yaml:"provisionUsers"`
+
+	// disable (and eventually delete) grafana accounts of users who left
+	Offboarding OffboardingPolicy `yaml:"offboarding"`
+
+	// every change that is applied is appended to this file (one json object per line), empty means no audit log
+	AuditLogPath string `yaml:"auditLogPath"`
+
+	// just-in-time elevations (requested at /admin/elevations) are stored in this file, empty means elevations are disabled
+	ElevationsPath       string        `yaml:"elevationsPath"`
+	MaxElevationDuration time.Duration `yaml:"maxElevationDuration"` // longest duration an elevation can be requested for (default 8h)
+	ElevationAPIToken    string        `yaml:"-"`                    // callers must send it as bearer token to request elevations, read from 'ELEVATION_API_TOKEN'
+
+	// plans are not executed automatically, they wait until an operator approves them (the safety brake is not used then)
+	RequireApproval  bool   `yaml:"requireApproval"`
+	ApprovalAPIToken string `yaml:"-"` // callers must send it as bearer token to approve or reject changes, read from 'APPROVAL_API_TOKEN'
+
+	// safety brake: plans that exceed any of these limits are not executed until an operator overrides the brake (0 means no limit)
+	MaxRemovals             int     `yaml:"maxRemovals"`
+	MaxDemotions            int     `yaml:"maxDemotions"`
+	MaxAffectedUsersPercent float64 `yaml:"maxAffectedUsersPercent"`
+	BrakeAPIToken           string  `yaml:"-"` // callers must send it as bearer token to override the brake, read from 'BRAKE_API_TOKEN'
+}
+
+// the modes of an OrgPolicy
+const (
+	orgModeManaged  = "managed"  // the sync owns the org: users are demoted and removed when the rules say so
+	orgModeAdditive = "additive" // roles are only granted, access is also managed manually
+)
+
+// OffboardingPolicy decides what happens to the grafana accounts of users who left all mapped groups
+type OffboardingPolicy struct {
+	DisableUnmatched bool          `yaml:"disableUnmatched"` // disable users that are not matched by any rule
+	DisableSuspended bool          `yaml:"disableSuspended"` // disable users that are suspended in the directory (google only)
+	DeleteAfter      time.Duration `yaml:"deleteAfter"`      // delete users this long after they were disabled by the sync (0 means never, requires the audit log)
+}
+
+func (p *OffboardingPolicy) isEnabled() bool {
+	return p.DisableUnmatched || p.DisableSuspended
+}
+
+// OrgPolicy decides how much of the access to some orgs is owned by the sync
+type OrgPolicy struct {
+	Organizations FlattenedArray `yaml:"orgs"` // names or regex (enclosed in //)
+	Mode          string         `yaml:"mode"` // managed or additive
+}
+
+// canDemoteIn returns true if users may be demoted or removed in the given org
+func (s *Settings) canDemoteIn(org string) bool {
+	for _, p := range s.OrgPolicies {
+		if matchesOrgPattern(p.Organizations, org) {
+			return p.Mode == orgModeManaged
+		}
+	}
+	return s.CanDemote
 }
 
 // Config -
 type Config struct {
-	Google   GoogleConfig  `yaml:"google"`
-	Grafana  GrafanaConfig `yaml:"grafana"`
-	Settings Settings      `yaml:"settings"`
-	Rules    []*Rule       `yaml:"rules"`
+	Provider string            `yaml:"provider"` // where groups without a provider prefix are resolved from: google (default), ldap, or file
+	Google   GoogleConfig      `yaml:"google"`
+	LDAP     groups.LDAPConfig `yaml:"ldap"`
+	File     groups.FileConfig `yaml:"file"`
+	Grafana  GrafanaConfig     `yaml:"grafana"`
+	Grafanas []GrafanaConfig   `yaml:"grafanas"` // multiple grafana instances, used instead of 'grafana'
+	Settings Settings          `yaml:"settings"`
+	Rules    []*Rule           `yaml:"rules"`
 }
 
 // may return nil in case of errors
@@ -56,24 +139,91 @@ func tryLoadConfig(configPath string) *Config {
 		return nil
 	}
 
+	if c.Provider != "" && !contains(providerNames, c.Provider) {
+		log.Errorw("invalid group provider", "provider", c.Provider, "validProviders", providerNames)
+		return nil
+	}
+
+	for _, u := range c.Settings.ProtectedUsers {
+		if isRegex(u) {
+			if _, err := regexp.Compile(u[1 : len(u)-1]); err != nil {
+				log.Errorw("protected user pattern can not be compiled", "pattern", u, "error", err)
+				return nil
+			}
+		}
+	}
+
+	for i, p := range c.Settings.OrgPolicies {
+		if p.Mode != orgModeManaged && p.Mode != orgModeAdditive {
+			log.Errorw("invalid org policy mode, must be 'managed' or 'additive'", "policyIndex", i, "mode", p.Mode)
+			return nil
+		}
+		for _, o := range p.Organizations {
+			if isRegex(o) {
+				if _, err := regexp.Compile(o[1 : len(o)-1]); err != nil {
+					log.Errorw("org pattern of org policy can not be compiled", "policyIndex", i, "pattern", o, "error", err)
+					return nil
+				}
+			}
+		}
+	}
+
+	if len(c.Grafanas) > 0 && c.Grafana.URL != "" {
+		log.Errorw("use either 'grafana' or 'grafanas', not both")
+		return nil
+	}
+	if len(c.Grafanas) == 0 {
+		if c.Grafana.Name == "" {
+			c.Grafana.Name = defaultTargetName
+		}
+		c.Grafanas = []GrafanaConfig{c.Grafana}
+	}
+	var targetNames []string
+	for i := range c.Grafanas {
+		g := &c.Grafanas[i]
+		if g.Name == "" || contains(targetNames, g.Name) {
+			log.Errorw("every grafana instance in 'grafanas' needs a unique name", "index", i, "name", g.Name)
+			return nil
+		}
+		targetNames = append(targetNames, g.Name)
+
+		g.Password = os.Getenv(g.passwordEnv())
+		if g.Password == "" {
+			g.Password = os.Getenv("GRAFANA_PASS")
+		}
+	}
+
+	if c.Settings.Offboarding.DeleteAfter > 0 && c.Settings.AuditLogPath == "" {
+		log.Errorw("offboarding.deleteAfter requires the audit log (auditLogPath), it is used to find out when a user was disabled")
+		return nil
+	}
+
 	for i, r := range c.Rules {
 		r.Index = i
-		err := r.verify()
+		err := r.verify(&c)
 		if err != nil {
-			log.Errorw("error verifying rule", "error", err, "role", r.Role)
+			log.Errorw("error verifying rule", "error", err, "ruleIndex", i, "role", r.Role)
 			return nil
 		}
 	}
 
-	c.Grafana.Password = os.Getenv("GRAFANA_PASS")
+	c.LDAP.BindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	c.Settings.ElevationAPIToken = os.Getenv("ELEVATION_API_TOKEN")
+	c.Settings.BrakeAPIToken = os.Getenv("BRAKE_API_TOKEN")
+	c.Settings.ApprovalAPIToken = os.Getenv("APPROVAL_API_TOKEN")
 
 	return &c
 }
 
+// getAllGroups returns all groups the rules reference by name (group patterns are not included)
 func (c *Config) getAllGroups() []string {
 	var ar []string
 	for _, e := range c.Rules {
-		ar = append(ar, e.Groups...)
+		for _, g := range e.Groups {
+			if _, key := c.parseGroupRef(g); !isRegex(key) {
+				ar = append(ar, g)
+			}
+		}
 	}
 	return distinct(ar)
 }
@@ -85,3 +235,22 @@ func (c *Config) getAllUsers() []string {
 	}
 	return distinct(ar)
 }
+
+func (c *Config) hasTeamRules() bool {
+	for _, r := range c.Rules {
+		if len(r.Teams) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTarget returns true if there is a grafana instance with the given name
+func (c *Config) hasTarget(name string) bool {
+	for _, g := range c.Grafanas {
+		if g.Name == name {
+			return true
+		}
+	}
+	return false
+}
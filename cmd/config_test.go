@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanDemoteIn(t *testing.T) {
+	policies := []OrgPolicy{
+		{Organizations: FlattenedArray{"Shared"}, Mode: orgModeAdditive},
+		{Organizations: FlattenedArray{"/^Team /"}, Mode: orgModeManaged},
+		{Organizations: FlattenedArray{"/.*/"}, Mode: orgModeAdditive}, // only for orgs no earlier policy matches
+	}
+
+	tests := []struct {
+		name      string
+		canDemote bool
+		policies  []OrgPolicy
+		org       string
+		want      bool
+	}{
+		{"no policies, canDemote", true, nil, "Prod", true},
+		{"no policies", false, nil, "Prod", false},
+		{"no matching policy, canDemote", true, policies[:2], "Prod", true},
+		{"no matching policy", false, policies[:2], "Prod", false},
+		{"additive", true, policies, "Shared", false},
+		{"managed by pattern", false, policies, "Team SRE", true},
+		{"first matching policy wins", true, policies, "Prod", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Settings{CanDemote: test.canDemote, OrgPolicies: test.policies}
+			if got := s.canDemoteIn(test.org); got != test.want {
+				t.Errorf("canDemoteIn(%q) = %v, want %v", test.org, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigOrgPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		policies string
+		valid    bool
+	}{
+		{"managed and additive", `[{orgs: ["Prod", "/^Team /"], mode: managed}, {orgs: ["Shared"], mode: additive}]`, true},
+		{"invalid mode", `[{orgs: ["Prod"], mode: readonly}]`, false},
+		{"missing mode", `[{orgs: ["Prod"]}]`, false},
+		{"invalid pattern", `[{orgs: ["/(/"], mode: managed}]`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "config.yaml")
+			content := "grafana:\n  url: http://grafana.test\nsettings:\n  orgPolicies: " + test.policies + "\n"
+			if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			c := tryLoadConfig(path)
+			if (c != nil) != test.valid {
+				t.Fatalf("tryLoadConfig() = %v, want a valid config: %v", c, test.valid)
+			}
+			if c != nil && len(c.Settings.OrgPolicies) != 2 {
+				t.Errorf("config has %d org policies, want 2", len(c.Settings.OrgPolicies))
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/elevation"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// elevations are not part of the config, their rules all have this index
+	elevationRuleIndex = -1
+
+	// expired grants are kept for a while, so their role can still be revoked when grafana could not be updated right away
+	elevationRetention = 7 * 24 * time.Hour
+
+	defaultMaxElevationDuration = 8 * time.Hour
+)
+
+var elevations *elevation.Store // nil if no 'elevationsPath' is configured
+
+// elevationRequest asks for a role in an org (of a grafana instance) for a limited time
+type elevationRequest struct {
+	User        string `json:"user"`
+	Org         string `json:"org"`
+	Target      string `json:"target"` // name of the grafana instance, empty means the first one
+	Role        Role   `json:"role"`
+	Duration    string `json:"duration"` // like "2h"
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requestedBy"`
+}
+
+func setupElevations() error {
+	if config.Settings.ElevationsPath == "" {
+		return nil
+	}
+
+	var err error
+	elevations, err = elevation.Open(config.Settings.ElevationsPath)
+	return err
+}
+
+func maxElevationDuration() time.Duration {
+	if config.Settings.MaxElevationDuration <= 0 {
+		return defaultMaxElevationDuration
+	}
+	return config.Settings.MaxElevationDuration
+}
+
+// authorizeElevation checks the bearer token of a request against 'ELEVATION_API_TOKEN'
+func authorizeElevation(c *gin.Context) bool {
+	return authorizeToken(c, config.Settings.ElevationAPIToken)
+}
+
+// authorizeToken checks the bearer token of a request against the given token, nothing is authorized if the token is not set
+func authorizeToken(c *gin.Context, token string) bool {
+	given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
+
+// toGrant checks the request against the settings and the current state of grafana (the current target must be the one of the request)
+func (r *elevationRequest) toGrant() (elevation.Grant, error) {
+	if r.User == "" || r.Org == "" || r.Reason == "" {
+		return elevation.Grant{}, fmt.Errorf("'user', 'org', and 'reason' are required")
+	}
+	if r.Role != "Viewer" && r.Role != "Editor" && r.Role != "Admin" {
+		return elevation.Grant{}, fmt.Errorf("invalid role '%v', must be one of [Viewer, Editor, Admin]", r.Role)
+	}
+
+	duration, err := time.ParseDuration(r.Duration)
+	if err != nil {
+		return elevation.Grant{}, fmt.Errorf("invalid duration: %v", err)
+	}
+	if duration <= 0 || duration > maxElevationDuration() {
+		return elevation.Grant{}, fmt.Errorf("duration must be positive and at most %v", maxElevationDuration())
+	}
+
+	if isRegex(r.Org) || grafana.findOrg(r.Org) == nil || grafana.findOrg(r.Org).ID == 0 {
+		return elevation.Grant{}, fmt.Errorf("org '%v' does not exist", r.Org)
+	}
+	if grafana.findUser(r.User) == nil {
+		return elevation.Grant{}, fmt.Errorf("user '%v' does not exist in grafana (they have to log in once)", r.User)
+	}
+	var previous Role
+	if orgUser := grafana.findOrg(r.Org).findUser(r.User); orgUser != nil {
+		previous = Role(orgUser.Role)
+	}
+	if previous.isHigherOrEqThan(r.Role) {
+		return elevation.Grant{}, fmt.Errorf("user '%v' already has the role %v in org '%v'", r.User, previous, r.Org)
+	}
+
+	return elevation.Grant{
+		User:        r.User,
+		Org:         r.Org,
+		Target:      currentTarget.Name,
+		Role:        string(r.Role),
+		Previous:    string(previous),
+		Reason:      r.Reason,
+		RequestedBy: r.RequestedBy,
+		Expires:     time.Now().UTC().Add(duration),
+	}, nil
+}
+
+// grantRule creates a rule that gives the user of a grant its role, until the grant expires
+func grantRule(g elevation.Grant) *Rule {
+	expires := g.Expires
+	return &Rule{
+		Note:          fmt.Sprintf("elevation %v: %v (requested by %v)", g.ID, g.Reason, g.RequestedBy),
+		Index:         elevationRuleIndex,
+		Users:         FlattenedArray{g.User},
+		Organizations: FlattenedArray{g.Org},
+		Targets:       FlattenedArray{grantTarget(g)},
+		Role:          Role(g.Role),
+		ValidUntil:    &expires,
+	}
+}
+
+// grantTarget returns the name of the grafana instance of a grant.
+// Grants from before there were multiple instances have none, they belong to the first one.
+func grantTarget(g elevation.Grant) string {
+	if g.Target == "" && len(config.Grafanas) > 0 {
+		return config.Grafanas[0].Name
+	}
+	return g.Target
+}
+
+// elevationRules returns a rule for every active grant (and forgets grants that expired long ago)
+func elevationRules(now time.Time) []*Rule {
+	if elevations == nil {
+		return nil
+	}
+
+	// commands that only compute a plan leave the file as it is (expired grants are skipped below anyway)
+	if !readOnly {
+		if err := elevations.Prune(now.Add(-elevationRetention)); err != nil {
+			log.Errorw("unable to remove expired elevations", "error", err)
+		}
+	}
+
+	var rules []*Rule
+	for _, g := range elevations.Grants() {
+		if g.IsActive(now) {
+			rules = append(rules, grantRule(g))
+		}
+	}
+	return rules
+}
+
+// revokeElevation takes away the role of an expired elevation, for changes that keepChange would drop (without 'canDemote', or in additive orgs).
+// The user goes back to the role they had before the elevation (or the role the rules give them, if that is higher), never lower than that.
+// Returns true if the (adjusted) change should be made.
+func revokeElevation(email string, change *userRoleChange) bool {
+	if elevations == nil || !change.NewRole.isLowerThan(change.OldRole) {
+		return false
+	}
+
+	now := time.Now()
+	for _, g := range elevations.Grants() {
+		if g.User != email || g.Org != change.Organization.Name || grantTarget(g) != currentTarget.Name || Role(g.Role) != change.OldRole || g.IsActive(now) {
+			continue
+		}
+
+		revertTo, reason := Role(g.Previous), (*Rule)(nil) // no rule gives the role from before the elevation
+		if change.NewRole.isHigherOrEqThan(revertTo) {
+			revertTo, reason = change.NewRole, change.Reason
+		}
+		if !revertTo.isLowerThan(change.OldRole) {
+			return false
+		}
+		if revertTo.isLowerThan(change.Organization.unresolvedRole) {
+			return false // a rule for this org depends on a group that could not be resolved, the user might still be entitled to their role
+		}
+		if change.Organization.ID == 1 && revertTo == "" && !config.Settings.RemoveFromMainOrg {
+			return false
+		}
+		change.NewRole, change.Reason = revertTo, reason
+		return true
+	}
+	return false
+}
+
+// elevationsForDisplay lists all grants (active and recently expired ones)
+func elevationsForDisplay() []map[string]interface{} {
+	result := make([]map[string]interface{}, 0)
+	if elevations == nil {
+		return result
+	}
+
+	now := time.Now()
+	for _, g := range elevations.Grants() {
+		result = append(result, map[string]interface{}{
+			"id":          g.ID,
+			"user":        g.User,
+			"org":         g.Org,
+			"target":      grantTarget(g),
+			"role":        g.Role,
+			"reason":      g.Reason,
+			"requestedBy": g.RequestedBy,
+			"created":     g.Created,
+			"expires":     g.Expires,
+			"active":      g.IsActive(now),
+		})
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/elevation"
+)
+
+func TestElevationRequestToGrant(t *testing.T) {
+	setupTestGrafana(&Config{}, "a@corp.com", "b@corp.com")
+	addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Editor"})
+
+	request := func(user string, role Role, duration string) *elevationRequest {
+		return &elevationRequest{User: user, Org: "Prod", Role: role, Duration: duration, Reason: "incident"}
+	}
+
+	tests := []struct {
+		name     string
+		request  *elevationRequest
+		previous string
+		wantErr  string
+	}{
+		{"not a member", request("b@corp.com", "Admin", "1h"), "", ""},
+		{"member", request("a@corp.com", "Admin", "1h"), "Editor", ""},
+		{"same role", request("a@corp.com", "Editor", "1h"), "", "already has the role Editor"},
+		{"lower role", request("a@corp.com", "Viewer", "1h"), "", "already has the role Editor"},
+		{"unknown user", request("c@corp.com", "Admin", "1h"), "", "does not exist in grafana"},
+		{"unknown org", &elevationRequest{User: "b@corp.com", Org: "Dev", Role: "Admin", Duration: "1h", Reason: "incident"}, "", "does not exist"},
+		{"invalid role", request("b@corp.com", "Owner", "1h"), "", "invalid role"},
+		{"too long", request("b@corp.com", "Admin", "9h"), "", "at most"},
+		{"no reason", &elevationRequest{User: "b@corp.com", Org: "Prod", Role: "Admin", Duration: "1h"}, "", "required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, err := test.request.toGrant()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("toGrant() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("toGrant() error = %v", err)
+			}
+			if g.Previous != test.previous || g.Role != string(test.request.Role) || g.Target != currentTarget.Name {
+				t.Errorf("toGrant() = %+v, want role %v with previous role %q", g, test.request.Role, test.previous)
+			}
+		})
+	}
+}
+
+func TestRevokeElevation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elevations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	tests := []struct {
+		name           string
+		org            uint
+		grantRole      Role
+		previous       Role
+		active         bool
+		oldRole        Role
+		newRole        Role // computed by the rules
+		unresolvedRole Role
+		want           bool
+		wantRole       Role
+	}{
+		{"back to the previous role", 2, "Admin", "Viewer", false, "Admin", "", "", true, "Viewer"},
+		{"back to no role", 2, "Admin", "", false, "Admin", "", "", true, ""},
+		{"rules give more than the previous role", 2, "Admin", "Viewer", false, "Admin", "Editor", "", true, "Editor"},
+		{"still active", 2, "Admin", "Viewer", true, "Admin", "", "", false, ""},
+		{"role changed since", 2, "Editor", "Viewer", false, "Admin", "", "", false, ""},
+		{"not a demotion", 2, "Admin", "Viewer", false, "Admin", "Admin", "", false, "Admin"},
+		{"unresolved rule", 2, "Admin", "", false, "Admin", "", "Viewer", false, ""},
+		{"main org", 1, "Admin", "", false, "Admin", "", "", false, ""},
+		{"main org, previous role", 1, "Admin", "Viewer", false, "Admin", "", "", true, "Viewer"},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestGrafana(&Config{}, "a@corp.com")
+			org := addTestOrg(test.org, "Prod", map[string]Role{"a@corp.com": test.oldRole})
+			org.unresolvedRole = test.unresolvedRole
+
+			var err error
+			elevations, err = elevation.Open(filepath.Join(dir, fmt.Sprintf("elevations-%d.json", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { elevations = nil }()
+			expires := now.Add(-time.Hour)
+			if test.active {
+				expires = now.Add(time.Hour)
+			}
+			grant := elevation.Grant{User: "a@corp.com", Org: "Prod", Target: currentTarget.Name, Role: string(test.grantRole), Previous: string(test.previous), Expires: expires}
+			if _, err := elevations.Add(grant); err != nil {
+				t.Fatal(err)
+			}
+
+			rule := &Rule{Role: test.newRole}
+			change := &userRoleChange{org, test.oldRole, test.newRole, rule}
+			if got := revokeElevation("a@corp.com", change); got != test.want {
+				t.Fatalf("revokeElevation() = %v, want %v", got, test.want)
+			}
+			if test.want && change.NewRole != test.wantRole {
+				t.Errorf("revokeElevation() new role = %q, want %q", change.NewRole, test.wantRole)
+			}
+			if test.want && (change.Reason == rule) != (test.wantRole == test.newRole) {
+				t.Errorf("revokeElevation() reason = %v, want the rule only if its role is kept", change.Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// ruleExpiration describes a rule that will stop being applied soon, and the users that are affected by it right now
+type ruleExpiration struct {
+	Target        string    `json:"target"`
+	RuleIndex     int       `json:"ruleIndex"`
+	RuleNote      string    `json:"ruleNote,omitempty"`
+	Role          Role      `json:"role,omitempty"`
+	Organizations []string  `json:"orgs"`
+	ValidUntil    time.Time `json:"validUntil"`
+	ExpiresIn     string    `json:"expiresIn"`
+	Users         []string  `json:"users"`
+}
+
+// upcomingExpirations lists the active rules of the given targets that expire within the given duration (soonest first).
+// The active rules of a target are the ones its last plan was based on.
+func upcomingExpirations(targets []*grafanaTarget, within time.Duration) []*ruleExpiration {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	now := time.Now()
+	type ruleKey struct {
+		target string
+		index  int
+		note   string
+	}
+	byRule := make(map[ruleKey]*ruleExpiration)
+
+	for _, t := range targets {
+		for _, rule := range t.activeRules {
+			if rule.ValidUntil == nil || !rule.isActive(now) || rule.ValidUntil.Sub(now) > within {
+				continue
+			}
+
+			// templated rules are expanded into many rules, they are reported as one (elevations all have the same index, but a different note)
+			key := ruleKey{t.Name, rule.Index, rule.Note}
+			e, exists := byRule[key]
+			if !exists {
+				e = &ruleExpiration{t.Name, rule.Index, rule.Note, rule.Role, nil, *rule.ValidUntil, rule.ValidUntil.Sub(now).Round(time.Second).String(), make([]string, 0)}
+				byRule[key] = e
+			}
+			users, _ := rule.resolveUsers()
+			e.Organizations = distinct(append(e.Organizations, rule.Organizations...))
+			e.Users = distinct(append(e.Users, users...))
+		}
+	}
+
+	result := make([]*ruleExpiration, 0, len(byRule))
+	for _, e := range byRule {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ValidUntil.Before(result[j].ValidUntil)
+	})
+	return result
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpcomingExpirations(t *testing.T) {
+	now := time.Now()
+	soon, later, past := now.Add(time.Hour), now.Add(30*24*time.Hour), now.Add(-time.Hour)
+	rule := func(index int, note string, until *time.Time, users ...string) *Rule {
+		return &Rule{Index: index, Note: note, Users: FlattenedArray(users), Organizations: FlattenedArray{"Prod"}, Role: "Viewer", ValidUntil: until}
+	}
+
+	prod := &grafanaTarget{Name: "prod", activeRules: []*Rule{
+		rule(0, "", &soon, "a@corp.com"),
+		rule(0, "", &soon, "b@corp.com"), // expanded from the same templated rule
+		rule(1, "", &later, "c@corp.com"),
+		rule(2, "", nil, "d@corp.com"),
+		rule(3, "", &past, "e@corp.com"),
+	}}
+	staging := &grafanaTarget{Name: "staging", activeRules: []*Rule{
+		rule(0, "", &soon, "f@corp.com"),
+		rule(-1, "elevation 1", &soon, "g@corp.com"),
+	}}
+
+	tests := []struct {
+		name    string
+		targets []*grafanaTarget
+		want    []string
+	}{
+		{"one target", []*grafanaTarget{prod}, []string{"prod#0 a@corp.com,b@corp.com"}},
+		{"all targets", []*grafanaTarget{prod, staging}, []string{"prod#0 a@corp.com,b@corp.com", "staging#-1 g@corp.com", "staging#0 f@corp.com"}},
+		{"target without plan", []*grafanaTarget{{Name: "new"}}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, e := range upcomingExpirations(test.targets, 24*time.Hour) {
+				got = append(got, fmt.Sprintf("%v#%d %v", e.Target, e.RuleIndex, strings.Join(e.Users, ",")))
+			}
+			sort.Strings(got)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("upcomingExpirations() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// orgPermission describes what role a user gets in an organization, and why
+type orgPermission struct {
+	Organization  string   `json:"organization"`
+	CurrentRole   Role     `json:"currentRole"`          // role the user has in grafana right now
+	ComputedRole  Role     `json:"computedRole"`         // highest role granted by the rules
+	ResultingRole Role     `json:"resultingRole"`        // role after the next update (demotions/removals might not be allowed)
+	Protection    string   `json:"protection,omitempty"` // why the user is not demoted or removed, even though the rules say so
+	RuleIndex     *int     `json:"ruleIndex,omitempty"`
+	RuleNote      string   `json:"ruleNote,omitempty"`
+	Groups        []string `json:"groups,omitempty"` // groups that connect the user to the rule (nested groups are shown as a path)
+	ListedInUsers bool     `json:"listedInUsers,omitempty"`
+	UserPatterns  []string `json:"userPatterns,omitempty"` // patterns in the 'users' of the rule that match the user
+	Restricted    bool     `json:"restricted,omitempty"`   // the rule is a restriction (exclude or maxRole) that lowered the role
+
+	PatternMatches map[string][]string `json:"patternMatches,omitempty"` // everything the patterns (in groups and users) of the rule matched
+}
+
+// explainUser runs the same logic as createUpdatePlan, but only for a single user,
+// and reports the outcome (and the rule responsible for it) for every organization.
+func explainUser(email string) []*orgPermission {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	update := newUserUpdate(email)
+	updates := map[string]*userUpdate{email: update}
+
+	applyRules(updates)
+
+	result := make([]*orgPermission, 0, len(update.Changes))
+	for _, change := range update.Changes {
+		p := &orgPermission{
+			Organization:  change.Organization.Name,
+			CurrentRole:   change.OldRole,
+			ComputedRole:  change.NewRole,
+			ResultingRole: change.OldRole,
+		}
+		if keepChange(change) || revokeElevation(email, change) {
+			if p.Protection = protectedFrom(email, change); p.Protection == "" {
+				p.ResultingRole = change.NewRole
+			}
+		}
+
+		if change.Reason != nil {
+			index := change.Reason.Index
+			p.RuleIndex = &index
+			p.RuleNote = change.Reason.Note
+			p.Groups, p.ListedInUsers = change.Reason.connections(email)
+			p.UserPatterns = change.Reason.userPatternsMatching(email)
+			p.Restricted = change.Reason.isRestriction()
+			if len(change.Reason.patternMatches) > 0 {
+				p.PatternMatches = change.Reason.patternMatches
+			}
+		}
+
+		result = append(result, p)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Organization) < strings.ToLower(result[j].Organization)
+	})
+
+	return result
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// describePermission formats the parts of an orgPermission the tests look at,
+// like "Viewer>Editor>Editor rule 0 listed" (current>computed>resulting role)
+func describePermission(p *orgPermission) string {
+	s := fmt.Sprintf("%v>%v>%v", p.CurrentRole, p.ComputedRole, p.ResultingRole)
+	if p.RuleIndex != nil {
+		s += fmt.Sprintf(" rule %d", *p.RuleIndex)
+	}
+	if len(p.Groups) > 0 {
+		s += " via " + strings.Join(p.Groups, ",")
+	}
+	if p.ListedInUsers {
+		s += " listed"
+	}
+	if len(p.UserPatterns) > 0 {
+		s += " matches " + strings.Join(p.UserPatterns, ",")
+	}
+	if p.Restricted {
+		s += " restricted"
+	}
+	if p.Protection != "" {
+		s += " protected"
+	}
+	return s
+}
+
+func TestExplainUser(t *testing.T) {
+	defer setupTestGroups(t, "ops: [a@corp.com]\nsre: [b@corp.com, ops]\n")()
+
+	grant := func(role Role, orgs ...string) *Rule {
+		return &Rule{Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray(orgs), Role: role}
+	}
+
+	tests := []struct {
+		name     string
+		settings Settings
+		rules    []*Rule
+		want     []string // "org: description" for every org, sorted by org
+	}{
+		{"listed in users", Settings{CanDemote: true}, []*Rule{grant("Editor", "Prod")}, []string{
+			"Dev: >>",
+			"Prod: Viewer>Editor>Editor rule 0 listed",
+			"Staging: Editor>>",
+		}},
+		{"highest role wins", Settings{CanDemote: true}, []*Rule{grant("Viewer", "/.*/"), grant("Admin", "Prod")}, []string{
+			"Dev: >Viewer>Viewer rule 0 listed",
+			"Prod: Viewer>Admin>Admin rule 1 listed",
+			"Staging: Editor>Viewer>Viewer rule 0 listed",
+		}},
+		{"nested group", Settings{CanDemote: true}, []*Rule{{Groups: FlattenedArray{"file:sre"}, Organizations: FlattenedArray{"Dev"}, Role: "Viewer"}}, []string{
+			"Dev: >Viewer>Viewer rule 0 via sre > ops",
+			"Prod: Viewer>>",
+			"Staging: Editor>>",
+		}},
+		{"user pattern", Settings{CanDemote: true}, []*Rule{{Users: FlattenedArray{`/.*@corp\.com/`}, Organizations: FlattenedArray{"Dev"}, Role: "Editor"}}, []string{
+			"Dev: >Editor>Editor rule 0 matches /.*@corp\\.com/",
+			"Prod: Viewer>>",
+			"Staging: Editor>>",
+		}},
+		{"exclusion", Settings{CanDemote: true}, []*Rule{grant("Editor", "Prod", "Staging"), {Groups: FlattenedArray{"file:ops"}, Organizations: FlattenedArray{"Prod"}, Exclude: true}}, []string{
+			"Dev: >>",
+			"Prod: Viewer>> rule 1 via ops restricted",
+			"Staging: Editor>Editor>Editor rule 0 listed",
+		}},
+		{"maxRole", Settings{CanDemote: true}, []*Rule{grant("Admin", "Prod", "Staging"), {Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"Staging"}, MaxRole: "Viewer"}}, []string{
+			"Dev: >>",
+			"Prod: Viewer>Admin>Admin rule 0 listed",
+			"Staging: Editor>Viewer>Viewer rule 1 listed restricted",
+		}},
+		{"demotions not allowed", Settings{}, []*Rule{grant("Viewer", "Staging")}, []string{
+			"Dev: >>",
+			"Prod: Viewer>>Viewer",
+			"Staging: Editor>Viewer>Editor rule 0 listed",
+		}},
+		{"unresolved group", Settings{CanDemote: true}, []*Rule{grant("Viewer", "Staging"), {Groups: FlattenedArray{"file:missing"}, Organizations: FlattenedArray{"Staging"}, Role: "Editor"}}, []string{
+			"Dev: >>",
+			"Prod: Viewer>>",
+			"Staging: Editor>Viewer>Editor rule 0 listed", // the user might be in the missing group
+		}},
+		{"unresolved restriction", Settings{CanDemote: true}, []*Rule{grant("Admin", "Prod"), {Groups: FlattenedArray{"file:missing"}, Organizations: FlattenedArray{"Prod"}, Exclude: true}}, []string{
+			"Dev: >>",
+			"Prod: Viewer>Admin>Viewer rule 0 listed", // the user might be in the missing group
+			"Staging: Editor>>",
+		}},
+		{"protected user", Settings{CanDemote: true, ProtectedUsers: []string{"a@corp.com"}}, []*Rule{grant("Admin", "Prod")}, []string{
+			"Dev: >>",
+			"Prod: Viewer>Admin>Admin rule 0 listed",
+			"Staging: Editor>>Editor protected",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestGrafana(&Config{Settings: test.settings, Rules: test.rules}, "a@corp.com", "b@corp.com")
+			addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Viewer"})
+			addTestOrg(3, "Dev", nil)
+			addTestOrg(4, "Staging", map[string]Role{"a@corp.com": "Editor", "b@corp.com": "Viewer"})
+			activeRules = expandRules()
+
+			var got []string
+			for _, p := range explainUser("a@corp.com") {
+				got = append(got, p.Organization+": "+describePermission(p))
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("explainUser() =\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestExplainUserPatternMatches(t *testing.T) {
+	defer setupTestGroups(t, "team-a: [a@corp.com]\nteam-b: [b@corp.com]\nother: [a@corp.com]\n")()
+
+	rule := &Rule{Groups: FlattenedArray{"file:/team-.*/"}, Organizations: FlattenedArray{"Prod"}, Role: "Editor"}
+	setupTestGrafana(&Config{Rules: []*Rule{rule}}, "a@corp.com", "b@corp.com")
+	addTestOrg(2, "Prod", nil)
+	activeRules = expandRules()
+
+	result := explainUser("a@corp.com")
+	if len(result) != 1 {
+		t.Fatalf("explainUser() = %v, want one org", result)
+	}
+	p := result[0]
+	if got, want := describePermission(p), ">Editor>Editor rule 0 via team-a"; got != want {
+		t.Errorf("explainUser() = %v, want %v", got, want)
+	}
+	if got := strings.Join(p.PatternMatches["file:/team-.*/"], ","); got != "file:team-a,file:team-b" {
+		t.Errorf("pattern matches = %v, want file:team-a,file:team-b", got)
+	}
+}
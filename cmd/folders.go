@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// Permission is a folder or dashboard permission: View, Edit, Admin, or <empty> (no permission)
+type Permission string
+
+var permissionLevels = map[Permission]int{
+	"":      0,
+	"View":  1,
+	"Edit":  2,
+	"Admin": 4,
+}
+
+func permissionFromLevel(level int) Permission {
+	for p, l := range permissionLevels {
+		if l == level {
+			return p
+		}
+	}
+	return ""
+}
+
+func (p Permission) isHigherThan(other Permission) bool {
+	return permissionLevels[p] > permissionLevels[other]
+}
+
+// PermissionGrant is a folder (or dashboard) that the users (or teams) of a rule get a permission for
+type PermissionGrant struct {
+	UID        string     `yaml:"uid"`
+	Title      string     `yaml:"title"` // folders only, can be used instead of the uid
+	Permission Permission `yaml:"permission"`
+}
+
+func (g *PermissionGrant) verify(isDashboard bool) error {
+	if g.Permission != "View" && g.Permission != "Edit" && g.Permission != "Admin" {
+		return fmt.Errorf("invalid permission '%v', must be one of [View, Edit, Admin]", g.Permission)
+	}
+	if isDashboard && g.UID == "" {
+		return fmt.Errorf("dashboards must be specified by their 'uid'")
+	}
+	if !isDashboard && g.UID == "" && g.Title == "" {
+		return fmt.Errorf("folders must be specified by their 'uid' or 'title'")
+	}
+	return nil
+}
+
+func (g *PermissionGrant) matches(f *grafanaFolder) bool {
+	if g.UID != "" {
+		return g.UID == f.UID
+	}
+	return g.Title == f.Title
+}
+
+// grafanaFolder is a folder, or a dashboard (which has its own permissions as well)
+type grafanaFolder struct {
+	ID          uint   `json:"id"`
+	UID         string `json:"uid"`
+	Title       string `json:"title"`
+	IsDashboard bool   `json:"-"`
+
+	Permissions []folderPermission `json:"-"` // only fetched for folders and dashboards that are referenced by a rule
+}
+
+// folderPermission is an entry of the access control list of a folder or dashboard
+type folderPermission struct {
+	UserID     uint   `json:"userId"`
+	UserEmail  string `json:"userEmail"`
+	TeamID     uint   `json:"teamId"`
+	Team       string `json:"team"`
+	Role       string `json:"role"` // permission for everyone with an org role (not managed by the sync)
+	Permission int    `json:"permission"`
+	Inherited  bool   `json:"inherited"` // dashboards inherit the permissions of their folder
+}
+
+// folderPermissionChange gives a user or team a different permission for a folder (or dashboard)
+type folderPermissionChange struct {
+	Organization  *grafanaOrganization
+	Folder        *grafanaFolder
+	UserID        uint         // either the user...
+	UserEmail     string       //
+	Team          *grafanaTeam // ...or the team gets the permission (the team might be created by the same plan)
+	OldPermission Permission
+	NewPermission Permission
+	Reason        *Rule
+}
+
+func (f *grafanaFolder) kind() string {
+	if f.IsDashboard {
+		return "dashboard"
+	}
+	return "folder"
+}
+
+func (f *grafanaFolder) permissionsPath() string {
+	if f.IsDashboard {
+		return fmt.Sprintf("/api/dashboards/id/%d/permissions", f.ID)
+	}
+	return fmt.Sprintf("/api/folders/%v/permissions", f.UID)
+}
+
+// grantee is the name of the user or team the permission is for
+func (c *folderPermissionChange) grantee() string {
+	if c.Team != nil {
+		return "team:" + c.Team.Name
+	}
+	return c.UserEmail
+}
+
+func (c *folderPermissionChange) action() string {
+	if c.OldPermission == "" {
+		return "permission_add"
+	} else if c.NewPermission == "" {
+		return "permission_remove"
+	}
+	return "permission_update"
+}
+
+func (o *grafanaOrganization) findFolder(uid string, isDashboard bool) *grafanaFolder {
+	for _, f := range o.Folders {
+		if f.UID == uid && f.IsDashboard == isDashboard {
+			return f
+		}
+	}
+	return nil
+}
+
+// folderPageSize is the number of folders requested at once, grafana returns at most 1000
+const folderPageSize = 1000
+
+// fetchFolders gets the folders and dashboards of every org that are referenced by the given rules (with their permissions).
+// Orgs whose folders can't be listed are marked, only their folder permissions are not planned in this run.
+func (g *grafanaState) fetchFolders(rules []*Rule) {
+	needed := false
+	for _, r := range rules {
+		if len(r.Folders) > 0 || len(r.Dashboards) > 0 {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return
+	}
+
+	for _, org := range g.organizations {
+		folders, err := g.getFolders(org.ID, rules)
+		if err != nil {
+			log.Errorw("error listing folders for org, no folder permissions are changed in it in this run", "org", org.Name, "error", err.Error())
+			org.unresolvedFolders = true
+			continue
+		}
+		org.Folders = folders
+	}
+}
+
+// getFolders fetches all folders of an org, and the dashboards that are referenced by one of the rules.
+// Permissions are only fetched for folders and dashboards that are referenced by one of the rules.
+func (g *grafanaState) getFolders(orgID uint, rules []*Rule) ([]*grafanaFolder, error) {
+	var folders []*grafanaFolder
+	for page := 1; ; page++ {
+		var batch []*grafanaFolder
+		g.Wait()
+		err := g.apiRequest("GET", fmt.Sprintf("/api/folders?limit=%d&page=%d", folderPageSize, page), orgID, nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, batch...)
+		if len(batch) < folderPageSize {
+			break
+		}
+	}
+
+	referenced := func(f *grafanaFolder) bool {
+		for _, r := range rules {
+			for _, grant := range r.Folders {
+				if grant.matches(f) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var result []*grafanaFolder
+	for _, f := range folders {
+		if referenced(f) {
+			result = append(result, f)
+		}
+	}
+
+	var dashboardUIDs []string
+	for _, r := range rules {
+		for _, grant := range r.Dashboards {
+			dashboardUIDs = append(dashboardUIDs, grant.UID)
+		}
+	}
+	if len(dashboardUIDs) > 0 {
+		query := url.Values{"type": {"dash-db"}, "dashboardUIDs": distinct(dashboardUIDs)}
+		var dashboards []*grafanaFolder
+		g.Wait()
+		err := g.apiRequest("GET", "/api/search?"+query.Encode(), orgID, nil, &dashboards)
+		if err != nil {
+			return nil, fmt.Errorf("searching dashboards: %v", err)
+		}
+		for _, d := range dashboards {
+			d.IsDashboard = true
+			result = append(result, d)
+		}
+	}
+
+	for _, f := range result {
+		g.Wait()
+		err := g.apiRequest("GET", f.permissionsPath(), orgID, nil, &f.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("listing permissions of %v '%v': %v", f.kind(), f.Title, err)
+		}
+	}
+
+	return result, nil
+}
+
+// setFolderPermissions replaces the access control list of a folder (or dashboard) with its current permissions, changed by the given changes
+func (g *grafanaState) setFolderPermissions(orgID uint, f *grafanaFolder, changes []*folderPermissionChange) error {
+	items := make([]map[string]interface{}, 0)
+	changed := make(map[string]bool) // "user:ID" or "team:ID" of every grantee that gets a new permission (or loses theirs)
+	for _, c := range changes {
+		if c.Team != nil {
+			if c.Team.ID == 0 {
+				return fmt.Errorf("team '%v' was not created", c.Team.Name)
+			}
+			changed[fmt.Sprintf("team:%d", c.Team.ID)] = true
+		} else {
+			changed[fmt.Sprintf("user:%d", c.UserID)] = true
+		}
+	}
+
+	for _, p := range f.Permissions {
+		if p.Inherited {
+			continue
+		}
+		switch {
+		case p.UserID != 0:
+			if !changed[fmt.Sprintf("user:%d", p.UserID)] {
+				items = append(items, map[string]interface{}{"userId": p.UserID, "permission": p.Permission})
+			}
+		case p.TeamID != 0:
+			if !changed[fmt.Sprintf("team:%d", p.TeamID)] {
+				items = append(items, map[string]interface{}{"teamId": p.TeamID, "permission": p.Permission})
+			}
+		case p.Role != "":
+			items = append(items, map[string]interface{}{"role": p.Role, "permission": p.Permission})
+		}
+	}
+
+	for _, c := range changes {
+		if c.NewPermission == "" {
+			continue // removed
+		}
+		if c.Team != nil {
+			items = append(items, map[string]interface{}{"teamId": c.Team.ID, "permission": permissionLevels[c.NewPermission]})
+		} else {
+			items = append(items, map[string]interface{}{"userId": c.UserID, "permission": permissionLevels[c.NewPermission]})
+		}
+	}
+
+	g.Wait()
+	return g.apiRequest("POST", f.permissionsPath(), orgID, map[string]interface{}{"items": items}, nil)
+}
+
+// currentPermission returns the permission a user or team has right now (inherited permissions are not included, they are not managed here)
+func (f *grafanaFolder) currentPermission(userID uint, team *grafanaTeam) Permission {
+	for _, p := range f.Permissions {
+		if p.Inherited {
+			continue
+		}
+		if (team == nil && p.UserID != 0 && p.UserID == userID) || (team != nil && team.ID != 0 && p.TeamID == team.ID) {
+			return permissionFromLevel(p.Permission)
+		}
+	}
+	return ""
+}
+
+// planFolderPermissions computes the permission changes for every folder and dashboard that is referenced by a rule.
+// Rules with teams grant the permission to their teams, all other rules grant it to each of their users (who are, or will be, members of the org).
+// Users and teams that have a permission which no rule grants lose it (only in orgs where users can be demoted).
+// Permissions for org roles (Viewer, Editor) and inherited permissions are never touched.
+func planFolderPermissions(userUpdates map[string]*userUpdate) []*folderPermissionChange {
+	type grantee struct {
+		userID uint
+		team   *grafanaTeam
+	}
+	type grant struct {
+		permission Permission
+		reason     *Rule
+		email      string // of the user (if the grantee is a user)
+	}
+
+	excluded := excludedUsers()
+
+	desiredPermissions := make(map[*grafanaFolder]map[grantee]*grant) // folder -> grantee -> highest permission
+	orgOf := make(map[*grafanaFolder]*grafanaOrganization)
+	managedBy := make(map[*grafanaFolder]*Rule)        // first rule that references the folder
+	unresolvedFolders := make(map[*grafanaFolder]bool) // folders with rules that depend on groups that could not be resolved
+
+	// 1. collect the desired permissions of each folder
+	for _, rule := range activeRules {
+		if len(rule.Folders) == 0 && len(rule.Dashboards) == 0 {
+			continue
+		}
+		users, unresolved := rule.resolveUsers()
+
+		for _, org := range grafana.organizations {
+			if !rule.matchesOrg(org.Name) || org.unresolvedFolders {
+				continue
+			}
+
+			for _, f := range org.Folders {
+				permission := rule.permissionFor(f)
+				if permission == "" {
+					continue
+				}
+
+				perms, exists := desiredPermissions[f]
+				if !exists {
+					perms = make(map[grantee]*grant)
+					desiredPermissions[f] = perms
+					orgOf[f] = org
+					managedBy[f] = rule
+				}
+				if len(unresolved) > 0 {
+					unresolvedFolders[f] = true
+				}
+
+				add := func(g grantee, email string) {
+					if existing, exists := perms[g]; !exists || permission.isHigherThan(existing.permission) {
+						perms[g] = &grant{permission, rule, email}
+					}
+				}
+				if len(rule.Teams) > 0 {
+					for _, teamName := range rule.Teams {
+						if team := org.findTeam(teamName); team != nil {
+							add(grantee{team: team}, "")
+						}
+					}
+					continue
+				}
+				for _, u := range users {
+					grafUser := grafana.findUser(u)
+					if grafUser == nil || excluded[org.ID][u] || !willBeOrgMember(userUpdates[u], org) {
+						continue
+					}
+					add(grantee{userID: grafUser.ID}, u)
+				}
+			}
+		}
+	}
+
+	// 2. compare with the current permissions
+	var changes []*folderPermissionChange
+	for f, perms := range desiredPermissions {
+		org := orgOf[f]
+		mayDowngrade := config.Settings.canDemoteIn(org.Name) && !unresolvedFolders[f]
+
+		for g, desired := range perms {
+			current := f.currentPermission(g.userID, g.team)
+			if desired.permission == current {
+				continue
+			}
+			if desired.permission.isHigherThan(current) && org.unresolvedRestriction {
+				continue // a restriction for this org could not be resolved, the user might not be allowed to be in the org at all
+			}
+			if current.isHigherThan(desired.permission) && (!mayDowngrade || (g.team == nil && protection(desired.email) != "")) {
+				continue
+			}
+			changes = append(changes, &folderPermissionChange{org, f, g.userID, desired.email, g.team, current, desired.permission, desired.reason})
+		}
+
+		if !mayDowngrade {
+			continue // we don't know all the users and teams that should have a permission, so nobody loses theirs
+		}
+
+		// users and teams that have a permission, but no rule grants it to them
+		for _, p := range f.Permissions {
+			if p.Inherited || (p.UserID == 0 && p.TeamID == 0) {
+				continue
+			}
+			g := grantee{userID: p.UserID}
+			if p.TeamID != 0 {
+				g = grantee{team: org.findTeamByID(p.TeamID)}
+				if g.team == nil {
+					continue
+				}
+			} else if protection(p.UserEmail) != "" {
+				continue
+			}
+			if _, isDesired := perms[g]; isDesired {
+				continue
+			}
+			changes = append(changes, &folderPermissionChange{org, f, g.userID, p.UserEmail, g.team, permissionFromLevel(p.Permission), "", managedBy[f]})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].key() < changes[j].key()
+	})
+	return changes
+}
+
+// permissionFor returns the permission the rule grants for the folder (or dashboard), or "" if the rule does not reference it
+func (r *Rule) permissionFor(f *grafanaFolder) Permission {
+	grants := r.Folders
+	if f.IsDashboard {
+		grants = r.Dashboards
+	}
+	var highest Permission
+	for _, g := range grants {
+		if g.matches(f) && g.Permission.isHigherThan(highest) {
+			highest = g.Permission
+		}
+	}
+	return highest
+}
+
+// willBeOrgMember returns true if the user is a member of the org, or will be added to it by the plan
+func willBeOrgMember(update *userUpdate, org *grafanaOrganization) bool {
+	if update == nil {
+		return false
+	}
+	isMember := org.findUser(update.Email) != nil
+	for _, change := range update.Changes {
+		if change.Organization == org {
+			return change.NewRole != ""
+		}
+	}
+	return isMember
+}
+
+func (o *grafanaOrganization) findTeamByID(id uint) *grafanaTeam {
+	for _, t := range o.Teams {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// groupByFolder groups changes by the folder they change, so every folder is only updated once
+func groupByFolder(changes []*folderPermissionChange) (folders []*grafanaFolder, byFolder map[*grafanaFolder][]*folderPermissionChange) {
+	byFolder = make(map[*grafanaFolder][]*folderPermissionChange)
+	for _, c := range changes {
+		if _, exists := byFolder[c.Folder]; !exists {
+			folders = append(folders, c.Folder)
+		}
+		byFolder[c.Folder] = append(byFolder[c.Folder], c)
+	}
+	return folders, byFolder
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPlanFolderPermissions(t *testing.T) {
+	users := []string{"a@corp.com", "b@corp.com", "c@corp.com", "admin@corp.com"}
+	grant := func(permission Permission, users ...string) *Rule {
+		return &Rule{Users: FlattenedArray(users), Organizations: FlattenedArray{"Prod"}, Folders: []*PermissionGrant{{UID: "ops", Permission: permission}}}
+	}
+	user := func(email string, level int) folderPermission {
+		id := uint(0)
+		for i, u := range users {
+			if u == email {
+				id = uint(i + 1)
+			}
+		}
+		return folderPermission{UserID: id, UserEmail: email, Permission: level}
+	}
+
+	tests := []struct {
+		name      string
+		rules     []*Rule
+		canDemote bool
+		current   []folderPermission
+		want      []string
+	}{
+		{"grant", []*Rule{grant("Edit", "a@corp.com")}, false, nil, []string{"a@corp.com >Edit"}},
+		{"highest permission wins", []*Rule{grant("View", "a@corp.com"), grant("Admin", "a@corp.com")}, false, nil, []string{"a@corp.com >Admin"}},
+		{"folder by title", []*Rule{{Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"Prod"}, Folders: []*PermissionGrant{{Title: "Ops", Permission: "View"}}}}, false, nil, []string{"a@corp.com >View"}},
+		{"already granted", []*Rule{grant("Edit", "a@corp.com")}, true, []folderPermission{user("a@corp.com", 2)}, nil},
+		{"upgrade", []*Rule{grant("Edit", "a@corp.com")}, false, []folderPermission{user("a@corp.com", 1)}, []string{"a@corp.com View>Edit"}},
+		{"downgrade and revoke", []*Rule{grant("View", "a@corp.com")}, true, []folderPermission{user("a@corp.com", 4), user("b@corp.com", 1)}, []string{"a@corp.com Admin>View", "b@corp.com View>"}},
+		{"no downgrade or revoke without canDemote", []*Rule{grant("View", "a@corp.com")}, false, []folderPermission{user("a@corp.com", 4), user("b@corp.com", 1)}, nil},
+		{"protected user keeps the permission", []*Rule{grant("View", "a@corp.com")}, true, []folderPermission{user("admin@corp.com", 4)}, []string{"a@corp.com >View"}},
+		{"unresolved group blocks revoke", []*Rule{{Users: FlattenedArray{"a@corp.com"}, Groups: FlattenedArray{"file:missing"}, Organizations: FlattenedArray{"Prod"}, Folders: []*PermissionGrant{{UID: "ops", Permission: "View"}}}}, true, []folderPermission{user("b@corp.com", 1)}, []string{"a@corp.com >View"}},
+		{"inherited and role permissions are not managed", []*Rule{grant("View", "a@corp.com")}, true, []folderPermission{{UserID: 2, UserEmail: "b@corp.com", Permission: 1, Inherited: true}, {Role: "Editor", Permission: 2}}, []string{"a@corp.com >View"}},
+		{"only org members", []*Rule{grant("View", "c@corp.com")}, true, nil, nil},
+		{"excluded user", []*Rule{grant("View", "a@corp.com"), {Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"Prod"}, Exclude: true}}, true, nil, nil},
+		{"team", []*Rule{{Teams: FlattenedArray{"SRE"}, Organizations: FlattenedArray{"Prod"}, Folders: []*PermissionGrant{{UID: "ops", Permission: "Edit"}}}}, true, []folderPermission{{TeamID: 10, Team: "SRE", Permission: 1}, user("a@corp.com", 1)}, []string{"a@corp.com View>", "team:SRE View>Edit"}},
+		{"other folder", []*Rule{{Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"Prod"}, Folders: []*PermissionGrant{{UID: "dev", Permission: "View"}}}}, true, []folderPermission{user("b@corp.com", 1)}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Rules: test.rules}
+			c.Settings.CanDemote = test.canDemote
+			c.Settings.ProtectedUsers = FlattenedArray{"admin@corp.com"}
+			setupTestGrafana(c, users...)
+			activeRules = c.Rules
+			prod := addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Viewer", "b@corp.com": "Viewer", "admin@corp.com": "Admin"})
+			prod.Teams = []*grafanaTeam{{10, 2, "SRE", nil}}
+			prod.Folders = []*grafanaFolder{{ID: 1, UID: "ops", Title: "Ops", Permissions: test.current}}
+
+			updates := make(map[string]*userUpdate)
+			for _, email := range users {
+				updates[email] = &userUpdate{Email: email}
+			}
+
+			var got []string
+			for _, change := range planFolderPermissions(updates) {
+				if change.Organization != prod || change.Folder.UID != "ops" {
+					t.Errorf("change for folder '%v' in org '%v'", change.Folder.UID, change.Organization.Name)
+				}
+				got = append(got, fmt.Sprintf("%v %v>%v", change.grantee(), change.OldPermission, change.NewPermission))
+			}
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("planFolderPermissions() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetFoldersPages(t *testing.T) {
+	server := newFakeGrafana()
+	defer server.Close()
+
+	total := folderPageSize + 5
+	server.respond("GET /api/folders", func(r *http.Request) interface{} {
+		var page int
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+		folders := make([]map[string]interface{}, 0)
+		for i := (page - 1) * folderPageSize; i < page*folderPageSize && i < total; i++ {
+			folders = append(folders, map[string]interface{}{"id": i + 1, "uid": fmt.Sprintf("f%d", i+1), "title": fmt.Sprintf("Folder %d", i+1)})
+		}
+		return folders
+	})
+	noPermissions := func(*http.Request) interface{} { return []folderPermission{} }
+	server.respond("GET /api/folders/f1/permissions", noPermissions)
+	server.respond(fmt.Sprintf("GET /api/folders/f%d/permissions", total), noPermissions)
+
+	c := &Config{Grafanas: server.config()}
+	setupTestGrafana(c)
+	rules := []*Rule{{Organizations: FlattenedArray{"Prod"}, Folders: []*PermissionGrant{
+		{UID: "f1", Permission: "View"},
+		{Title: fmt.Sprintf("Folder %d", total), Permission: "Edit"}, // on the second page
+	}}}
+
+	folders, err := grafana.getFolders(2, rules)
+	if err != nil {
+		t.Fatalf("getFolders() error = %v", err)
+	}
+	var got []string
+	for _, f := range folders {
+		got = append(got, f.UID)
+	}
+	if want := []string{"f1", fmt.Sprintf("f%d", total)}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("getFolders() = %v, want %v", got, want)
+	}
+
+	pages := 0
+	for _, r := range server.receivedRequests() {
+		if r == "GET /api/folders" {
+			pages++
+		}
+	}
+	if pages != 2 {
+		t.Errorf("getFolders() requested %d pages, want 2", pages)
+	}
+}
+
+func TestFetchFoldersKeepsOrgsWithoutFolders(t *testing.T) {
+	server := newFakeGrafana()
+	defer server.Close()
+	server.respond("GET /api/folders", func(r *http.Request) interface{} {
+		if r.Header.Get("X-Grafana-Org-Id") == "3" {
+			return "not a list of folders"
+		}
+		return []map[string]interface{}{{"id": 1, "uid": "ops", "title": "Ops"}}
+	})
+	server.respond("GET /api/folders/ops/permissions", func(*http.Request) interface{} { return []folderPermission{} })
+
+	rules := []*Rule{{Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"Prod", "Dev"}, Folders: []*PermissionGrant{{UID: "ops", Permission: "View"}}}}
+	c := &Config{Grafanas: server.config(), Rules: rules}
+	setupTestGrafana(c, "a@corp.com")
+	activeRules = c.Rules
+	prod := addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Viewer"})
+	dev := addTestOrg(3, "Dev", map[string]Role{"a@corp.com": "Viewer"})
+
+	grafana.fetchFolders(rules)
+	if grafana.organizations[3] != dev || !dev.unresolvedFolders || prod.unresolvedFolders {
+		t.Fatalf("fetchFolders() must keep Dev, and only mark its folders as unresolved")
+	}
+
+	updates := map[string]*userUpdate{"a@corp.com": {Email: "a@corp.com"}}
+	changes := planFolderPermissions(updates)
+	if len(changes) != 1 || changes[0].Organization != prod {
+		t.Errorf("planFolderPermissions() = %v, want one change in Prod", changes)
+	}
+}
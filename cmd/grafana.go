@@ -1,7 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/rikimaru0345/sdk"
 	"golang.org/x/time/rate"
@@ -12,47 +21,133 @@ type grafanaState struct {
 
 	// todo: move this into a separate "Grafana" package and don't use package-globals
 	allUsers      []sdk.User
+	disabledUsers map[uint]bool                 // [userID]disabled, users that can't log in anymore
 	organizations map[uint]*grafanaOrganization // [orgID]Org
 
+	// orgs that are named by rules but don't exist yet, they are created when the plan is executed (their ID is 0 until then)
+	newOrganizations []*grafanaOrganization
+
+	// [orgName] orgs that exist, but their users or teams could not be fetched in this run.
+	// They are not in 'organizations', so nothing is planned for them (and they are not created again).
+	unavailableOrgs map[string]bool
+
 	rateLimit *rate.Limiter
+
+	// needed for the api endpoints the sdk does not cover (teams, ...)
+	httpClient *http.Client
+	url        string
+	user       string
+	password   string
+
+	responses *statusRecorder // all requests go through it (the sdk's as well)
+}
+
+// statusRecorder is a http transport that remembers the status code of the last response, the sdk does not return it
+type statusRecorder struct {
+	next           http.RoundTripper
+	lastStatusCode int32
+}
+
+func (r *statusRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if resp != nil {
+		atomic.StoreInt32(&r.lastStatusCode, int32(resp.StatusCode))
+	}
+	return resp, err
+}
+
+// takeStatusCode returns the status code of the last response from grafana, 0 if there was none since the last call
+func (g *grafanaState) takeStatusCode() int {
+	return int(atomic.SwapInt32(&g.responses.lastStatusCode, 0))
 }
 
 type grafanaOrganization struct {
 	*sdk.Org
 	Users []sdk.OrgUser
+	Teams []*grafanaTeam
+
+	Folders []*grafanaFolder // folders and dashboards that are referenced by a rule (with their permissions)
+
+	unresolvedRole        Role // highest role of all rules (for this org) that depend on groups that could not be resolved in the current run
+	unresolvedRestriction bool // a restriction for this org depends on groups that could not be resolved in the current run
+	unresolvedFolders     bool // the folders of this org could not be listed in the current run, no folder permissions are planned for it
 }
 
-func (g *grafanaState) fetchState() {
+// fetchState gets all users and orgs (and their teams, if needed). Folders are fetched by fetchFolders, they depend on the active rules.
+// If the users or orgs can't be listed, the state is empty and an error is returned.
+func (g *grafanaState) fetchState() error {
+	g.newOrganizations = nil
+	g.organizations = make(map[uint]*grafanaOrganization)
+	g.unavailableOrgs = make(map[string]bool)
 
 	// get all users (including those that don't belong to any org)
 	var err error
 	g.Wait()
-	g.allUsers, err = g.GetAllUsers()
+	g.allUsers, g.disabledUsers, err = g.getAllUsers()
 	if err != nil {
-		log.Errorf("unable to fetch all users from grafana: %v", err.Error())
-		return
+		return fmt.Errorf("unable to fetch all users from grafana: %v", err)
 	}
 
 	// get all orgs...
-	g.organizations = make(map[uint]*grafanaOrganization)
 	g.Wait()
 	orgs, err := g.GetAllOrgs()
 	if err != nil {
-		log.Errorf("unable to list all orgs: %v" + err.Error())
-		return
+		g.allUsers = nil
+		return fmt.Errorf("unable to list all orgs: %v", err)
 	}
 
+	fetchTeams := config.hasTeamRules()
+
 	for _, org := range orgs {
 		// ...and their users
 		g.Wait()
 		users, err := g.GetOrgUsers(org.ID)
 		if err != nil {
-			log.Error("error listing users for org: " + err.Error())
+			log.Errorw("error listing users for org, nothing is planned for it in this run", "org", org.Name, "error", err.Error())
+			g.unavailableOrgs[org.Name] = true
 			continue
 		}
 		orgCopy := org // need to create a local copy of the org...
-		g.organizations[org.ID] = &grafanaOrganization{&orgCopy, users}
+		grafOrg := &grafanaOrganization{&orgCopy, users, nil, nil, "", false, false}
+
+		// ...and their teams (only needed when there are rules that manage teams)
+		if fetchTeams {
+			grafOrg.Teams, err = g.getTeams(org.ID)
+			if err != nil {
+				log.Errorw("error listing teams for org, nothing is planned for it in this run", "org", org.Name, "error", err.Error())
+				g.unavailableOrgs[org.Name] = true
+				continue
+			}
+		}
+
+		g.organizations[org.ID] = grafOrg
 	}
+	return nil
+}
+
+// getAllUsers lists all users, unlike sdk.GetAllUsers it also fills in IsGrafanaAdmin (the api calls it 'isAdmin'),
+// and returns which users are disabled (the sdk does not know about that at all)
+func (g *grafanaState) getAllUsers() ([]sdk.User, map[uint]bool, error) {
+	var users []struct {
+		sdk.User
+		IsAdmin    bool `json:"isAdmin"`
+		IsDisabled bool `json:"isDisabled"`
+	}
+	err := g.apiRequest("GET", "/api/users?perpage=99999", 0, nil, &users)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make([]sdk.User, len(users))
+	disabled := make(map[uint]bool)
+	for i, u := range users {
+		result[i] = u.User
+		result[i].IsGrafanaAdmin = u.IsAdmin
+		if u.IsDisabled {
+			disabled[u.ID] = true
+		}
+	}
+	return result, disabled, nil
 }
 
 // Wait consumes a token for an api request against grafana (or waits until a token is available!)
@@ -60,6 +155,61 @@ func (g *grafanaState) Wait() {
 	g.rateLimit.Wait(context.Background())
 }
 
+// apiRequest sends a request to an api endpoint that is not covered by the sdk.
+// If orgID is not 0, the request is executed in the context of that organization.
+// The response is decoded into 'result' (if it is not nil).
+func (g *grafanaState) apiRequest(method string, path string, orgID uint, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(g.url, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(g.user, g.password)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if orgID != 0 {
+		req.Header.Set("X-Grafana-Org-Id", strconv.FormatUint(uint64(orgID), 10))
+	}
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP error %d: returns %s", resp.StatusCode, raw)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(raw, result); err != nil {
+			return fmt.Errorf("unmarshal response: %s\n%s", err, raw)
+		}
+	}
+	return nil
+}
+
+func (g *grafanaState) findUser(email string) *sdk.User {
+	for i := range g.allUsers {
+		if g.allUsers[i].Email == email {
+			return &g.allUsers[i]
+		}
+	}
+	return nil
+}
+
 func (g *grafanaOrganization) findUser(userEmail string) *sdk.OrgUser {
 	for _, u := range g.Users {
 		if u.Email == userEmail {
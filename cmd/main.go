@@ -3,16 +3,23 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
 
+	"github.com/cloudworkz/grafana-permission-sync/pkg/audit"
+	"github.com/cloudworkz/grafana-permission-sync/pkg/elevation"
+	"github.com/cloudworkz/grafana-permission-sync/pkg/groups"
 	"github.com/cloudworkz/grafana-permission-sync/pkg/watcher"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -22,19 +29,41 @@ var (
 	log *zap.SugaredLogger
 
 	configPath string
-
-	dryRunNoPlanNoExec = len(os.Getenv("GRAFANA_PERMISSION_SYNC_NO_PLAN_NO_EXEC")) > 0
-	dryRunNoExec       = len(os.Getenv("GRAFANA_PERMISSION_SYNC_NO_EXEC")) > 0
 )
 
 func main() {
-	// 1. Setup, load config, ...
 	logRaw, _ := zap.NewProduction()
 	log = logRaw.Sugar()
 
 	flag.StringVar(&configPath, "configPath", "./config.yaml", "alternative path to the config file")
+	flag.Usage = printUsage
 	flag.Parse()
 
+	var args []string
+	if flag.NArg() > 1 {
+		args = flag.Args()[1:]
+	}
+
+	switch flag.Arg(0) {
+	case "", "run":
+		runDaemon()
+	case "validate":
+		os.Exit(runValidate())
+	case "plan":
+		os.Exit(runPlan(args))
+	case "apply":
+		os.Exit(runApply(args))
+	case "explain":
+		os.Exit(runExplain(args))
+	default:
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+// runDaemon keeps grafana in sync (until the process is stopped)
+func runDaemon() {
+	// 1. Setup, load config, ...
 	// Load config
 	config = tryLoadConfig(configPath)
 	if config == nil {
@@ -45,6 +74,7 @@ func main() {
 	setupConfigHotReload(configPath)
 
 	// 2. Start sync
+	watchGroupFiles = true
 	setupSync()
 	go startSync()
 
@@ -59,8 +89,8 @@ func startWebServer() {
 	rawLog := log.Desugar()
 	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{
 		Formatter: func(param gin.LogFormatterParams) string {
-			// don't log liveness checks
-			if strings.HasPrefix(param.Path, "/admin/") {
+			// don't log liveness checks (or metric scrapes)
+			if strings.HasPrefix(param.Path, "/admin/") || param.Path == "/metrics" {
 				return ""
 			}
 
@@ -93,14 +123,16 @@ func startWebServer() {
 		}
 	})
 
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	r.GET("/admin/alive", func(c *gin.Context) {
 		renderYAML(c, 200, gin.H{"status": "ready"})
 	})
 
 	r.GET("/admin/groups/:email", func(c *gin.Context) {
-		email := c.Param("email")
+		groupRef := c.Param("email") // can have a provider prefix, like "ldap:cn=ops,dc=corp,dc=com"
 		recurse := c.Query("recurse") == "true"
-		members, err := groupTree.ListGroupMembersForDisplay(email, recurse)
+		members, err := listGroupMembersForDisplay(groupRef, recurse)
 		if err != nil {
 			renderJSON(c, 500, gin.H{"error": err.Error()})
 			return
@@ -108,17 +140,299 @@ func startWebServer() {
 		renderJSON(c, 200, members)
 	})
 
+	r.GET("/admin/group-status", func(c *gin.Context) {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+
+		status := make(map[string]interface{})
+		for name, p := range groupProviders {
+			status[name] = p.FetchStatus()
+		}
+		renderJSON(c, 200, status)
+	})
+
+	r.GET("/admin/targets", func(c *gin.Context) {
+		renderJSON(c, 200, targetsForDisplay())
+	})
+
 	r.GET("/admin/users/:email", func(c *gin.Context) {
+		if createdPlans == 0 {
+			renderJSON(c, 503, gin.H{"error": "no state has been fetched from grafana yet"})
+			return
+		}
+		t, ok := targetFromRequest(c)
+		if !ok {
+			return
+		}
+
 		email := c.Param("email")
-		groups, err := groupTree.ListUserGroupsForDisplay(email)
+		groups, err := listUserGroupsForDisplay(email)
+		if err != nil {
+			renderJSON(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+
+		var organizations []*orgPermission
+		withTarget(t, func() {
+			organizations = explainUser(email) // resulting permissions (and orgs the user would not be in) and the rules responsible
+		})
+		renderJSON(c, 200, gin.H{
+			"email":         email,
+			"target":        t.Name,
+			"groups":        groups,
+			"organizations": organizations,
+		})
+	})
+
+	r.GET("/admin/expirations", func(c *gin.Context) {
+		within := 7 * 24 * time.Hour
+		if s := c.Query("within"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				renderJSON(c, 400, gin.H{"error": "invalid duration for 'within': " + err.Error()})
+				return
+			}
+			within = d
+		}
+		// without 'target' the rules of all grafana instances are listed
+		stateMutex.Lock()
+		selected := targets
+		stateMutex.Unlock()
+		if c.Query("target") != "" {
+			t, ok := targetFromRequest(c)
+			if !ok {
+				return
+			}
+			selected = []*grafanaTarget{t}
+		}
+
+		renderJSON(c, 200, upcomingExpirations(selected, within))
+	})
+
+	r.GET("/admin/elevations", func(c *gin.Context) {
+		renderJSON(c, 200, elevationsForDisplay())
+	})
+
+	r.POST("/admin/elevations", func(c *gin.Context) {
+		if elevations == nil {
+			renderJSON(c, 404, gin.H{"error": "elevations are not enabled ('elevationsPath' is not set)"})
+			return
+		}
+		if !authorizeElevation(c) {
+			renderJSON(c, 401, gin.H{"error": "missing or wrong bearer token"})
+			return
+		}
+
+		var req elevationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			renderJSON(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		stateMutex.Lock()
+		t := findTarget(req.Target)
+		stateMutex.Unlock()
+		if t == nil {
+			renderJSON(c, 400, gin.H{"error": "unknown target '" + req.Target + "'"})
+			return
+		}
+
+		var grant elevation.Grant
+		var err error
+		withTarget(t, func() {
+			stateMutex.Lock()
+			grant, err = req.toGrant()
+			stateMutex.Unlock()
+		})
+		if err != nil {
+			renderJSON(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+
+		grant, err = elevations.Add(grant)
+		if err != nil {
+			renderJSON(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+		log.Infow("Elevation granted", "id", grant.ID, "user", grant.User, "org", grant.Org, "target", grant.Target, "role", grant.Role, "expires", grant.Expires, "reason", grant.Reason, "requestedBy", grant.RequestedBy, "clientIP", c.ClientIP())
+		renderJSON(c, 200, grant)
+	})
+
+	r.DELETE("/admin/elevations/:id", func(c *gin.Context) {
+		if elevations == nil {
+			renderJSON(c, 404, gin.H{"error": "elevations are not enabled ('elevationsPath' is not set)"})
+			return
+		}
+		if !authorizeElevation(c) {
+			renderJSON(c, 401, gin.H{"error": "missing or wrong bearer token"})
+			return
+		}
+
+		expired, err := elevations.Expire(c.Param("id"))
+		if err != nil {
+			renderJSON(c, 500, gin.H{"error": err.Error()})
+			return
+		}
+		if !expired {
+			renderJSON(c, 404, gin.H{"error": "no active elevation with this id"})
+			return
+		}
+		log.Infow("Elevation ended early", "id", c.Param("id"), "clientIP", c.ClientIP())
+		renderJSON(c, 200, gin.H{"status": "elevation ended, the role will be revoked in the next run"})
+	})
+
+	r.GET("/admin/plan", func(c *gin.Context) {
+		t, ok := targetFromRequest(c)
+		if !ok {
+			return
+		}
+
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+
+		if t.lastPlan == nil {
+			renderJSON(c, 503, gin.H{"error": "no plan has been created yet for target '" + t.Name + "'"})
+			return
+		}
+
+		format := c.DefaultQuery("format", "json")
+		bytes, err := marshalPlanFile(t.lastPlan, format)
+		if err != nil {
+			renderJSON(c, 400, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(200, "application/"+format+"; charset=utf-8", bytes)
+	})
+
+	r.GET("/admin/brake", func(c *gin.Context) {
+		t, ok := targetFromRequest(c)
+		if !ok {
+			return
+		}
+
+		withTarget(t, func() { // the changes refer to the orgs of the target
+			brakeMutex.Lock()
+			defer brakeMutex.Unlock()
+
+			if t.blockedPlan == nil {
+				renderJSON(c, 200, gin.H{"target": t.Name, "blocked": false})
+				return
+			}
+
+			stateMutex.Lock()
+			changes := planForDisplay(t.blockedPlan.Plan)
+			stateMutex.Unlock()
+
+			renderJSON(c, 200, gin.H{
+				"target":         t.Name,
+				"blocked":        true,
+				"planId":         t.blockedPlan.ID,
+				"overrideArmed":  t.brakeOverride == t.blockedPlan.ID,
+				"blockedAt":      t.blockedPlan.Time,
+				"exceededLimits": t.blockedPlan.Reasons,
+				"stats":          t.blockedPlan.Stats,
+				"changes":        changes,
+			})
+		})
+	})
+
+	r.POST("/admin/brake/override", func(c *gin.Context) {
+		if !authorizeToken(c, config.Settings.BrakeAPIToken) {
+			renderJSON(c, 401, gin.H{"error": "missing or wrong bearer token"})
+			return
+		}
+		t, ok := targetFromRequest(c)
+		if !ok {
+			return
+		}
+
+		brakeMutex.Lock()
+		defer brakeMutex.Unlock()
+
+		if t.blockedPlan == nil {
+			renderJSON(c, 409, gin.H{"error": "no plan is blocked by the safety brake"})
+			return
+		}
+		if c.Query("planId") != t.blockedPlan.ID {
+			renderJSON(c, 409, gin.H{"error": fmt.Sprintf("planId '%v' does not match the blocked plan ('%v'), it has changed since you reviewed it", c.Query("planId"), t.blockedPlan.ID)})
+			return
+		}
+
+		t.brakeOverride = t.blockedPlan.ID
+		log.Warnw("Safety brake override armed by operator, the blocked plan will be executed in the next run (if it has not changed by then)", "target", t.Name, "planId", t.blockedPlan.ID, "clientIP", c.ClientIP())
+		renderJSON(c, 200, gin.H{"status": "override armed, the blocked plan for target '" + t.Name + "' will be executed in the next run (if it has not changed by then)"})
+	})
+
+	r.GET("/admin/pending", func(c *gin.Context) {
+		t, ok := targetFromRequest(c)
+		if !ok {
+			return
+		}
+
+		withTarget(t, func() { // the changes refer to the orgs of the target
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			renderJSON(c, 200, pendingPlanForDisplay(t))
+		})
+	})
+
+	decide := func(approve bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if !authorizeToken(c, config.Settings.ApprovalAPIToken) {
+				renderJSON(c, 401, gin.H{"error": "missing or wrong bearer token"})
+				return
+			}
+			t, ok := targetFromRequest(c)
+			if !ok {
+				return
+			}
+
+			err := decideOnPendingPlan(t, c.Query("planId"), c.Param("email"), approve)
+			if err != nil {
+				renderJSON(c, 409, gin.H{"error": err.Error()})
+				return
+			}
+			renderJSON(c, 200, gin.H{"status": "ok"})
+		}
+	}
+	r.POST("/admin/pending/approve", decide(true))
+	r.POST("/admin/pending/approve/:email", decide(true))
+	r.POST("/admin/pending/reject", decide(false))
+	r.POST("/admin/pending/reject/:email", decide(false))
+
+	r.GET("/admin/audit", func(c *gin.Context) {
+		if auditJournal == nil {
+			renderJSON(c, 404, gin.H{"error": "audit log is not enabled (settings.auditLogPath)"})
+			return
+		}
+
+		filter := audit.Filter{User: c.Query("user"), Org: c.Query("org"), Target: c.Query("target"), Action: c.Query("action"), Limit: 1000}
+		var err error
+		if from := c.Query("from"); from != "" {
+			if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+				renderJSON(c, 400, gin.H{"error": "invalid 'from', must be RFC3339: " + err.Error()})
+				return
+			}
+		}
+		if to := c.Query("to"); to != "" {
+			if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+				renderJSON(c, 400, gin.H{"error": "invalid 'to', must be RFC3339: " + err.Error()})
+				return
+			}
+		}
+		if limit := c.Query("limit"); limit != "" {
+			if filter.Limit, err = strconv.Atoi(limit); err != nil {
+				renderJSON(c, 400, gin.H{"error": "invalid 'limit': " + err.Error()})
+				return
+			}
+		}
+
+		entries, err := auditJournal.Query(filter)
 		if err != nil {
 			renderJSON(c, 500, gin.H{"error": err.Error()})
 			return
 		}
-		renderJSON(c, 200, groups)
-		// todo:
-		// 1. resulting in permissions: x, y, z, ...
-		// 2. and the user would not be in organizations: a, b, c, ...
+		renderJSON(c, 200, entries)
 	})
 
 	err := r.Run(":3000")
@@ -171,11 +485,44 @@ func setupConfigHotReload(configPath string) {
 		c := tryLoadConfig(configPath)
 		if c == nil {
 			log.Error("Config file changed, but loading failed. Will continue with already loaded config and ignore new config.")
+			configReloadsMetric.WithLabelValues("failure").Inc()
 			return
 		}
 		newConfig = c
+		configReloadsMetric.WithLabelValues("success").Inc()
 
 		log.Info("new config loaded successfully, swapping on next idle phase")
 
 	}
 }
+
+var groupFileWatchers []*watcher.Watcher // watchers of the current file provider
+
+// setupGroupFilesHotReload reloads the groups of the file provider whenever one of its files changes.
+// The watchers of a previous file provider (which had different paths) are stopped.
+func setupGroupFilesHotReload(p *groups.FileProvider) {
+	for _, w := range groupFileWatchers {
+		w.Stop()
+	}
+	groupFileWatchers = nil
+
+	for _, path := range p.Paths() {
+		w, err := watcher.WatchPath(path)
+		if err != nil {
+			log.Errorw("can't start group file watcher. hot-reloading will be disabled for this file!", "path", path, "error", err)
+			continue
+		}
+		w.OnError = func(err error) {
+			log.Errorw("error in group file watcher", "error", err)
+		}
+		w.OnChange = func(filePath string) {
+			err := p.Reload()
+			if err != nil {
+				log.Errorw("Group file changed, but loading failed. Will continue with the previously loaded groups.", "path", filePath, "error", err)
+				return
+			}
+			log.Infow("group files reloaded successfully", "path", filePath)
+		}
+		groupFileWatchers = append(groupFileWatchers, w)
+	}
+}
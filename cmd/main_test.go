@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/groups"
+	"github.com/rikimaru0345/sdk"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// setupTestGrafana sets the package globals up like the sync loop would, for a single grafana instance
+// that has the given users (user i has the id i+1, and their email as login)
+func setupTestGrafana(c *Config, users ...string) {
+	for i, r := range c.Rules {
+		r.Index = i
+	}
+	if len(c.Grafanas) == 0 {
+		c.Grafanas = []GrafanaConfig{{Name: defaultTargetName, URL: "http://grafana.test", User: "sync-admin"}}
+	}
+	config = c
+	targets = nil
+	setupTargets()
+
+	grafana.disabledUsers = make(map[uint]bool)
+	for i, email := range users {
+		grafana.allUsers = append(grafana.allUsers, sdk.User{ID: uint(i + 1), Email: email, Login: email})
+	}
+}
+
+// addTestOrg adds an org to the grafana state, roles are the current roles of its members (by email).
+// The members are sorted by email.
+func addTestOrg(id uint, name string, roles map[string]Role) *grafanaOrganization {
+	org := &grafanaOrganization{&sdk.Org{ID: id, Name: name}, nil, nil, nil, "", false, false}
+	emails := make([]string, 0, len(roles))
+	for email := range roles {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	for _, email := range emails {
+		role := roles[email]
+		user := grafana.findUser(email)
+		if user == nil {
+			panic(fmt.Sprintf("user '%v' is not set up", email))
+		}
+		org.Users = append(org.Users, sdk.OrgUser{OrgID: id, ID: user.ID, Email: email, Login: email, Role: string(role)})
+	}
+	grafana.organizations[id] = org
+	return org
+}
+
+// setupTestGroups sets up the file provider with the given group definitions (yaml, group name: members),
+// the returned function removes it again
+func setupTestGroups(t *testing.T, definitions string) func() {
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "groups.yaml")
+	if err := ioutil.WriteFile(path, []byte(definitions), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := groups.CreateFileProvider(log, groups.FileConfig{Paths: []string{path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupProviders[providerFile] = p
+
+	return func() {
+		delete(groupProviders, providerFile)
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeGrafana is a grafana api that accepts every request (and records it)
+type fakeGrafana struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	requests  []string                                   // method and path of every request
+	failures  map[string]int                             // method and path of requests that are answered with this status code (instead of 200)
+	responses map[string]func(*http.Request) interface{} // method and path of requests that are answered with the json of what the function returns
+}
+
+func newFakeGrafana() *fakeGrafana {
+	f := &fakeGrafana{failures: make(map[string]int), responses: make(map[string]func(*http.Request) interface{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := r.Method + " " + r.URL.Path
+		f.mutex.Lock()
+		f.requests = append(f.requests, request)
+		status, fails := f.failures[request]
+		respond := f.responses[request]
+		f.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if fails {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message": "failed"}`))
+			return
+		}
+		if respond != nil {
+			json.NewEncoder(w).Encode(respond(r))
+			return
+		}
+		w.Write([]byte(`{"message": "ok"}`))
+	}))
+	return f
+}
+
+// fail makes the fake answer all future requests with this method and path with the status code
+func (f *fakeGrafana) fail(request string, status int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures[request] = status
+}
+
+// respond makes the fake answer all future requests with this method and path with the json of what fn returns
+func (f *fakeGrafana) respond(request string, fn func(*http.Request) interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.responses[request] = fn
+}
+
+func (f *fakeGrafana) config() []GrafanaConfig {
+	return []GrafanaConfig{{Name: defaultTargetName, URL: f.URL, User: "sync-admin"}}
+}
+
+func (f *fakeGrafana) receivedRequests() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.requests...)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "grafana_permission_sync"
+
+var (
+	plansCreatedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "plans_created_total",
+		Help:      "Number of update plans that have been computed, by grafana target",
+	}, []string{"target"})
+	planFailuresMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "plans_failed_total",
+		Help:      "Number of update plans that could not be computed because grafana was not reachable, by grafana target",
+	}, []string{"target"})
+
+	changesPlannedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "changes_planned_total",
+		Help:      "Number of changes in computed update plans, by grafana target and type",
+	}, []string{"target", "type"})
+	changesAppliedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "changes_applied_total",
+		Help:      "Number of changes that have been applied to grafana successfully, by grafana target and type",
+	}, []string{"target", "type"})
+	changesFailedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "changes_failed_total",
+		Help:      "Number of changes that could not be applied to grafana, by grafana target and type",
+	}, []string{"target", "type"})
+
+	apiRequestDurationMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration (and count) of requests against the grafana and google apis",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "method", "code"})
+
+	groupFetchDurationMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "group_fetch_duration_seconds",
+		Help:      "Time it took to fetch all groups referenced by the rules",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600},
+	})
+	cachedGroupsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cached_groups",
+		Help:      "Number of groups in the cache of each group provider",
+	}, []string{"provider"})
+	cachedUsersMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cached_users",
+		Help:      "Number of users in the cache of each group provider",
+	}, []string{"provider"})
+
+	configReloadsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of attempts to reload the config file, by result (success, failure)",
+	}, []string{"result"})
+
+	lastSuccessfulSyncMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix timestamp of the last run in which all planned changes were applied (or nothing had to be changed), by grafana target",
+	}, []string{"target"})
+)
+
+// instrumentTransport wraps a http transport, so all requests made through it are recorded in the api metrics
+func instrumentTransport(api string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	observer := apiRequestDurationMetric.MustCurryWith(prometheus.Labels{"api": api})
+	return promhttp.InstrumentRoundTripperDuration(observer, next)
+}
+
+func updateCacheMetrics() {
+	for name, p := range groupProviders {
+		groupCount, userCount := p.CacheSize()
+		cachedGroupsMetric.WithLabelValues(name).Set(float64(groupCount))
+		cachedUsersMetric.WithLabelValues(name).Set(float64(userCount))
+	}
+}
+
+// changeTypes returns the type of each change in the plan, as used in the metrics
+func (p *updatePlan) changeTypes() []string {
+	var types []string
+	for range p.NewUsers {
+		types = append(types, "create_user")
+	}
+	for range p.NewOrgs {
+		types = append(types, "create_org")
+	}
+	for range p.NewTeams {
+		types = append(types, "create_team")
+	}
+	for _, uu := range p.Users {
+		for _, change := range uu.Changes {
+			types = append(types, change.action())
+		}
+		for _, change := range uu.TeamChanges {
+			types = append(types, change.metricType())
+		}
+		if uu.AdminChange != nil {
+			types = append(types, uu.AdminChange.action())
+		}
+		if uu.Offboarding != nil {
+			types = append(types, uu.Offboarding.action())
+		}
+	}
+	for _, change := range p.FolderChanges {
+		types = append(types, change.action())
+	}
+	return types
+}
+
+func (c *teamMembershipChange) metricType() string {
+	if c.Add {
+		return "team_add"
+	}
+	return "team_remove"
+}
+
+// recordChangeResult counts a change (in the target) as applied or failed
+func recordChangeResult(t *grafanaTarget, changeType string, err error) {
+	if err != nil {
+		changesFailedMetric.WithLabelValues(t.Name, changeType).Inc()
+	} else {
+		changesAppliedMetric.WithLabelValues(t.Name, changeType).Inc()
+	}
+}
+
+// recordSuccessfulSync remembers that the target is fully in sync
+func recordSuccessfulSync(t *grafanaTarget) {
+	lastSuccessfulSyncMetric.WithLabelValues(t.Name).SetToCurrentTime()
+
+	stateMutex.Lock()
+	t.lastSync = time.Now()
+	stateMutex.Unlock()
+}
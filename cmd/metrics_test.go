@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiRequestCounts returns the number of requests (and their total duration) recorded for the api, by method and status code
+func apiRequestCounts(t *testing.T, api string) (counts map[string]uint64, durations map[string]float64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts = make(map[string]uint64)
+	durations = make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != metricsNamespace+"_api_request_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["api"] == api {
+				counts[labels["method"]+" "+labels["code"]] = m.GetHistogram().GetSampleCount()
+				durations[labels["method"]+" "+labels["code"]] = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return counts, durations
+}
+
+func TestInstrumentTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	before, _ := apiRequestCounts(t, "test")
+	client := &http.Client{Transport: instrumentTransport("test", nil)}
+	for _, request := range []struct{ method, path string }{{"GET", "/ok"}, {"GET", "/ok"}, {"GET", "/missing"}, {"POST", "/ok"}} {
+		req, _ := http.NewRequest(request.method, server.URL+request.path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	after, durations := apiRequestCounts(t, "test")
+
+	want := map[string]uint64{"get 200": 2, "get 404": 1, "post 200": 1}
+	if len(after) != len(want) {
+		t.Errorf("requests by method and code = %v, want %v", after, want)
+	}
+	for labels, count := range want {
+		if got := after[labels] - before[labels]; got != count {
+			t.Errorf("number of requests with %v = %d, want %d", labels, got, count)
+		}
+		if durations[labels] <= 0 {
+			t.Errorf("duration of requests with %v = %v, want more than 0", labels, durations[labels])
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/audit"
+)
+
+const (
+	offboardingDisable = "disable_user"
+	offboardingDelete  = "delete_user"
+	offboardingEnable  = "enable_user" // the user is matched again after the sync disabled the account
+)
+
+// offboardingChange disables the grafana account of a user who left, deletes it once it has been disabled for long enough,
+// or enables it again when the user comes back
+type offboardingChange struct {
+	UserID uint
+	Action string // offboardingDisable, offboardingDelete or offboardingEnable
+	Why    string // shown as the reason, there is no rule that causes an offboarding
+}
+
+func (c *offboardingChange) action() string {
+	return c.Action
+}
+
+// isRemoval is true for changes that take the account away
+func (c *offboardingChange) isRemoval() bool {
+	return c.Action != offboardingEnable
+}
+
+// planOffboarding disables the accounts of users who are not matched by any rule (or are suspended in the directory),
+// and deletes accounts that were disabled by the sync more than 'deleteAfter' ago.
+// Accounts the sync disabled are enabled again once the user is matched by a rule (and not suspended) again.
+// Protected users are never offboarded, and while any rule depends on groups that could not be resolved nobody counts as unmatched.
+func planOffboarding(userUpdates map[string]*userUpdate) {
+	policy := config.Settings.Offboarding
+	if !policy.isEnabled() {
+		return
+	}
+
+	matched := make(map[string]bool)
+	suspended := make(map[string]bool)
+	allResolved := true
+	for _, rule := range activeRules {
+		if rule.isRestriction() {
+			continue
+		}
+		users, unresolved := rule.resolveUsers()
+		if len(unresolved) > 0 {
+			allResolved = false
+		}
+		for _, u := range users {
+			matched[u] = true
+		}
+		for _, ref := range rule.groupRefs() {
+			group, _ := getGroup(ref)
+			if group == nil {
+				continue
+			}
+			for _, u := range group.AllUsers() {
+				if u.Suspended {
+					suspended[u.Email] = true
+				}
+			}
+		}
+	}
+	if policy.DisableUnmatched && !allResolved {
+		log.Warnw("some rules depend on groups that could not be resolved, no unmatched user will be disabled or deleted in this run")
+	}
+
+	disabledAt, err := lastDisabled()
+	if err != nil {
+		log.Errorw("unable to read the audit log, no user will be deleted or enabled again in this run", "error", err)
+	}
+
+	for email, update := range userUpdates {
+		grafUser := grafana.findUser(email)
+		if grafUser == nil || protection(email) != "" {
+			continue
+		}
+
+		// only accounts that were disabled by the sync itself are deleted or enabled again
+		since, disabledBySync := disabledAt[email]
+		disabled := grafana.disabledUsers[grafUser.ID]
+
+		var why string
+		if policy.DisableSuspended && suspended[email] {
+			why = "suspended in the directory"
+		} else if policy.DisableUnmatched && allResolved && !matched[email] {
+			why = "not matched by any rule"
+		} else {
+			if disabled && disabledBySync && matched[email] && !suspended[email] {
+				update.Offboarding = &offboardingChange{grafUser.ID, offboardingEnable, fmt.Sprintf("matched by a rule again, disabled since %v", since.Format(time.RFC3339))}
+			}
+			continue
+		}
+
+		if !disabled {
+			update.Offboarding = &offboardingChange{grafUser.ID, offboardingDisable, why}
+			continue
+		}
+
+		if policy.DeleteAfter > 0 && disabledBySync && time.Since(since) >= policy.DeleteAfter {
+			update.Offboarding = &offboardingChange{grafUser.ID, offboardingDelete, fmt.Sprintf("%v, disabled since %v", why, since.Format(time.RFC3339))}
+		}
+	}
+}
+
+// lastDisabled returns when each user was last disabled by the sync in the current target, according to the audit log.
+// Users the sync has enabled again since then are not included.
+func lastDisabled() (map[string]time.Time, error) {
+	result := make(map[string]time.Time)
+	if auditJournal == nil {
+		return result, nil
+	}
+
+	disables, err := auditJournal.Query(audit.Filter{Action: offboardingDisable})
+	if err != nil {
+		return nil, err
+	}
+	enables, err := auditJournal.Query(audit.Filter{Action: offboardingEnable})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range disables {
+		if isCurrentTarget(e) && e.Outcome == audit.OutcomeOK {
+			result[e.User] = e.Time // entries are sorted oldest first, so the newest one wins
+		}
+	}
+	for _, e := range enables {
+		if since, ok := result[e.User]; ok && isCurrentTarget(e) && e.Outcome == audit.OutcomeOK && !e.Time.Before(since) {
+			delete(result, e.User)
+		}
+	}
+	return result, nil
+}
+
+// isCurrentTarget is true if the audit entry was written for the current target
+func isCurrentTarget(e audit.Entry) bool {
+	// entries from before there were multiple grafana instances have no target, they belong to the first one
+	return e.Target == currentTarget.Name || (e.Target == "" && currentTarget == targets[0])
+}
+
+func (g *grafanaState) disableUser(userID uint) error {
+	g.Wait()
+	return g.apiRequest("POST", fmt.Sprintf("/api/admin/users/%d/disable", userID), 0, nil, nil)
+}
+
+func (g *grafanaState) enableUser(userID uint) error {
+	g.Wait()
+	return g.apiRequest("POST", fmt.Sprintf("/api/admin/users/%d/enable", userID), 0, nil, nil)
+}
+
+func (g *grafanaState) deleteUser(userID uint) error {
+	g.Wait()
+	return g.apiRequest("DELETE", fmt.Sprintf("/api/admin/users/%d", userID), 0, nil, nil)
+}
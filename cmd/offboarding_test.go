@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/audit"
+)
+
+func TestPlanOffboarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offboarding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	users := []string{"kept@corp.com", "gone@corp.com", "old@corp.com", "recent@corp.com", "back@corp.com", "manual@corp.com", "reenabled@corp.com", "admin@corp.com"}
+	disabled := []string{"old@corp.com", "recent@corp.com", "back@corp.com", "manual@corp.com", "reenabled@corp.com"}
+	matching := &Rule{Users: FlattenedArray{"kept@corp.com", "back@corp.com", "manual@corp.com", "reenabled@corp.com"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}
+
+	now := time.Now()
+	history := []audit.Entry{
+		{Time: now.Add(-60 * 24 * time.Hour), Action: offboardingDisable, User: "old@corp.com", Outcome: audit.OutcomeOK},
+		{Time: now.Add(-50 * 24 * time.Hour), Action: offboardingDisable, User: "back@corp.com", Outcome: audit.OutcomeOK},
+		{Time: now.Add(-40 * 24 * time.Hour), Action: offboardingDisable, User: "reenabled@corp.com", Outcome: audit.OutcomeOK},
+		{Time: now.Add(-30 * 24 * time.Hour), Action: offboardingEnable, User: "reenabled@corp.com", Outcome: audit.OutcomeOK}, // disabled by someone else afterwards
+		{Time: now.Add(-20 * 24 * time.Hour), Action: offboardingDisable, User: "manual@corp.com", Outcome: audit.OutcomeFailed, Error: "403"},
+		{Time: now.Add(-time.Hour), Action: offboardingDisable, User: "recent@corp.com", Outcome: audit.OutcomeOK},
+		{Time: now.Add(-time.Hour), Target: "other", Action: offboardingDisable, User: "manual@corp.com", Outcome: audit.OutcomeOK},
+	}
+
+	tests := []struct {
+		name  string
+		rules []*Rule
+		want  map[string]string
+	}{
+		{"all groups resolved", []*Rule{matching}, map[string]string{
+			"gone@corp.com": offboardingDisable,
+			"old@corp.com":  offboardingDelete,
+			"back@corp.com": offboardingEnable,
+		}},
+		{"unresolved group", []*Rule{matching, {Groups: FlattenedArray{"file:missing"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}}, map[string]string{
+			"back@corp.com": offboardingEnable, // matched by a rule that could be resolved
+		}},
+		{"restrictions don't match", []*Rule{matching, {Users: FlattenedArray{"gone@corp.com"}, Organizations: FlattenedArray{"Prod"}, Exclude: true}}, map[string]string{
+			"gone@corp.com": offboardingDisable,
+			"old@corp.com":  offboardingDelete,
+			"back@corp.com": offboardingEnable,
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Rules: test.rules}
+			c.Settings.ProtectedUsers = FlattenedArray{"admin@corp.com"}
+			c.Settings.Offboarding = OffboardingPolicy{DisableUnmatched: true, DeleteAfter: 30 * 24 * time.Hour}
+			c.Settings.AuditLogPath = filepath.Join(dir, test.name+".log")
+			setupTestGrafana(c, users...)
+			activeRules = c.Rules
+			for _, email := range disabled {
+				grafana.disabledUsers[grafana.findUser(email).ID] = true
+			}
+
+			if err := setupAuditJournal(); err != nil {
+				t.Fatalf("setupAuditJournal() error = %v", err)
+			}
+			defer func() {
+				auditJournal.Close()
+				auditJournal = nil
+			}()
+			for _, e := range history {
+				if err := auditJournal.Append(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			updates := make(map[string]*userUpdate)
+			for _, email := range users {
+				updates[email] = &userUpdate{Email: email}
+			}
+			planOffboarding(updates)
+
+			for _, email := range users {
+				got := ""
+				if change := updates[email].Offboarding; change != nil {
+					got = change.action()
+					if change.UserID != grafana.findUser(email).ID {
+						t.Errorf("%v: change is for user id %d", email, change.UserID)
+					}
+				}
+				if got != test.want[email] {
+					t.Errorf("%v: offboarding = %q, want %q", email, got, test.want[email])
+				}
+			}
+		})
+	}
+}
+
+func TestOffboardingSafetyBrakeStats(t *testing.T) {
+	tests := []struct {
+		action   string
+		removals int
+	}{
+		{offboardingDisable, 1},
+		{offboardingDelete, 1},
+		{offboardingEnable, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			plan := &updatePlan{Users: []userUpdate{{Email: "a@corp.com", Offboarding: &offboardingChange{1, test.action, "test"}}}}
+			if got := plan.stats().Removals; got != test.removals {
+				t.Errorf("stats().Removals = %d, want %d", got, test.removals)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rikimaru0345/sdk"
+)
+
+func (g *grafanaState) findOrg(name string) *grafanaOrganization {
+	for _, org := range g.organizations {
+		if org.Name == name {
+			return org
+		}
+	}
+	for _, org := range g.newOrganizations {
+		if org.Name == name {
+			return org
+		}
+	}
+	return nil
+}
+
+func (g *grafanaState) createOrg(org *grafanaOrganization) error {
+	g.Wait()
+	status, err := g.CreateOrg(sdk.Org{Name: org.Name})
+	if err != nil {
+		return err
+	}
+	if status.OrgID == nil {
+		return fmt.Errorf("grafana did not return the id of the new org")
+	}
+	org.ID = *status.OrgID
+	return nil
+}
+
+// planOrganizations checks that every org that is named literally (not by a regex) in a rule exists.
+// Missing orgs are returned so they can be created (only if 'createMissingOrgs' is enabled),
+// otherwise the rule can't do anything for them, which is most likely a mistake in the config.
+// Orgs that exist, but could not be fetched, are not missing.
+func planOrganizations() []*grafanaOrganization {
+	var newOrgs []*grafanaOrganization
+
+	for _, rule := range activeRules {
+		for _, name := range rule.Organizations {
+			if isRegex(name) {
+				continue // regex, it is fine if it doesn't match anything
+			}
+			if grafana.findOrg(name) != nil || grafana.unavailableOrgs[name] {
+				continue
+			}
+
+			if !config.Settings.CreateMissingOrgs {
+				log.Warnw("RULE DOES NOTHING FOR AN ORG: the org does not exist in grafana (check for typos, or enable 'createMissingOrgs' to create it)", "ruleIndex", rule.Index, "ruleNote", rule.Note, "org", name)
+				continue
+			}
+
+			org := &grafanaOrganization{&sdk.Org{Name: name}, nil, nil, nil, "", false, false}
+			grafana.newOrganizations = append(grafana.newOrganizations, org)
+			newOrgs = append(newOrgs, org)
+		}
+	}
+
+	return newOrgs
+}
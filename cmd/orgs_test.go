@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPlanOrganizationsSkipsUnavailableOrgs(t *testing.T) {
+	server := newFakeGrafana()
+	defer server.Close()
+	server.respond("GET /api/users", func(*http.Request) interface{} {
+		return []map[string]interface{}{{"id": 1, "email": "a@corp.com", "login": "a@corp.com"}}
+	})
+	server.respond("GET /api/orgs", func(*http.Request) interface{} {
+		return []map[string]interface{}{{"id": 2, "name": "Prod"}, {"id": 3, "name": "Dev"}}
+	})
+	server.respond("GET /api/orgs/2/users", func(*http.Request) interface{} {
+		return []map[string]interface{}{{"orgId": 2, "userId": 1, "email": "a@corp.com", "role": "Viewer"}}
+	})
+	server.fail("GET /api/orgs/3/users", 500)
+
+	rules := []*Rule{{Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"Prod", "Dev", "Staging"}, Role: "Editor"}}
+	c := &Config{Grafanas: server.config(), Rules: rules}
+	c.Settings.CreateMissingOrgs = true
+	setupTestGrafana(c)
+	activeRules = c.Rules
+
+	if err := grafana.fetchState(); err != nil {
+		t.Fatalf("fetchState() error = %v", err)
+	}
+	if len(grafana.organizations) != 1 || !grafana.unavailableOrgs["Dev"] {
+		t.Fatalf("fetchState() orgs = %v, unavailable = %v; want only Prod, and Dev unavailable", grafana.organizations, grafana.unavailableOrgs)
+	}
+
+	var created []string
+	for _, org := range planOrganizations() {
+		created = append(created, org.Name)
+	}
+	if strings.Join(created, ",") != "Staging" {
+		t.Errorf("planOrganizations() = %v, want only Staging", created)
+	}
+
+	update := newUserUpdate("a@corp.com")
+	for _, change := range update.Changes {
+		if change.Organization.Name == "Dev" {
+			t.Errorf("a change is planned for the unavailable org Dev")
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rikimaru0345/sdk"
+	"gopkg.in/yaml.v2"
+)
+
+// planFileVersion is increased whenever the schema of planFile changes in an incompatible way
+const planFileVersion = 1
+
+// planFile is the stable, serializable form of an update plan.
+// It can be saved, reviewed, and applied later (as long as grafana has not changed in the meantime).
+type planFile struct {
+	Version    int       `json:"version" yaml:"version"`
+	RunID      string    `json:"runId" yaml:"runId"`
+	CreatedAt  time.Time `json:"createdAt" yaml:"createdAt"`
+	Target     string    `json:"target,omitempty" yaml:"target,omitempty"` // name of the grafana instance, empty means the first one
+	GrafanaURL string    `json:"grafanaUrl" yaml:"grafanaUrl"`
+
+	NewUsers []planFileNewUser `json:"newUsers,omitempty" yaml:"newUsers,omitempty"`
+	NewOrgs  []string          `json:"newOrgs,omitempty" yaml:"newOrgs,omitempty"` // names of the orgs that will be created
+	NewTeams []planFileTeam    `json:"newTeams,omitempty" yaml:"newTeams,omitempty"`
+	Users    []planFileUser    `json:"users" yaml:"users"`
+
+	FolderChanges []planFileFolderChange `json:"folderChanges,omitempty" yaml:"folderChanges,omitempty"`
+
+	// changes that are not made because the user is protected (only informational, they are not applied)
+	Skipped []planFileSkipped `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+}
+
+type planFileSkipped struct {
+	Email   string `json:"email" yaml:"email"`
+	Org     string `json:"org" yaml:"org"`
+	OldRole Role   `json:"oldRole" yaml:"oldRole"`
+	NewRole Role   `json:"newRole" yaml:"newRole"`
+	Why     string `json:"why" yaml:"why"`
+}
+
+type planFileNewUser struct {
+	Email  string          `json:"email" yaml:"email"`
+	Reason *planFileReason `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+type planFileTeam struct {
+	Org   string `json:"org" yaml:"org"`
+	OrgID uint   `json:"orgId" yaml:"orgId"`
+	Name  string `json:"name" yaml:"name"`
+}
+
+type planFileUser struct {
+	Email       string               `json:"email" yaml:"email"`
+	Changes     []planFileRoleChange `json:"changes,omitempty" yaml:"changes,omitempty"`
+	TeamChanges []planFileTeamChange `json:"teamChanges,omitempty" yaml:"teamChanges,omitempty"`
+	AdminChange *planFileAdminChange `json:"grafanaAdmin,omitempty" yaml:"grafanaAdmin,omitempty"`
+	Offboarding *planFileOffboarding `json:"offboarding,omitempty" yaml:"offboarding,omitempty"`
+}
+
+type planFileOffboarding struct {
+	Action string `json:"action" yaml:"action"` // disable_user, delete_user, enable_user
+	Why    string `json:"why" yaml:"why"`
+}
+
+type planFileAdminChange struct {
+	Action string          `json:"action" yaml:"action"` // grafana_admin_grant, grafana_admin_revoke
+	Reason *planFileReason `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+type planFileRoleChange struct {
+	Action  string          `json:"action" yaml:"action"` // add, promote, demote, remove
+	Org     string          `json:"org" yaml:"org"`
+	OrgID   uint            `json:"orgId" yaml:"orgId"` // 0 for orgs that will be created
+	OldRole Role            `json:"oldRole" yaml:"oldRole"`
+	NewRole Role            `json:"newRole" yaml:"newRole"`
+	Reason  *planFileReason `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+type planFileTeamChange struct {
+	Action string          `json:"action" yaml:"action"` // team_add, team_remove
+	Org    string          `json:"org" yaml:"org"`
+	OrgID  uint            `json:"orgId" yaml:"orgId"`
+	Team   string          `json:"team" yaml:"team"`
+	Reason *planFileReason `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+type planFileFolderChange struct {
+	Action        string          `json:"action" yaml:"action"` // permission_add, permission_update, permission_remove
+	Org           string          `json:"org" yaml:"org"`
+	OrgID         uint            `json:"orgId" yaml:"orgId"`
+	Dashboard     bool            `json:"dashboard,omitempty" yaml:"dashboard,omitempty"` // the uid is the uid of a dashboard, not of a folder
+	UID           string          `json:"uid" yaml:"uid"`
+	Title         string          `json:"title" yaml:"title"`
+	User          string          `json:"user,omitempty" yaml:"user,omitempty"` // either the user...
+	Team          string          `json:"team,omitempty" yaml:"team,omitempty"` // ...or the team gets the permission
+	OldPermission Permission      `json:"oldPermission" yaml:"oldPermission"`
+	NewPermission Permission      `json:"newPermission" yaml:"newPermission"`
+	Reason        *planFileReason `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+type planFileReason struct {
+	RuleIndex int    `json:"ruleIndex" yaml:"ruleIndex"`
+	RuleNote  string `json:"ruleNote,omitempty" yaml:"ruleNote,omitempty"`
+}
+
+func newPlanFileReason(r *Rule) *planFileReason {
+	if r == nil {
+		return nil
+	}
+	return &planFileReason{r.Index, r.Note}
+}
+
+// rule creates a placeholder rule, so changes loaded from a file can show (and audit) their reason
+func (r *planFileReason) rule() *Rule {
+	if r == nil {
+		return nil
+	}
+	return &Rule{Note: r.RuleNote, Index: r.RuleIndex}
+}
+
+func toPlanFile(plan *updatePlan) *planFile {
+	f := &planFile{
+		Version:    planFileVersion,
+		RunID:      plan.RunID,
+		CreatedAt:  time.Now().UTC(),
+		Target:     currentTarget.Name,
+		GrafanaURL: currentTarget.Config.URL,
+		Users:      make([]planFileUser, 0, len(plan.Users)),
+	}
+
+	for _, u := range plan.NewUsers {
+		f.NewUsers = append(f.NewUsers, planFileNewUser{u.Email, newPlanFileReason(u.Reason)})
+	}
+
+	for _, org := range plan.NewOrgs {
+		f.NewOrgs = append(f.NewOrgs, org.Name)
+	}
+
+	for _, team := range plan.NewTeams {
+		f.NewTeams = append(f.NewTeams, planFileTeam{grafana.organizations[team.OrgID].Name, team.OrgID, team.Name})
+	}
+
+	for _, uu := range plan.Users {
+		u := planFileUser{Email: uu.Email}
+		for _, change := range uu.Changes {
+			u.Changes = append(u.Changes, planFileRoleChange{change.action(), change.Organization.Name, change.Organization.ID, change.OldRole, change.NewRole, newPlanFileReason(change.Reason)})
+		}
+		for _, change := range uu.TeamChanges {
+			u.TeamChanges = append(u.TeamChanges, planFileTeamChange{change.metricType(), change.Organization.Name, change.Organization.ID, change.Team.Name, newPlanFileReason(change.Reason)})
+		}
+		if change := uu.AdminChange; change != nil {
+			u.AdminChange = &planFileAdminChange{change.action(), newPlanFileReason(change.Reason)}
+		}
+		if change := uu.Offboarding; change != nil {
+			u.Offboarding = &planFileOffboarding{change.action(), change.Why}
+		}
+		f.Users = append(f.Users, u)
+	}
+
+	for _, change := range plan.FolderChanges {
+		c := planFileFolderChange{change.action(), change.Organization.Name, change.Organization.ID, change.Folder.IsDashboard, change.Folder.UID, change.Folder.Title, change.UserEmail, "", change.OldPermission, change.NewPermission, newPlanFileReason(change.Reason)}
+		if change.Team != nil {
+			c.Team = change.Team.Name
+		}
+		f.FolderChanges = append(f.FolderChanges, c)
+	}
+
+	for _, s := range plan.Skipped {
+		f.Skipped = append(f.Skipped, planFileSkipped{s.Email, s.Change.Organization.Name, s.Change.OldRole, s.Change.NewRole, s.Why})
+	}
+
+	return f
+}
+
+// marshalPlanFile serializes a plan, format is either json or yaml
+func marshalPlanFile(f *planFile, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(f, "", "    ")
+	case "yaml":
+		return yaml.Marshal(f)
+	}
+	return nil, fmt.Errorf("unknown plan format '%v', must be json or yaml", format)
+}
+
+// planFileFormat decides the format of a plan file based on its extension
+func planFileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+func writePlanFile(path string, plan *updatePlan) error {
+	bytes, err := marshalPlanFile(toPlanFile(plan), planFileFormat(path))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0640)
+}
+
+func readPlanFile(path string) (*planFile, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &planFile{}
+	if planFileFormat(path) == "yaml" {
+		err = yaml.Unmarshal(bytes, f)
+	} else {
+		err = json.Unmarshal(bytes, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing plan file: %v", err)
+	}
+
+	if f.Version != planFileVersion {
+		return nil, fmt.Errorf("plan file has version %d, but only version %d is supported", f.Version, planFileVersion)
+	}
+	return f, nil
+}
+
+// toUpdatePlan turns a saved plan back into an executable plan.
+// The plan is only valid if grafana (its current state must already be fetched) still looks exactly like it did when the plan was created:
+// the orgs and teams must exist (or still be missing, if they are created by the plan), every user must have the role that is the 'oldRole' of its change,
+// and team memberships, grafana admin flags, disabled accounts, and folder permissions must not have changed.
+func (f *planFile) toUpdatePlan() (*updatePlan, error) {
+	if strings.TrimSuffix(f.GrafanaURL, "/") != strings.TrimSuffix(currentTarget.Config.URL, "/") {
+		return nil, fmt.Errorf("plan was created for grafana at '%v', but the config uses '%v' for target '%v'", f.GrafanaURL, currentTarget.Config.URL, currentTarget.Name)
+	}
+
+	plan := &updatePlan{RunID: f.RunID}
+
+	for _, u := range f.NewUsers {
+		if grafana.findUser(u.Email) != nil {
+			return nil, fmt.Errorf("user '%v' should be created, but exists already", u.Email)
+		}
+		plan.NewUsers = append(plan.NewUsers, &newGrafanaUser{u.Email, u.Reason.rule()})
+	}
+
+	newOrgs := make(map[string]*grafanaOrganization)
+	for _, name := range f.NewOrgs {
+		if grafana.findOrg(name) != nil || grafana.unavailableOrgs[name] {
+			return nil, fmt.Errorf("org '%v' should be created, but it exists already", name)
+		}
+		org := &grafanaOrganization{&sdk.Org{Name: name}, nil, nil, nil, "", false, false}
+		plan.NewOrgs = append(plan.NewOrgs, org)
+		newOrgs[name] = org
+	}
+
+	findOrg := func(id uint, name string) (*grafanaOrganization, error) {
+		if id == 0 {
+			if org, exists := newOrgs[name]; exists {
+				return org, nil
+			}
+			return nil, fmt.Errorf("org '%v' has no id, but it is not created by the plan either", name)
+		}
+		org, exists := grafana.organizations[id]
+		if !exists || org.Name != name {
+			return nil, fmt.Errorf("org '%v' (id %d) does not exist anymore", name, id)
+		}
+		return org, nil
+	}
+
+	for _, t := range f.NewTeams {
+		org, err := findOrg(t.OrgID, t.Org)
+		if err != nil {
+			return nil, err
+		}
+		if org.findTeam(t.Name) != nil {
+			return nil, fmt.Errorf("team '%v' in org '%v' should be created, but it exists already", t.Name, t.Org)
+		}
+		if org.ID == 0 {
+			return nil, fmt.Errorf("team '%v' should be created in org '%v', which is created by the same plan (teams in new orgs are created in the next run)", t.Name, t.Org)
+		}
+		team := &grafanaTeam{OrgID: org.ID, Name: t.Name}
+		org.Teams = append(org.Teams, team)
+		plan.NewTeams = append(plan.NewTeams, team)
+	}
+
+	for _, u := range f.Users {
+		update := userUpdate{Email: u.Email}
+
+		for _, c := range u.Changes {
+			org, err := findOrg(c.OrgID, c.Org)
+			if err != nil {
+				return nil, err
+			}
+
+			var currentRole Role
+			if orgUser := org.findUser(u.Email); orgUser != nil {
+				currentRole = Role(orgUser.Role)
+			}
+			if currentRole != c.OldRole {
+				return nil, fmt.Errorf("role of '%v' in org '%v' has changed since the plan was created (plan: '%v', now: '%v')", u.Email, c.Org, c.OldRole, currentRole)
+			}
+
+			update.Changes = append(update.Changes, &userRoleChange{org, c.OldRole, c.NewRole, c.Reason.rule()})
+		}
+
+		for _, c := range u.TeamChanges {
+			org, err := findOrg(c.OrgID, c.Org)
+			if err != nil {
+				return nil, err
+			}
+			team := org.findTeam(c.Team)
+			if team == nil {
+				return nil, fmt.Errorf("team '%v' in org '%v' does not exist anymore", c.Team, c.Org)
+			}
+			grafUser := grafana.findUser(u.Email)
+			if grafUser == nil {
+				return nil, fmt.Errorf("user '%v' does not exist anymore", u.Email)
+			}
+
+			add := c.Action == "team_add"
+			if team.ID != 0 && team.hasMember(grafUser.ID) == add {
+				return nil, fmt.Errorf("membership of '%v' in team '%v' (org '%v') has changed since the plan was created", u.Email, c.Team, c.Org)
+			}
+
+			update.TeamChanges = append(update.TeamChanges, &teamMembershipChange{org, team, grafUser.ID, add, c.Reason.rule()})
+		}
+
+		if c := u.AdminChange; c != nil {
+			grafUser := grafana.findUser(u.Email)
+			if grafUser == nil {
+				return nil, fmt.Errorf("user '%v' does not exist anymore", u.Email)
+			}
+			grant := c.Action == "grafana_admin_grant"
+			if grafUser.IsGrafanaAdmin == grant {
+				return nil, fmt.Errorf("grafana admin flag of '%v' has changed since the plan was created", u.Email)
+			}
+			update.AdminChange = &grafanaAdminChange{grafUser.ID, grant, c.Reason.rule()}
+		}
+
+		if c := u.Offboarding; c != nil {
+			grafUser := grafana.findUser(u.Email)
+			if grafUser == nil {
+				return nil, fmt.Errorf("user '%v' does not exist anymore", u.Email)
+			}
+			var wasDisabled bool
+			switch c.Action {
+			case offboardingDisable:
+			case offboardingDelete, offboardingEnable:
+				wasDisabled = true
+			default:
+				return nil, fmt.Errorf("unknown offboarding action '%v' for '%v'", c.Action, u.Email)
+			}
+			if grafana.disabledUsers[grafUser.ID] != wasDisabled {
+				return nil, fmt.Errorf("account of '%v' has been enabled or disabled since the plan was created", u.Email)
+			}
+			update.Offboarding = &offboardingChange{grafUser.ID, c.Action, c.Why}
+		}
+
+		plan.Users = append(plan.Users, update)
+	}
+
+	for _, c := range f.FolderChanges {
+		org, err := findOrg(c.OrgID, c.Org)
+		if err != nil {
+			return nil, err
+		}
+		folder := org.findFolder(c.UID, c.Dashboard)
+		if folder == nil {
+			return nil, fmt.Errorf("'%v' (uid %v) in org '%v' does not exist anymore", c.Title, c.UID, c.Org)
+		}
+
+		change := &folderPermissionChange{org, folder, 0, c.User, nil, c.OldPermission, c.NewPermission, c.Reason.rule()}
+		if c.Team != "" {
+			change.Team = org.findTeam(c.Team)
+			if change.Team == nil {
+				return nil, fmt.Errorf("team '%v' in org '%v' does not exist anymore", c.Team, c.Org)
+			}
+		} else {
+			grafUser := grafana.findUser(c.User)
+			if grafUser == nil {
+				return nil, fmt.Errorf("user '%v' does not exist anymore", c.User)
+			}
+			change.UserID = grafUser.ID
+		}
+
+		if current := folder.currentPermission(change.UserID, change.Team); current != c.OldPermission {
+			return nil, fmt.Errorf("permission of '%v' for '%v' (org '%v') has changed since the plan was created (plan: '%v', now: '%v')", change.grantee(), c.Title, c.Org, c.OldPermission, current)
+		}
+
+		plan.FolderChanges = append(plan.FolderChanges, change)
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rikimaru0345/sdk"
+	"gopkg.in/yaml.v2"
+)
+
+// setupPlanTestGrafana sets up a grafana instance with an org, a team, and a folder
+func setupPlanTestGrafana() {
+	setupTestGrafana(&Config{}, "a@corp.com", "b@corp.com", "c@corp.com")
+	org := addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Viewer", "b@corp.com": "Editor"})
+	org.Teams = []*grafanaTeam{{10, 2, "SRE", nil}}
+	org.Folders = []*grafanaFolder{{ID: 5, UID: "f1", Title: "Ops", Permissions: []folderPermission{{UserID: 2, UserEmail: "b@corp.com", Permission: 1}}}}
+}
+
+// newTestPlan sets up grafana (see setupPlanTestGrafana), and returns a plan that changes every part of it
+// (accounts, orgs, teams, roles, the grafana admin flag, and folder permissions)
+func newTestPlan() *updatePlan {
+	setupPlanTestGrafana()
+	org := grafana.organizations[2]
+	team, folder := org.Teams[0], org.Folders[0]
+	newTeam := &grafanaTeam{0, 2, "Platform", nil}
+	org.Teams = append(org.Teams, newTeam)
+	newOrg := &grafanaOrganization{&sdk.Org{Name: "Staging"}, nil, nil, nil, "", false, false}
+
+	rule := &Rule{Index: 3, Note: "ops"}
+	return &updatePlan{
+		RunID:    "run-1",
+		NewUsers: []*newGrafanaUser{{"new@corp.com", rule}},
+		NewOrgs:  []*grafanaOrganization{newOrg},
+		NewTeams: []*grafanaTeam{newTeam},
+		Users: []userUpdate{
+			{
+				Email:       "a@corp.com",
+				Changes:     []*userRoleChange{{org, "Viewer", "Editor", rule}, {newOrg, "", "Viewer", rule}},
+				TeamChanges: []*teamMembershipChange{{org, team, 1, true, rule}, {org, newTeam, 1, true, rule}},
+				AdminChange: &grafanaAdminChange{1, true, rule},
+			},
+			{Email: "b@corp.com", Changes: []*userRoleChange{{org, "Editor", "", nil}}},
+			{Email: "c@corp.com", Offboarding: &offboardingChange{3, offboardingDisable, "not matched by any rule"}},
+		},
+		FolderChanges: []*folderPermissionChange{{org, folder, 2, "b@corp.com", nil, "View", "Edit", rule}},
+	}
+}
+
+func TestPlanFileRoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			plan := newTestPlan()
+			data, err := marshalPlanFile(toPlanFile(plan), format)
+			if err != nil {
+				t.Fatalf("marshalPlanFile() error = %v", err)
+			}
+
+			// the grafana state the plan is applied to is fetched again
+			setupPlanTestGrafana()
+			f := &planFile{}
+			if format == "yaml" {
+				err = yaml.Unmarshal(data, f)
+			} else {
+				err = json.Unmarshal(data, f)
+			}
+			if err != nil {
+				t.Fatalf("unmarshal error = %v", err)
+			}
+			loaded, err := f.toUpdatePlan()
+			if err != nil {
+				t.Fatalf("toUpdatePlan() error = %v", err)
+			}
+
+			if got, want := strings.Join(loaded.keys(), "\n"), strings.Join(plan.keys(), "\n"); got != want {
+				t.Errorf("loaded plan has the changes\n%v\nwant\n%v", got, want)
+			}
+			if reason := loaded.Users[0].Changes[0].Reason; reason == nil || reason.Index != 3 || reason.Note != "ops" {
+				t.Errorf("loaded reason = %+v, want rule #3 'ops'", reason)
+			}
+		})
+	}
+}
+
+// setTestOrgRole changes the role of a member of an org, an empty role removes them from the org
+func setTestOrgRole(orgID uint, email string, role Role) {
+	org := grafana.organizations[orgID]
+	for i, u := range org.Users {
+		if u.Email != email {
+			continue
+		}
+		if role == "" {
+			org.Users = append(org.Users[:i], org.Users[i+1:]...)
+		} else {
+			org.Users[i].Role = string(role)
+		}
+		return
+	}
+}
+
+func TestPlanFileValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func() // changes grafana after the plan was created
+		wantErr string
+	}{
+		{"unchanged", func() {}, ""},
+		{"other grafana", func() { currentTarget.Config.URL = "http://other.test" }, "was created for grafana at"},
+		{"user created", func() { grafana.allUsers = append(grafana.allUsers, sdk.User{ID: 9, Email: "new@corp.com"}) }, "'new@corp.com' should be created, but exists already"},
+		{"org created", func() { addTestOrg(4, "Staging", nil) }, "org 'Staging' should be created"},
+		{"org deleted", func() { delete(grafana.organizations, 2) }, "org 'Prod' (id 2) does not exist anymore"},
+		{"org renamed", func() { grafana.organizations[2].Name = "Production" }, "org 'Prod' (id 2) does not exist anymore"},
+		{"team created", func() {
+			grafana.organizations[2].Teams = append(grafana.organizations[2].Teams, &grafanaTeam{11, 2, "Platform", nil})
+		}, "team 'Platform' in org 'Prod' should be created"},
+		{"team deleted", func() { grafana.organizations[2].Teams = nil }, "team 'SRE' in org 'Prod' does not exist anymore"},
+		{"role changed", func() { setTestOrgRole(2, "a@corp.com", "Admin") }, "role of 'a@corp.com' in org 'Prod' has changed"},
+		{"user removed from org", func() { setTestOrgRole(2, "b@corp.com", "") }, "role of 'b@corp.com' in org 'Prod' has changed"},
+		{"team member added", func() { grafana.organizations[2].Teams[0].Members = []grafanaTeamMember{{1, "a@corp.com"}} }, "membership of 'a@corp.com' in team 'SRE'"},
+		{"admin flag changed", func() { grafana.findUser("a@corp.com").IsGrafanaAdmin = true }, "grafana admin flag of 'a@corp.com' has changed"},
+		{"account disabled", func() { grafana.disabledUsers[3] = true }, "account of 'c@corp.com' has been enabled or disabled"},
+		{"folder deleted", func() { grafana.organizations[2].Folders = nil }, "'Ops' (uid f1) in org 'Prod' does not exist anymore"},
+		{"folder permission changed", func() { grafana.organizations[2].Folders[0].Permissions[0].Permission = 2 }, "permission of 'b@corp.com' for 'Ops' (org 'Prod') has changed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := toPlanFile(newTestPlan())
+			setupPlanTestGrafana()
+			test.change()
+
+			_, err := f.toUpdatePlan()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("toUpdatePlan() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("toUpdatePlan() error = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlanFileRejectsTeamsInNewOrgs(t *testing.T) {
+	f := toPlanFile(newTestPlan())
+	setupPlanTestGrafana()
+	f.NewTeams = append(f.NewTeams, planFileTeam{"Staging", 0, "Platform"}) // Staging is created by the plan
+
+	_, err := f.toUpdatePlan()
+	if err == nil || !strings.Contains(err.Error(), "which is created by the same plan") {
+		t.Errorf("toUpdatePlan() error = %v, want an error about the new org", err)
+	}
+}
+
+func TestReadPlanFileVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{"json", "plan.json", `{"version": 1, "users": []}`, ""},
+		{"yaml", "plan.yml", "version: 1\nusers: []\n", ""},
+		{"newer version", "plan.json", `{"version": 2, "users": []}`, "only version 1 is supported"},
+		{"no version", "plan.yaml", "users: []\n", "only version 1 is supported"},
+		{"invalid", "plan.json", `{"version": `, "parsing plan file"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.file)
+			if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readPlanFile(path)
+			if (err != nil) != (test.wantErr != "") || (err != nil && !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("readPlanFile() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlanWithoutReasons(t *testing.T) {
+	f := toPlanFile(newTestPlan())
+	for i := range f.NewUsers {
+		f.NewUsers[i].Reason = nil
+	}
+	for i := range f.Users {
+		for j := range f.Users[i].Changes {
+			f.Users[i].Changes[j].Reason = nil
+		}
+		for j := range f.Users[i].TeamChanges {
+			f.Users[i].TeamChanges[j].Reason = nil
+		}
+		if f.Users[i].AdminChange != nil {
+			f.Users[i].AdminChange.Reason = nil
+		}
+	}
+	for i := range f.FolderChanges {
+		f.FolderChanges[i].Reason = nil
+	}
+
+	setupPlanTestGrafana()
+	plan, err := f.toUpdatePlan()
+	if err != nil {
+		t.Fatalf("toUpdatePlan() error = %v", err)
+	}
+
+	// none of them may fail because a change has no rule as its reason
+	printPlan(currentTarget, plan)
+	for _, format := range []string{"table", "json", "yaml"} {
+		if err := writePlan(&bytes.Buffer{}, plan, format); err != nil {
+			t.Errorf("writePlan(%v) error = %v", format, err)
+		}
+	}
+	for _, c := range planForDisplay(plan) {
+		if _, exists := c["reasonIndex"]; exists {
+			t.Errorf("change %v has a reason, but the plan file has none", c["id"])
+		}
+	}
+}
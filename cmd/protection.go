@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+)
+
+// skippedChange is a change the rules call for, but that is not made because the user is protected.
+// It is still shown in the plan, so it is clear why the user keeps their role.
+type skippedChange struct {
+	Email  string
+	Change *userRoleChange
+	Why    string
+}
+
+// protection returns why a user must never be demoted or removed, or "" if they are not protected
+func protection(email string) string {
+	if why := protectedByConfig(email); why != "" {
+		return why
+	}
+	if grafUser := grafana.findUser(email); grafUser != nil && grafUser.IsGrafanaAdmin {
+		return "grafana server admin"
+	}
+	return ""
+}
+
+// protectedByConfig returns why a user is protected by the config: listed in protectedUsers, or the grafana account of the sync itself
+func protectedByConfig(email string) string {
+	for _, item := range config.Settings.ProtectedUsers {
+		if isRegex(item) {
+			if isMatch, err := regexp.MatchString(item[1:len(item)-1], email); err == nil && isMatch {
+				return "matches protectedUsers " + item
+			}
+		} else if item == email {
+			return "listed in protectedUsers"
+		}
+	}
+
+	grafUser := grafana.findUser(email)
+	if grafUser != nil && (grafUser.Login == currentTarget.Config.User || grafUser.Email == currentTarget.Config.User) {
+		return "grafana account used by grafana-permission-sync"
+	}
+	return ""
+}
+
+// protectedFrom returns why the change must not be made (because it would demote or remove a protected user), or ""
+func protectedFrom(email string, change *userRoleChange) string {
+	if !change.NewRole.isLowerThan(change.OldRole) {
+		return ""
+	}
+	return protection(email)
+}
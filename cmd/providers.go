@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/groups"
+)
+
+// the group providers that can be referenced in the config
+const (
+	providerGoogle = "google"
+	providerLDAP   = "ldap"
+	providerFile   = "file"
+)
+
+var (
+	providerNames = []string{providerGoogle, providerLDAP, providerFile}
+
+	groupProviders        = make(map[string]groups.Provider) // [provider name]Provider
+	groupProviderSettings = make(map[string]interface{})     // [provider name]settings the provider was created with
+
+	watchGroupFiles bool // only the daemon reloads group files when they change
+)
+
+// parseGroupRef splits a group reference like "ldap:cn=ops,dc=corp,dc=com" into the name of the provider and the key of the group.
+// Groups without a provider prefix belong to the default provider ('provider' in the config).
+func (c *Config) parseGroupRef(ref string) (provider string, key string) {
+	for _, name := range providerNames {
+		if strings.HasPrefix(ref, name+":") {
+			return name, ref[len(name)+1:]
+		}
+	}
+	return c.defaultProvider(), ref
+}
+
+func (c *Config) defaultProvider() string {
+	if c.Provider == "" {
+		return providerGoogle
+	}
+	return c.Provider
+}
+
+// getUsedProviders returns the names of all providers that are referenced by the rules
+func (c *Config) getUsedProviders() []string {
+	var names []string
+	for _, rule := range c.Rules {
+		for _, ref := range rule.Groups {
+			name, _ := c.parseGroupRef(ref)
+			names = append(names, name)
+		}
+	}
+	return distinct(names)
+}
+
+// setupGroupProviders creates all providers the current config needs (that don't exist yet, or whose settings have changed)
+func setupGroupProviders() error {
+	for _, name := range config.getUsedProviders() {
+		settings := providerSettings(name)
+		_, exists := groupProviders[name]
+		if exists && reflect.DeepEqual(groupProviderSettings[name], settings) {
+			continue
+		}
+
+		p, err := createGroupProvider(name)
+		if err != nil {
+			return fmt.Errorf("unable to create group provider '%v': %v", name, err)
+		}
+		if exists {
+			log.Infow("settings of a group provider have changed, it has been recreated", "provider", name)
+		}
+		groupProviders[name] = p
+		groupProviderSettings[name] = settings
+	}
+	return nil
+}
+
+// providerSettings returns the part of the config a provider is created from
+func providerSettings(name string) interface{} {
+	switch name {
+	case providerGoogle:
+		return config.Google
+	case providerLDAP:
+		return config.LDAP
+	case providerFile:
+		return config.File
+	}
+	return nil
+}
+
+func createGroupProvider(name string) (groups.Provider, error) {
+	switch name {
+	case providerGoogle:
+		wrapTransport := func(t http.RoundTripper) http.RoundTripper { return instrumentTransport("google", t) }
+		return groups.CreateGroupTree(log, config.Google.Domain, config.Google.AdminEmail, config.Google.CredentialsPath, config.Google.GroupBlacklist, wrapTransport, []string{
+			"https://www.googleapis.com/auth/admin.directory.group.member.readonly",
+			"https://www.googleapis.com/auth/admin.directory.group.readonly",
+			//"https://www.googleapis.com/auth/admin.directory.user.readonly",
+		}...)
+	case providerLDAP:
+		return groups.CreateLDAPProvider(log, config.LDAP)
+	case providerFile:
+		p, err := groups.CreateFileProvider(log, config.File)
+		if err != nil {
+			return nil, err
+		}
+		if watchGroupFiles {
+			setupGroupFilesHotReload(p)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown provider")
+}
+
+// getGroup resolves a group reference (for example "google:sre@corp.com") using the corrosponding provider
+func getGroup(ref string) (*groups.Group, error) {
+	providerName, key := config.parseGroupRef(ref)
+	p, exists := groupProviders[providerName]
+	if !exists {
+		return nil, fmt.Errorf("group provider '%v' is not set up", providerName)
+	}
+	return p.GetGroup(key)
+}
+
+// clearGroupProviders removes all cached groups and users from all providers
+func clearGroupProviders() {
+	for _, p := range groupProviders {
+		p.Clear()
+	}
+}
+
+// listGroupMembersForDisplay lists the members of a group using the corrosponding provider
+func listGroupMembersForDisplay(ref string, includeDerived bool) ([]map[string]interface{}, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	providerName, key := config.parseGroupRef(ref)
+	p, exists := groupProviders[providerName]
+	if !exists {
+		return nil, fmt.Errorf("group provider '%v' is not set up", providerName)
+	}
+	return p.ListGroupMembersForDisplay(key, includeDerived)
+}
+
+// listUserGroupsForDisplay finds the groups of a user in all providers
+func listUserGroupsForDisplay(userKey string) ([]map[string]interface{}, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	names := make([]string, 0, len(groupProviders))
+	for name := range groupProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]map[string]interface{}, 0)
+	for _, name := range names {
+		userGroups, err := groupProviders[name].ListUserGroupsForDisplay(userKey)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		for _, g := range userGroups {
+			g["provider"] = name
+			result = append(result, g)
+		}
+	}
+	return result, nil
+}
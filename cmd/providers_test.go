@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cloudworkz/grafana-permission-sync/pkg/groups"
+)
+
+func TestParseGroupRef(t *testing.T) {
+	tests := []struct {
+		defaultProvider string
+		ref             string
+		provider        string
+		key             string
+	}{
+		{"", "sre@corp.com", providerGoogle, "sre@corp.com"},
+		{"", "google:sre@corp.com", providerGoogle, "sre@corp.com"},
+		{"", "ldap:cn=ops,dc=corp,dc=com", providerLDAP, "cn=ops,dc=corp,dc=com"},
+		{"", "file:contractors", providerFile, "contractors"},
+		{"", "file:/^team-/", providerFile, "/^team-/"},
+		{providerLDAP, "cn=ops,dc=corp,dc=com", providerLDAP, "cn=ops,dc=corp,dc=com"},
+		{providerLDAP, "google:sre@corp.com", providerGoogle, "sre@corp.com"},
+		{providerFile, "unknown:contractors", providerFile, "unknown:contractors"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			c := &Config{Provider: test.defaultProvider}
+			provider, key := c.parseGroupRef(test.ref)
+			if provider != test.provider || key != test.key {
+				t.Errorf("parseGroupRef(%q) = %v, %v; want %v, %v", test.ref, provider, key, test.provider, test.key)
+			}
+		})
+	}
+}
+
+func TestGetUsedProviders(t *testing.T) {
+	c := &Config{Provider: providerLDAP, Rules: []*Rule{
+		{Groups: FlattenedArray{"cn=ops,dc=corp,dc=com", "file:contractors"}},
+		{Groups: FlattenedArray{"google:sre@corp.com", "file:break-glass"}},
+		{Users: FlattenedArray{"a@corp.com"}},
+	}}
+
+	got := c.getUsedProviders()
+	sort.Strings(got)
+	if strings.Join(got, ",") != "file,google,ldap" {
+		t.Errorf("getUsedProviders() = %v, want [file google ldap]", got)
+	}
+}
+
+func TestSetupGroupProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.yaml", "b.yaml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("contractors: [a@external.com]\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		delete(groupProviders, providerFile)
+		delete(groupProviderSettings, providerFile)
+	}()
+
+	rules := []*Rule{{Groups: FlattenedArray{"file:contractors"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}}
+	config = &Config{Rules: rules, File: groups.FileConfig{Paths: []string{filepath.Join(dir, "a.yaml")}}}
+	if err := setupGroupProviders(); err != nil {
+		t.Fatalf("setupGroupProviders() error = %v", err)
+	}
+	first := groupProviders[providerFile]
+	if first == nil || groupProviders[providerGoogle] != nil {
+		t.Fatalf("setupGroupProviders() created %v, want only the file provider", groupProviders)
+	}
+
+	config = &Config{Rules: rules, File: groups.FileConfig{Paths: []string{filepath.Join(dir, "a.yaml")}}}
+	if err := setupGroupProviders(); err != nil || groupProviders[providerFile] != first {
+		t.Errorf("setupGroupProviders() recreated the provider (error %v), but its settings did not change", err)
+	}
+
+	config = &Config{Rules: rules, File: groups.FileConfig{Paths: []string{filepath.Join(dir, "b.yaml")}}}
+	if err := setupGroupProviders(); err != nil || groupProviders[providerFile] == first {
+		t.Errorf("setupGroupProviders() kept the provider (error %v), but its settings changed", err)
+	}
+
+	config = &Config{Rules: rules, File: groups.FileConfig{Paths: []string{filepath.Join(dir, "missing.yaml")}}}
+	if err := setupGroupProviders(); err == nil {
+		t.Errorf("setupGroupProviders() with a missing group file returned no error")
+	}
+}
+
+func TestResolveUsersFromSeveralProviders(t *testing.T) {
+	defer setupTestGroups(t, "contractors: [a@external.com, b@external.com]\n")()
+
+	// a second provider, under the name of another one
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ldap.yaml")
+	if err := ioutil.WriteFile(path, []byte("ops: [b@external.com, c@corp.com]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ldap, err := groups.CreateFileProvider(log, groups.FileConfig{Paths: []string{path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupProviders[providerLDAP] = ldap
+	defer delete(groupProviders, providerLDAP)
+
+	tests := []struct {
+		name       string
+		groups     []string
+		want       []string
+		unresolved []string
+	}{
+		{"one provider", []string{"file:contractors"}, []string{"a@external.com", "b@external.com", "d@corp.com"}, nil},
+		{"merged", []string{"file:contractors", "ldap:ops"}, []string{"a@external.com", "b@external.com", "c@corp.com", "d@corp.com"}, nil},
+		{"default provider", []string{"ops"}, []string{"b@external.com", "c@corp.com", "d@corp.com"}, nil},
+		{"provider not set up", []string{"ldap:ops", "google:sre@corp.com"}, []string{"b@external.com", "c@corp.com", "d@corp.com"}, []string{"google:sre@corp.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &Rule{Groups: FlattenedArray(test.groups), Users: FlattenedArray{"d@corp.com"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}
+			setupTestGrafana(&Config{Provider: providerLDAP, Rules: []*Rule{rule}})
+
+			users, unresolved := rule.resolveUsers()
+			sort.Strings(users)
+			if strings.Join(users, ",") != strings.Join(test.want, ",") {
+				t.Errorf("resolveUsers() = %v, want %v", users, test.want)
+			}
+			if strings.Join(unresolved, ",") != strings.Join(test.unresolved, ",") {
+				t.Errorf("unresolved groups = %v, want %v", unresolved, test.unresolved)
+			}
+		})
+	}
+}
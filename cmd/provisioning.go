@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/rikimaru0345/sdk"
+)
+
+// newGrafanaUser is a user that is granted a role by a rule, but has no grafana account yet.
+// The account is created (login = email) when the plan is executed, its roles follow in the next run.
+type newGrafanaUser struct {
+	Email  string
+	Reason *Rule // first rule that grants the user a role
+}
+
+func (u *newGrafanaUser) key() string {
+	return fmt.Sprintf("user:new:%v", u.Email)
+}
+
+// planNewUsers finds the users that get a role from a rule, but don't have a grafana account yet (only if 'provisionUsers' is enabled).
+// Users that 'exclude' restrictions keep out of every org their rules apply to don't get an account.
+func planNewUsers() []*newGrafanaUser {
+	if !config.Settings.ProvisionUsers {
+		return nil
+	}
+
+	exclusions := resolveExclusions()
+
+	newUsers := make(map[string]*newGrafanaUser)
+	for _, rule := range activeRules {
+		if rule.isRestriction() || rule.Role == "" {
+			continue
+		}
+		users, _ := rule.resolveUsers()
+		for _, u := range users {
+			if _, exists := newUsers[u]; exists || grafana.findUser(u) != nil {
+				continue
+			}
+			if !rule.grantsRoleTo(u, exclusions) {
+				continue
+			}
+			newUsers[u] = &newGrafanaUser{u, rule}
+		}
+	}
+
+	result := make([]*newGrafanaUser, 0, len(newUsers))
+	for _, u := range newUsers {
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Email < result[j].Email })
+	return result
+}
+
+// exclusion is an 'exclude' restriction and its users
+type exclusion struct {
+	rule       *Rule
+	users      map[string]bool
+	unresolved bool // some groups could not be resolved, so we don't know who is excluded
+}
+
+func resolveExclusions() []exclusion {
+	var exclusions []exclusion
+	for _, rule := range activeRules {
+		if !rule.Exclude {
+			continue
+		}
+		users, unresolved := rule.resolveUsers()
+		e := exclusion{rule, make(map[string]bool), len(unresolved) > 0}
+		for _, u := range users {
+			e.users[u] = true
+		}
+		exclusions = append(exclusions, e)
+	}
+	return exclusions
+}
+
+// grantsRoleTo returns true if the rule gives the user a role in at least one org (existing or new) the user is not excluded from.
+// Orgs with an exclusion that could not be resolved don't count, the user might be excluded from them.
+func (r *Rule) grantsRoleTo(email string, exclusions []exclusion) bool {
+	var orgs []*grafanaOrganization
+	for _, org := range grafana.organizations {
+		orgs = append(orgs, org)
+	}
+	orgs = append(orgs, grafana.newOrganizations...)
+
+	for _, org := range orgs {
+		if !r.matchesOrg(org.Name) {
+			continue
+		}
+		excluded := false
+		for _, e := range exclusions {
+			if e.rule.matchesOrg(org.Name) && (e.unresolved || e.users[email]) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// createUser creates a grafana account for the user, with a random password nobody knows (they log in through oauth)
+func (g *grafanaState) createUser(u *newGrafanaUser) (sdk.StatusMessage, error) {
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return sdk.StatusMessage{}, err
+	}
+
+	g.Wait()
+	return g.CreateUser(sdk.User{Login: u.Email, Email: u.Email, Name: u.Email, Password: hex.EncodeToString(password)})
+}
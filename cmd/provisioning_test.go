@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanNewUsersRespectsExclusions(t *testing.T) {
+	grant := &Rule{Users: FlattenedArray{"new@corp.com", "existing@corp.com"}, Organizations: FlattenedArray{"Prod", "Dev"}, Role: "Viewer"}
+
+	tests := []struct {
+		name       string
+		exclusions []*Rule
+		want       []string
+	}{
+		{"no exclusions", nil, []string{"new@corp.com"}},
+		{"excluded from some orgs", []*Rule{{Users: FlattenedArray{"new@corp.com"}, Organizations: FlattenedArray{"Prod"}, Exclude: true}}, []string{"new@corp.com"}},
+		{"excluded from all orgs", []*Rule{{Users: FlattenedArray{"new@corp.com"}, Organizations: FlattenedArray{"Prod", "Dev"}, Exclude: true}}, nil},
+		{"excluded from all orgs by two rules", []*Rule{
+			{Users: FlattenedArray{"new@corp.com"}, Organizations: FlattenedArray{"Prod"}, Exclude: true},
+			{Users: FlattenedArray{"new@corp.com"}, Organizations: FlattenedArray{"/^D/"}, Exclude: true},
+		}, nil},
+		{"unresolved exclusion", []*Rule{{Groups: FlattenedArray{"file:missing"}, Organizations: FlattenedArray{"Prod", "Dev"}, Exclude: true}}, nil},
+		{"maxRole is no exclusion", []*Rule{{Users: FlattenedArray{"new@corp.com"}, Organizations: FlattenedArray{"Prod", "Dev"}, MaxRole: "Viewer"}}, []string{"new@corp.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Settings: Settings{ProvisionUsers: true}, Rules: append([]*Rule{grant}, test.exclusions...)}
+			setupTestGrafana(c, "existing@corp.com")
+			activeRules = c.Rules
+			addTestOrg(2, "Prod", nil)
+			addTestOrg(3, "Dev", nil)
+
+			var got []string
+			for _, u := range planNewUsers() {
+				got = append(got, u.Email)
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("planNewUsers() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
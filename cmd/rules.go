@@ -2,10 +2,14 @@ package main
 
 import "errors"
 
+import "fmt"
+
 import "strings"
 
 import "regexp"
 
+import "time"
+
 // Rule is a single mapping rule that specifies
 // what google groups/users get what grafana-role in which grafana-org
 type Rule struct {
@@ -15,14 +19,61 @@ type Rule struct {
 	Groups        FlattenedArray `yaml:"groups"`
 	Users         FlattenedArray `yaml:"users"`
 	Organizations FlattenedArray `yaml:"orgs"`
+	Targets       FlattenedArray `yaml:"targets"` // names of the grafana instances the rule applies to, empty means all
 	Role          Role           `yaml:"role"`
+	Teams         FlattenedArray `yaml:"teams"` // grafana teams (in every matching org) that should contain exactly the users of this rule
+
+	// folder and dashboard permissions for the users of this rule (or for its teams, if the rule has any)
+	Folders    []*PermissionGrant `yaml:"folders"`
+	Dashboards []*PermissionGrant `yaml:"dashboards"`
+
+	GrafanaAdmin bool `yaml:"grafanaAdmin"` // the users of this rule are grafana server admins (instance-wide, independent of 'orgs')
+
+	// restrictions, they are applied after all other rules and override them
+	Exclude bool `yaml:"exclude"` // the users of this rule get no role at all in the orgs (and are not in any managed team there)
+	MaxRole Role `yaml:"maxRole"` // the users of this rule get at most this role in the orgs
+
+	// the rule is only applied within this time window (both are optional), for temporary access
+	ValidFrom  *time.Time `yaml:"validFrom"`
+	ValidUntil *time.Time `yaml:"validUntil"`
+
+	// filled in for every plan (see expandRules)
+	patternMatches     map[string][]string // [pattern in groups or users]matched group references or user emails
+	unresolvedPatterns []string            // group patterns for which the list of all groups could not be fetched
 }
 
-func (r *Rule) verify() error {
-	if r.Role != "Viewer" && r.Role != "Editor" && r.Role != "Admin" {
+func (r *Rule) verify(c *Config) error {
+	if r.isRestriction() {
+		if r.Role != "" {
+			return errors.New("a rule with 'exclude' or 'maxRole' restricts the role of its users, it can't have a 'role' as well")
+		}
+		if r.Exclude && r.MaxRole != "" {
+			return errors.New("a rule can't have both 'exclude' and 'maxRole'")
+		}
+		if r.MaxRole != "" && r.MaxRole != "Viewer" && r.MaxRole != "Editor" && r.MaxRole != "Admin" {
+			return fmt.Errorf("Invalid maxRole \"%v\". Must be one of [Viewer, Editor, Admin]", r.MaxRole)
+		}
+		if len(r.Teams) > 0 {
+			return errors.New("a rule with 'exclude' or 'maxRole' can't have teams")
+		}
+		if len(r.Folders) > 0 || len(r.Dashboards) > 0 {
+			return errors.New("a rule with 'exclude' or 'maxRole' can't have folders or dashboards")
+		}
+		if r.GrafanaAdmin {
+			return errors.New("a rule with 'exclude' or 'maxRole' can't grant grafanaAdmin")
+		}
+	} else if r.Role == "" && (len(r.Folders) > 0 || len(r.Dashboards) > 0 || r.GrafanaAdmin) {
+		// only grants folder permissions (to users who get their role from another rule), or grafana admin
+	} else if r.Role != "Viewer" && r.Role != "Editor" && r.Role != "Admin" {
 		return errors.New("Invalid role \"%s\". Must be one of [Viewer, Editor, Admin]")
 	}
 
+	for _, t := range r.Targets {
+		if !c.hasTarget(t) {
+			return fmt.Errorf("unknown target '%v', it must be the name of a grafana instance in 'grafanas'", t)
+		}
+	}
+
 	for _, o := range r.Organizations {
 		if strings.HasPrefix(o, "/") && strings.HasSuffix(o, "/") {
 			pattern := o[1 : len(o)-1]
@@ -33,12 +84,165 @@ func (r *Rule) verify() error {
 		}
 	}
 
+	for _, g := range r.Groups {
+		if _, key := c.parseGroupRef(g); isRegex(key) {
+			if _, err := regexp.Compile(key[1 : len(key)-1]); err != nil {
+				return fmt.Errorf("group pattern '%v' can not be compiled: %v", g, err)
+			}
+		}
+	}
+	for _, u := range r.Users {
+		if isRegex(u) {
+			if _, err := regexp.Compile(u[1 : len(u)-1]); err != nil {
+				return fmt.Errorf("user pattern '%v' can not be compiled: %v", u, err)
+			}
+		}
+	}
+
+	for _, g := range r.Folders {
+		if err := g.verify(false); err != nil {
+			return fmt.Errorf("folder: %v", err)
+		}
+	}
+	for _, g := range r.Dashboards {
+		if err := g.verify(true); err != nil {
+			return fmt.Errorf("dashboard: %v", err)
+		}
+	}
+
+	if r.ValidFrom != nil && r.ValidUntil != nil && !r.ValidUntil.After(*r.ValidFrom) {
+		return fmt.Errorf("validUntil (%v) must be after validFrom (%v)", r.ValidUntil.Format(time.RFC3339), r.ValidFrom.Format(time.RFC3339))
+	}
+
+	if r.isTemplated() {
+		return r.verifyTemplate(c)
+	}
+
 	return nil
 }
 
+// isActive returns true if the given time is within the time window of the rule
+func (r *Rule) isActive(t time.Time) bool {
+	if r.ValidFrom != nil && t.Before(*r.ValidFrom) {
+		return false
+	}
+	if r.ValidUntil != nil && !t.Before(*r.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// reasonFields returns the log fields that name the rule as the reason for a change.
+// Works for nil as well (removals, or changes of a saved plan without reasons), there are no fields then.
+func (r *Rule) reasonFields() []interface{} {
+	if r == nil {
+		return nil
+	}
+	return []interface{}{"reasonIndex", r.Index, "reasonNote", r.Note}
+}
+
+// isRestriction returns true for rules that don't grant a role, but limit the role of their users
+func (r *Rule) isRestriction() bool {
+	return r.Exclude || r.MaxRole != ""
+}
+
+// roleLimit returns the highest role the users of a restriction may have
+func (r *Rule) roleLimit() Role {
+	if r.Exclude {
+		return ""
+	}
+	return r.MaxRole
+}
+
+// groupRefs returns the groups of the rule, with every group pattern replaced by the groups it matched
+func (r *Rule) groupRefs() []string {
+	var refs []string
+	for _, g := range r.Groups {
+		if _, key := config.parseGroupRef(g); isRegex(key) {
+			refs = append(refs, r.patternMatches[g]...)
+		} else {
+			refs = append(refs, g)
+		}
+	}
+	return distinct(refs)
+}
+
+// userEmails returns the users of the rule, with every user pattern replaced by the grafana users it matched
+func (r *Rule) userEmails() []string {
+	var emails []string
+	for _, u := range r.Users {
+		if isRegex(u) {
+			emails = append(emails, r.patternMatches[u]...)
+		} else {
+			emails = append(emails, u)
+		}
+	}
+	return distinct(emails)
+}
+
+// userPatternsMatching returns the patterns in 'users' that match the given user
+func (r *Rule) userPatternsMatching(email string) []string {
+	var patterns []string
+	for _, u := range r.Users {
+		if isRegex(u) && contains(r.patternMatches[u], email) {
+			patterns = append(patterns, u)
+		}
+	}
+	return patterns
+}
+
+// resolveUsers returns the emails of all users that are affected by this rule (members of the groups, and explicitly listed users).
+// Groups that could not be fetched (completely, or only some of their nested groups) are returned as 'unresolved',
+// their last known members (if any) are still included in 'users'.
+func (r *Rule) resolveUsers() (users []string, unresolved []string) {
+	unresolved = append(unresolved, r.unresolvedPatterns...)
+
+	for _, groupEmail := range r.groupRefs() {
+		group, err := getGroup(groupEmail)
+		if err != nil {
+			log.Errorw("unable to get group", "email", groupEmail, "error", err)
+			unresolved = append(unresolved, groupEmail)
+		}
+		for _, user := range group.AllUsers() {
+			users = append(users, user.Email)
+		}
+	}
+
+	for _, userEmail := range r.userEmails() {
+		users = append(users, userEmail)
+	}
+
+	return distinct(users), unresolved
+}
+
+// connections returns how the user is connected to this rule: through which groups (as paths like "a@x.com > b@x.com"), and/or by being listed in 'users'
+func (r *Rule) connections(email string) (groupPaths []string, listedInUsers bool) {
+	for _, groupEmail := range r.groupRefs() {
+		group, _ := getGroup(groupEmail)
+		if group == nil {
+			continue
+		}
+		if path := group.PathTo(email); path != nil {
+			groupPaths = append(groupPaths, strings.Join(path, " > "))
+		}
+	}
+
+	return groupPaths, contains(r.Users, email)
+}
+
+// appliesTo returns true if the rule is used for the grafana instance with the given name
+func (r *Rule) appliesTo(target string) bool {
+	return len(r.Targets) == 0 || contains(r.Targets, target)
+}
+
 func (r *Rule) matchesOrg(org string) bool {
+	return matchesOrgPattern(r.Organizations, org)
+}
+
+// matchesOrgPattern returns true if any of the items is the name of the org, or a regex (enclosed in //) that matches it
+func matchesOrgPattern(items []string, org string) bool {
 	// check if it contains an exact match, or regex match
-	for _, item := range r.Organizations {
+	for _, item := range items {
 		if strings.HasPrefix(item, "/") && strings.HasSuffix(item, "/") {
 			// is regex match?
 			pattern := item[1 : len(item)-1]
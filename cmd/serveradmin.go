@@ -0,0 +1,74 @@
+package main
+
+// grafanaAdminChange grants or revokes the instance-wide "Grafana Admin" flag (server admin) of a user.
+// Unlike org roles it is not bound to any org.
+type grafanaAdminChange struct {
+	UserID uint
+	Grant  bool // true: make the user a server admin, false: revoke it
+	Reason *Rule
+}
+
+func (c *grafanaAdminChange) action() string {
+	if c.Grant {
+		return "grafana_admin_grant"
+	}
+	return "grafana_admin_revoke"
+}
+
+// hasGrafanaAdminRules returns true if the server admin flag is managed by the sync in the current target.
+// Without any rule that grants it, nobody's flag is touched.
+func (c *Config) hasGrafanaAdminRules() bool {
+	return c.firstGrafanaAdminRule() != nil
+}
+
+// firstGrafanaAdminRule returns the first rule for the current target that grants the server admin flag (even if it is not active right now),
+// it is the reason for revocations
+func (c *Config) firstGrafanaAdminRule() *Rule {
+	for _, r := range c.Rules {
+		if r.GrafanaAdmin && r.appliesTo(currentTarget.Name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// planGrafanaAdmins grants the server admin flag to every user of a rule with 'grafanaAdmin: true', and revokes it from everyone else.
+// Revoking requires canDemote, and never happens to protected users (including the grafana account of the sync itself),
+// or while any of those rules depends on groups that could not be resolved.
+func planGrafanaAdmins(userUpdates map[string]*userUpdate) {
+	if !config.hasGrafanaAdminRules() {
+		return
+	}
+
+	granted := make(map[string]*Rule) // user email -> first rule that grants the flag
+	mayRevoke := config.Settings.CanDemote
+
+	for _, rule := range activeRules {
+		if !rule.GrafanaAdmin {
+			continue
+		}
+		users, unresolved := rule.resolveUsers()
+		if len(unresolved) > 0 {
+			mayRevoke = false
+			log.Warnw("rule grants grafana admin, but depends on groups that could not be resolved, nobody will lose grafana admin in this run", "ruleIndex", rule.Index, "ruleNote", rule.Note, "unresolvedGroups", unresolved)
+		}
+		for _, u := range users {
+			if _, exists := granted[u]; !exists {
+				granted[u] = rule
+			}
+		}
+	}
+	for email, update := range userUpdates {
+		grafUser := grafana.findUser(email)
+		if grafUser == nil {
+			continue
+		}
+		rule, isGranted := granted[email]
+
+		if isGranted && !grafUser.IsGrafanaAdmin {
+			update.AdminChange = &grafanaAdminChange{grafUser.ID, true, rule}
+		} else if !isGranted && grafUser.IsGrafanaAdmin && mayRevoke && protectedByConfig(email) == "" {
+			update.AdminChange = &grafanaAdminChange{grafUser.ID, false, config.firstGrafanaAdminRule()}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPlanGrafanaAdmins(t *testing.T) {
+	users := []string{"a@corp.com", "b@corp.com", "sync-admin"}
+	grant := &Rule{Users: FlattenedArray{"a@corp.com"}, GrafanaAdmin: true}
+	unresolved := &Rule{Groups: FlattenedArray{"file:missing"}, GrafanaAdmin: true}
+	otherTarget := &Rule{Users: FlattenedArray{"a@corp.com"}, GrafanaAdmin: true, Targets: FlattenedArray{"other"}}
+
+	tests := []struct {
+		name     string
+		rules    []*Rule
+		settings Settings
+		admins   []string // users that are grafana server admins right now
+		want     []string // email+ for every grant, email- for every revocation
+	}{
+		{"no grafanaAdmin rules", nil, Settings{CanDemote: true}, []string{"b@corp.com"}, nil},
+		{"rule for another target", []*Rule{otherTarget}, Settings{CanDemote: true}, []string{"b@corp.com"}, nil},
+		{"grant", []*Rule{grant}, Settings{}, nil, []string{"a@corp.com+"}},
+		{"already granted", []*Rule{grant}, Settings{CanDemote: true}, []string{"a@corp.com"}, nil},
+		{"revoke needs canDemote", []*Rule{grant}, Settings{}, []string{"a@corp.com", "b@corp.com"}, nil},
+		{"revoke", []*Rule{grant}, Settings{CanDemote: true}, []string{"b@corp.com"}, []string{"a@corp.com+", "b@corp.com-"}},
+		{"protectedUsers", []*Rule{grant}, Settings{CanDemote: true, ProtectedUsers: []string{"b@corp.com"}}, []string{"b@corp.com"}, []string{"a@corp.com+"}},
+		{"protectedUsers pattern", []*Rule{grant}, Settings{CanDemote: true, ProtectedUsers: []string{"/^b@/"}}, []string{"b@corp.com"}, []string{"a@corp.com+"}},
+		{"account of the sync", []*Rule{grant}, Settings{CanDemote: true}, []string{"a@corp.com", "sync-admin"}, nil},
+		{"unresolved group", []*Rule{grant, unresolved}, Settings{CanDemote: true}, []string{"b@corp.com"}, []string{"a@corp.com+"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Settings: test.settings, Rules: test.rules}
+			setupTestGrafana(c, users...)
+			activeRules = c.Rules
+			for i := range grafana.allUsers {
+				grafana.allUsers[i].IsGrafanaAdmin = contains(test.admins, grafana.allUsers[i].Email)
+			}
+
+			updates := make(map[string]*userUpdate)
+			for _, email := range users {
+				updates[email] = newUserUpdate(email)
+			}
+			planGrafanaAdmins(updates)
+
+			var got []string
+			for email, update := range updates {
+				if change := update.AdminChange; change != nil {
+					if change.UserID != grafana.findUser(email).ID || change.Reason == nil {
+						t.Errorf("change of %v = %+v, want the id of the user and a reason", email, change)
+					}
+					if change.Grant {
+						got = append(got, email+"+")
+					} else {
+						got = append(got, email+"-")
+					}
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("planGrafanaAdmins() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
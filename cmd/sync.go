@@ -1,18 +1,34 @@
 package main
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/cloudworkz/grafana-permission-sync/pkg/groups"
 	"github.com/rikimaru0345/sdk"
 	"golang.org/x/time/rate"
 )
 
+// updatePlan is everything that has to be done to bring grafana in line with the rules
+type updatePlan struct {
+	RunID    string                 // identifies the run the plan was created in (in the audit log)
+	NewUsers []*newGrafanaUser      // users that get an account now, and their roles in the next run
+	NewOrgs  []*grafanaOrganization // orgs that have to be created before users can be added to them
+	NewTeams []*grafanaTeam         // teams that have to be created before members can be added to them
+	Users    []userUpdate
+	Skipped  []skippedChange // changes that are not made because the user is protected
+
+	FolderChanges []*folderPermissionChange // made after all users and teams are updated
+}
+
 // describes an update to a user,
 // how to adjust roles in each org
 type userUpdate struct {
-	Email   string
-	Changes []*userRoleChange
+	Email       string
+	Changes     []*userRoleChange
+	TeamChanges []*teamMembershipChange
+	AdminChange *grafanaAdminChange // grants or revokes grafana admin (nil: no change)
+	Offboarding *offboardingChange  // disables, deletes or enables the account (nil: no change)
 }
 type userRoleChange struct {
 	Organization *grafanaOrganization
@@ -30,43 +46,52 @@ var (
 
 	applyRateLimit *rate.Limiter
 
-	lastGoogleGroupFetch        time.Time
-	googleGroupRefreshRateLimit *rate.Limiter
+	lastGroupFetch        time.Time
+	groupRefreshRateLimit *rate.Limiter
 
 	noUpdatesMessageRateLimit *rate.Limiter
 
-	grafana   *grafanaState
-	groupTree *groups.GroupTree
+	grafana *grafanaState // state of the current target (see useTarget)
+
+	stateMutex sync.Mutex // guards grafana and the group providers, so they can be read from http handlers
+
+	readOnly bool // set by the commands that only compute plans (plan, explain), nothing is written then
 )
 
 func setupSync() {
 	setupRateLimits()
 
+	var targetNames []string
+	for _, g := range config.Grafanas {
+		targetNames = append(targetNames, g.Name+" ("+g.URL+")")
+	}
 	log.Infow("Starting Grafana-Permission-Sync",
 		"applyInterval", config.Settings.ApplyInterval.String(),
 		"groupRefreshInterval", config.Settings.GroupsFetchInterval.String(),
-		"grafana_url", config.Grafana.URL,
+		"grafanas", targetNames,
 		"rules", len(config.Rules))
 
-	// 1. grafana state
-	grafanaClient := sdk.NewClient(config.Grafana.URL, config.Grafana.User+":"+config.Grafana.Password, sdk.DefaultHTTPClient)
-	grafana = &grafanaState{grafanaClient, nil, make(map[uint]*grafanaOrganization), rate.NewLimiter(rate.Every(time.Second/10), 2)}
-
-	// 2. google groups service
-	var err error
-	groupTree, err = groups.CreateGroupTree(log, config.Google.Domain, config.Google.AdminEmail, config.Google.CredentialsPath, config.Google.GroupBlacklist, []string{
-		"https://www.googleapis.com/auth/admin.directory.group.member.readonly",
-		"https://www.googleapis.com/auth/admin.directory.group.readonly",
-		//"https://www.googleapis.com/auth/admin.directory.user.readonly",
-	}...)
+	// 1. grafana state (of every instance)
+	setupTargets()
+
+	// 2. audit log
+	if err := setupAuditJournal(); err != nil {
+		log.Fatalw("unable to open audit log", "path", config.Settings.AuditLogPath, "error", err)
+	}
+	if err := setupElevations(); err != nil {
+		log.Fatalw("unable to load elevations", "path", config.Settings.ElevationsPath, "error", err)
+	}
+
+	// 3. group providers (google groups service, ldap, ...)
+	err := setupGroupProviders()
 	if err != nil {
-		log.Fatalw("unable to create google directory service", "error", err.Error())
+		log.Fatalw("unable to set up group providers", "error", err.Error())
 	}
 }
 
 func setupRateLimits() {
 	applyRateLimit = rate.NewLimiter(rate.Every(config.Settings.ApplyInterval), 1)
-	googleGroupRefreshRateLimit = rate.NewLimiter(rate.Every(config.Settings.GroupsFetchInterval), 1)
+	groupRefreshRateLimit = rate.NewLimiter(rate.Every(config.Settings.GroupsFetchInterval), 1)
 	noUpdatesMessageRateLimit = rate.NewLimiter(rate.Every(noUpdatesMessageInterval), 1)
 }
 
@@ -83,6 +108,9 @@ func startSync() {
 			if newConfig != nil {
 				break // config has changed
 			}
+			if operatorDecisionsMade() {
+				break // apply approved changes right away
+			}
 			time.Sleep(time.Millisecond * 500)
 		}
 
@@ -90,116 +118,250 @@ func startSync() {
 		// Load new config (if there is one)
 		next := newConfig // todo: most likely nothing will go wrong here, but it would be cleaner to do a real "interlocked compare exchange"
 		if next != nil {
+			targetMutex.Lock()
+			stateMutex.Lock()
 			config = next
 			newConfig = nil
+			setupTargets()
+			err := setupGroupProviders()
+			stateMutex.Unlock()
+			targetMutex.Unlock()
+			if err != nil {
+				log.Errorw("new config references a group provider that could not be set up", "error", err)
+			}
 			setupRateLimits()
 			log.Info("A new config has been loaded and applied!")
 		}
 
 		// 3.
-		// Create and execute update plan
-		if dryRunNoPlanNoExec {
-			log.Warn("mode: dryRunNoPlanNoExec")
-			continue // skip rest
+		// Create and execute an update plan for every grafana instance, one after the other
+		stateMutex.Lock()
+		currentTargets := targets
+		stateMutex.Unlock()
+		for _, t := range currentTargets {
+			syncTarget(t)
 		}
+	}
+}
 
-		updatePlan := createUpdatePlan()
-		createdPlans++
+// syncTarget creates and executes an update plan for a single grafana instance.
+// An instance that can't be reached is skipped (and tried again in the next run), the others are not affected by it.
+// targetMutex is only held while the plan is created, executing it does not depend on the package globals of the current target.
+func syncTarget(t *grafanaTarget) {
+	updatePlan, ok := planTarget(t)
+	if !ok {
+		return
+	}
 
-		if len(updatePlan) > 0 {
-			printPlan(updatePlan)
+	if config.Settings.RequireApproval {
+		handlePlanApproval(t, updatePlan) // changes are only applied after an operator approved them
+		return
+	}
 
-			if !dryRunNoExec {
-				executePlan(updatePlan)
-			} else {
-				log.Warn("mode: dryRunNoExec")
-			}
-		} else {
-			printNoNewUpdates()
+	if !updatePlan.isEmpty() {
+		printPlan(t, updatePlan)
+
+		if !passSafetyBrake(t, updatePlan) {
+			return // blocked, wait for an operator
 		}
+
+		failed := executePlan(t, updatePlan)
+		if failed == 0 {
+			recordSuccessfulSync(t)
+		}
+	} else {
+		passSafetyBrake(t, updatePlan) // nothing to block, clears any previously blocked plan
+		recordSuccessfulSync(t)
+		printNoNewUpdates()
 	}
 }
 
-func createUpdatePlan() []userUpdate {
+// planTarget makes the target the current one, and creates its update plan
+func planTarget(t *grafanaTarget) (*updatePlan, bool) {
+	targetMutex.Lock()
+	defer targetMutex.Unlock()
+
+	stateMutex.Lock()
+	useTarget(t)
+	stateMutex.Unlock()
+
+	updatePlan, err := createUpdatePlan()
+	if err != nil {
+		log.Errorw("unable to create an update plan, this grafana instance is skipped in this run", "target", t.Name, "error", err)
+		planFailuresMetric.WithLabelValues(t.Name).Inc()
+		stateMutex.Lock()
+		t.lastError = err.Error()
+		stateMutex.Unlock()
+		return nil, false
+	}
+
+	createdPlans++
+	plansCreatedMetric.WithLabelValues(t.Name).Inc()
+	for _, changeType := range updatePlan.changeTypes() {
+		changesPlannedMetric.WithLabelValues(t.Name, changeType).Inc()
+	}
+	stateMutex.Lock()
+	t.lastPlan = toPlanFile(updatePlan)
+	t.lastError = ""
+	stateMutex.Unlock()
+	return updatePlan, true
+}
+
+func (p *updatePlan) isEmpty() bool {
+	return len(p.NewUsers) == 0 && len(p.NewOrgs) == 0 && len(p.NewTeams) == 0 && len(p.Users) == 0 && len(p.FolderChanges) == 0
+}
+
+// createUpdatePlan computes the plan for the current target, it fails if the state of grafana can't be fetched
+func createUpdatePlan() (*updatePlan, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
 
 	// - Grafana: fetch all users and orgs from grafana
-	grafana.fetchState()
+	if err := grafana.fetchState(); err != nil {
+		return nil, err
+	}
+
+	// - Rules: from the rules get set of all groups and set of all explicit users; fetch them from the group providers
+	fetchGroups()
+	activeRules = expandRules()
+	currentTarget.activeRules = activeRules
+
+	// - Folders: fetch the folders and dashboards the active rules grant permissions for
+	grafana.fetchFolders(activeRules)
+
+	// - Orgs: find orgs that are named by rules but don't exist yet
+	newOrgs := planOrganizations()
 
-	// - Rules: from the rules get set of all groups and set of all explicit users; fetch them from google
-	fetchGoogleGroups()
+	// - Users: find users that get a role, but don't have an account yet
+	newUsers := planNewUsers()
 
 	updates := make(map[string]*userUpdate) // user email -> update
 
 	// 1. setup initial state: nobody is in any organization!
 	for _, grafUser := range grafana.allUsers {
-		var initialChangeSet []*userRoleChange
-		for _, org := range grafana.organizations {
-			orgUser := org.findUser(grafUser.Email)
-			var currentRole Role
-			if orgUser != nil {
-				currentRole = Role(orgUser.Role)
-			}
-			initialChangeSet = append(initialChangeSet, &userRoleChange{org, currentRole, "", nil})
-		}
-
-		updates[grafUser.Email] = &userUpdate{grafUser.Email, initialChangeSet}
+		updates[grafUser.Email] = newUserUpdate(grafUser.Email)
 	}
 
-	// 2. apply all rules, keep highest permission
-	for _, rule := range config.Rules {
-		applyRule(updates, rule)
-	}
+	// 2. apply all rules, keep highest permission, then apply the restrictions
+	applyRules(updates)
 
 	// 3. filter changes:
 	// - remove entries that don't do anything (same new and old role)
 	// - remove demotions if we're not allowed to
 	// - do not remove anyone from orgID 1
+	// - never demote or remove protected users (but show that in the plan)
+	result := &updatePlan{RunID: newRunID(), NewUsers: newUsers, NewOrgs: newOrgs}
 	for _, userUpdate := range updates {
 		var realChanges []*userRoleChange
 		for _, change := range userUpdate.Changes {
-
-			keepChange := true
-
-			if change.OldRole == change.NewRole {
-				keepChange = false // not a change
-			}
-
-			if !config.Settings.CanDemote && change.NewRole.isLowerThan(change.OldRole) {
-				keepChange = false // prevent demotion / removal
-			}
-
-			if change.Organization.ID == 1 && change.NewRole == "" && !config.Settings.RemoveFromMainOrg {
-				keepChange = false // don't remove from main org
-			}
-
-			if keepChange {
+			if keepChange(change) || revokeElevation(userUpdate.Email, change) {
+				if why := protectedFrom(userUpdate.Email, change); why != "" {
+					result.Skipped = append(result.Skipped, skippedChange{userUpdate.Email, change, why})
+					continue
+				}
 				realChanges = append(realChanges, change)
 			}
 		}
 		userUpdate.Changes = realChanges
 	}
 
+	// 4. teams: add/remove members so every managed team mirrors its rules
+	result.NewTeams = planTeams(updates)
+
+	// 5. folders: grant (and revoke) folder and dashboard permissions
+	result.FolderChanges = planFolderPermissions(updates)
+
+	// 6. grafana admin: grant (and revoke) the server admin flag
+	planGrafanaAdmins(updates)
+
+	// 7. offboarding: disable (or delete) users who left, enable the ones that came back
+	planOffboarding(updates)
+
 	// convert update map to slice, filter entries that don't do anything
-	var result []userUpdate
 	for _, update := range updates {
-		if len(update.Changes) > 0 {
-			result = append(result, *update)
+		if update.hasChanges() {
+			result.Users = append(result.Users, *update)
 		}
 	}
-	return result
+	return result, nil
 }
 
-func printPlan(plan []userUpdate) {
+func (uu *userUpdate) hasChanges() bool {
+	return len(uu.Changes) > 0 || len(uu.TeamChanges) > 0 || uu.AdminChange != nil || uu.Offboarding != nil
+}
 
-	totalChanges := 0
-	for _, uu := range plan {
-		totalChanges += len(uu.Changes)
+// newUserUpdate creates the initial state for a user: their current role in every org, and no role as the new role
+func newUserUpdate(email string) *userUpdate {
+	var initialChangeSet []*userRoleChange
+	for _, org := range grafana.organizations {
+		orgUser := org.findUser(email)
+		var currentRole Role
+		if orgUser != nil {
+			currentRole = Role(orgUser.Role)
+		}
+		initialChangeSet = append(initialChangeSet, &userRoleChange{org, currentRole, "", nil})
+	}
+	for _, org := range grafana.newOrganizations {
+		initialChangeSet = append(initialChangeSet, &userRoleChange{org, "", "", nil})
+	}
+
+	return &userUpdate{email, initialChangeSet, nil, nil, nil}
+}
+
+// keepChange decides if a computed change should actually be made
+func keepChange(change *userRoleChange) bool {
+	if change.OldRole == change.NewRole {
+		return false // not a change
+	}
+
+	if change.NewRole.isLowerThan(change.OldRole) && !config.Settings.canDemoteIn(change.Organization.Name) {
+		return false // prevent demotion / removal
+	}
+
+	if change.Organization.ID == 1 && change.NewRole == "" && !config.Settings.RemoveFromMainOrg {
+		return false // don't remove from main org
+	}
+
+	if change.NewRole.isLowerThan(change.OldRole) && change.NewRole.isLowerThan(change.Organization.unresolvedRole) {
+		return false // a rule for this org depends on a group that could not be resolved, the user might still be entitled to their role
+	}
+
+	if change.NewRole.isHigherThan(change.OldRole) && change.Organization.unresolvedRestriction {
+		return false // a restriction for this org depends on a group that could not be resolved, the user might not be allowed to get the role
+	}
+
+	return true
+}
+
+func printPlan(t *grafanaTarget, plan *updatePlan) {
+
+	totalChanges := len(plan.NewUsers) + len(plan.NewOrgs) + len(plan.NewTeams) + len(plan.FolderChanges)
+	for _, uu := range plan.Users {
+		totalChanges += len(uu.Changes) + len(uu.TeamChanges)
+		if uu.AdminChange != nil {
+			totalChanges++
+		}
+		if uu.Offboarding != nil {
+			totalChanges++
+		}
 	}
 
 	log.Info("")
-	log.Infow("New update-plan computed!", "affectedUsers", len(plan), "totalChanges", totalChanges)
+	log.Infow("New update-plan computed!", "target", t.Name, "affectedUsers", len(plan.Users), "totalChanges", totalChanges)
+
+	for _, u := range plan.NewUsers {
+		log.With(u.Reason.reasonFields()...).Infow("Create user", "user", u.Email)
+	}
 
-	for _, uu := range plan {
+	for _, org := range plan.NewOrgs {
+		log.Infow("Create org", "org", org.Name)
+	}
+
+	for _, team := range plan.NewTeams {
+		log.Infow("Create team", "team", team.Name, "org", t.state.organizations[team.OrgID].Name)
+	}
+
+	for _, uu := range plan.Users {
 		for _, change := range uu.Changes {
 			if change.OldRole == "" {
 				// Add to org
@@ -216,44 +378,116 @@ func printPlan(plan []userUpdate) {
 					verb = "Demote"
 				}
 
-				log.Infow(verb+" user", "user", uu.Email, "org", change.Organization.Name, "oldRole", change.OldRole, "role", change.NewRole, "reasonIndex", change.Reason.Index, "reasonNote", change.Reason.Note)
+				log.With(change.Reason.reasonFields()...).Infow(verb+" user", "user", uu.Email, "org", change.Organization.Name, "oldRole", change.OldRole, "role", change.NewRole)
 			}
 		}
+		for _, change := range uu.TeamChanges {
+			if change.Add {
+				log.With(change.Reason.reasonFields()...).Infow("Add user to team", "user", uu.Email, "org", change.Organization.Name, "team", change.Team.Name)
+			} else {
+				log.Infow("Remove user from team", "user", uu.Email, "org", change.Organization.Name, "team", change.Team.Name)
+			}
+		}
+		if change := uu.AdminChange; change != nil {
+			if change.Grant {
+				log.With(change.Reason.reasonFields()...).Infow("Grant grafana admin", "user", uu.Email)
+			} else {
+				log.Infow("Revoke grafana admin", "user", uu.Email)
+			}
+		}
+		if change := uu.Offboarding; change != nil {
+			switch change.Action {
+			case offboardingDelete:
+				log.Infow("Delete user", "user", uu.Email, "why", change.Why)
+			case offboardingEnable:
+				log.Infow("Enable user", "user", uu.Email, "why", change.Why)
+			default:
+				log.Infow("Disable user", "user", uu.Email, "why", change.Why)
+			}
+		}
+	}
+
+	for _, change := range plan.FolderChanges {
+		log.With(change.Reason.reasonFields()...).Infow("Change "+change.Folder.kind()+" permission", "grantee", change.grantee(), "org", change.Organization.Name, change.Folder.kind(), change.Folder.Title, "oldPermission", change.OldPermission, "permission", change.NewPermission)
+	}
+
+	for _, s := range plan.Skipped {
+		log.Infow("Skipped change, user is protected", "user", s.Email, "org", s.Change.Organization.Name, "oldRole", s.Change.OldRole, "role", s.Change.NewRole, "protection", s.Why)
 	}
 
 	log.Info("")
 }
 
-func executePlan(plan []userUpdate) {
+// executePlan applies all changes to the grafana instance of the target, returns the number of changes that failed.
+// It does not use the package globals of the current target (see useTarget), http handlers may switch them in the meantime.
+func executePlan(t *grafanaTarget, plan *updatePlan) (failed int) {
+	g := t.state
 
 	log.Infow("Applying updates to Grafana...")
+	g.takeStatusCode() // forget the responses of fetchState, they don't belong to any change
 
-	for _, uu := range plan {
+	for _, u := range plan.NewUsers {
+		status, err := g.createUser(u)
+		if err != nil {
+			log.Errorw("error creating user", "user", u.Email, "error", err)
+			failed++
+		}
+		auditUserCreation(t, plan.RunID, u, status, err)
+	}
+
+	for _, org := range plan.NewOrgs {
+		err := g.createOrg(org)
+		if err != nil {
+			log.Errorw("error creating org", "org", org.Name, "error", err)
+			failed++
+		}
+		auditOrgCreation(t, plan.RunID, org, err)
+	}
+
+	for _, team := range plan.NewTeams {
+		err := g.createTeam(team)
+		if err != nil {
+			log.Errorw("error creating team", "team", team.Name, "orgId", team.OrgID, "error", err)
+			failed++
+		}
+		auditTeamCreation(t, plan.RunID, team, err)
+	}
+
+	for _, uu := range plan.Users {
 		for _, change := range uu.Changes {
 			var status sdk.StatusMessage
 			var err error = nil
 			var user *sdk.OrgUser = nil
 
+			if change.Organization.ID == 0 {
+				log.Warnw("cannot add user to org, org was not created", "user", uu.Email, "org", change.Organization.Name)
+				auditRoleChange(t, plan.RunID, uu.Email, change, sdk.StatusMessage{}, fmt.Errorf("org was not created"))
+				failed++
+				continue
+			}
+
 			if change.OldRole != "" {
 				user = change.Organization.findUser(uu.Email)
 				if user == nil {
 					log.Warnw("cannot find orgUser", "action", "remove from org", "user", uu.Email)
+					auditRoleChange(t, plan.RunID, uu.Email, change, sdk.StatusMessage{}, fmt.Errorf("cannot find orgUser"))
+					failed++
 					continue
 				}
 			}
 
 			if change.OldRole == "" {
 				// Add to org
-				grafana.Wait()
-				status, err = grafana.AddOrgUser(sdk.UserRole{LoginOrEmail: uu.Email, Role: string(change.NewRole)}, change.Organization.ID)
+				g.Wait()
+				status, err = g.AddOrgUser(sdk.UserRole{LoginOrEmail: uu.Email, Role: string(change.NewRole)}, change.Organization.ID)
 			} else if change.NewRole == "" {
 				// Remove from org
-				grafana.Wait()
-				status, err = grafana.DeleteOrgUser(change.Organization.ID, user.ID)
+				g.Wait()
+				status, err = g.DeleteOrgUser(change.Organization.ID, user.ID)
 			} else {
 				// Change role in org
-				grafana.Wait()
-				status, err = grafana.UpdateOrgUser(sdk.UserRole{LoginOrEmail: uu.Email, Role: string(change.NewRole)}, change.Organization.ID, user.ID)
+				g.Wait()
+				status, err = g.UpdateOrgUser(sdk.UserRole{LoginOrEmail: uu.Email, Role: string(change.NewRole)}, change.Organization.ID, user.ID)
 			}
 
 			if err != nil {
@@ -269,32 +503,127 @@ func executePlan(plan []userUpdate) {
 					"status", status.Status,
 					"UID", status.UID,
 					"URL", status.URL)
+				failed++
 			}
+			auditRoleChange(t, plan.RunID, uu.Email, change, status, err)
 		}
-	}
-}
 
-func applyRule(userUpdates map[string]*userUpdate, rule *Rule) {
+		// team changes come last, a user must be a member of the org before they can join one of its teams
+		for _, change := range uu.TeamChanges {
+			if change.Team.ID == 0 {
+				log.Warnw("cannot change team membership, team was not created", "user", uu.Email, "org", change.Organization.Name, "team", change.Team.Name)
+				auditTeamChange(t, plan.RunID, uu.Email, change, fmt.Errorf("team was not created"))
+				failed++
+				continue
+			}
 
-	// 1. find set of all affected users
-	// users = rule.Groups.Select(g=>g.Email).Concat(rule.Users).Distinct();
-	var users []string // user emails
+			var err error
+			if change.Add {
+				err = g.addTeamMember(change.Team, change.UserID)
+			} else {
+				err = g.removeTeamMember(change.Team, change.UserID)
+			}
 
-	for _, groupEmail := range rule.Groups {
-		group, err := groupTree.GetGroup(groupEmail)
+			if err != nil {
+				log.Errorw("error applying team update",
+					"userEmail", uu.Email,
+					"org", change.Organization.Name,
+					"team", change.Team.Name,
+					"add", change.Add,
+					"error", err)
+				failed++
+			}
+			auditTeamChange(t, plan.RunID, uu.Email, change, err)
+		}
+
+		if change := uu.AdminChange; change != nil {
+			g.Wait()
+			status, err := g.UpdateUserPermissions(sdk.UserPermissions{IsGrafanaAdmin: change.Grant}, change.UserID)
+			if err != nil {
+				log.Errorw("error applying grafana admin update",
+					"userEmail", uu.Email,
+					"grant", change.Grant,
+					"error", err)
+				failed++
+			}
+			auditAdminChange(t, plan.RunID, uu.Email, change, status, err)
+		}
+
+		// offboarding comes last, the account is gone (or can't be changed) afterwards
+		if change := uu.Offboarding; change != nil {
+			var err error
+			switch change.Action {
+			case offboardingDelete:
+				err = g.deleteUser(change.UserID)
+			case offboardingEnable:
+				err = g.enableUser(change.UserID)
+			default:
+				err = g.disableUser(change.UserID)
+			}
+			if err != nil {
+				log.Errorw("error applying offboarding",
+					"userEmail", uu.Email,
+					"action", change.action(),
+					"error", err)
+				failed++
+			}
+			auditOffboarding(t, plan.RunID, uu.Email, change, err)
+		}
+	}
+
+	// folder permissions come last, users must be members of the org (and teams must exist) before they can get a permission.
+	// The whole access control list of a folder is replaced at once, so all changes of a folder are made together
+	folders, changesByFolder := groupByFolder(plan.FolderChanges)
+	for _, f := range folders {
+		changes := changesByFolder[f]
+		err := g.setFolderPermissions(changes[0].Organization.ID, f, changes)
 		if err != nil {
-			log.Errorw("unable to get group", "email", groupEmail, "error", err)
+			log.Errorw("error applying "+f.kind()+" permissions",
+				"org", changes[0].Organization.Name,
+				f.kind(), f.Title,
+				"uid", f.UID,
+				"changes", len(changes),
+				"error", err)
+			failed += len(changes)
 		}
-		for _, user := range group.AllUsers() {
-			users = append(users, user.Email)
+		for _, change := range changes {
+			auditFolderChange(t, plan.RunID, change, err)
 		}
 	}
 
-	for _, userEmail := range rule.Users {
-		users = append(users, userEmail)
+	return failed
+}
+
+// applyRules computes the new role of every user: the highest role granted by any rule, limited by all restrictions
+func applyRules(userUpdates map[string]*userUpdate) {
+	for _, rule := range activeRules {
+		if !rule.isRestriction() {
+			applyRule(userUpdates, rule)
+		}
 	}
+	for _, rule := range activeRules {
+		if rule.isRestriction() {
+			applyRestriction(userUpdates, rule)
+		}
+	}
+}
+
+func applyRule(userUpdates map[string]*userUpdate, rule *Rule) {
 
-	users = distinct(users)
+	// 1. find set of all affected users
+	// users = rule.Groups.Select(g=>g.Email).Concat(rule.Users).Distinct();
+	users, unresolved := rule.resolveUsers()
+
+	if len(unresolved) > 0 {
+		// we don't know who should get the role of this rule,
+		// so nobody may be demoted below it in the orgs the rule applies to
+		for _, org := range grafana.organizations {
+			if rule.matchesOrg(org.Name) && rule.Role.isHigherThan(org.unresolvedRole) {
+				org.unresolvedRole = rule.Role
+			}
+		}
+		log.Warnw("rule depends on groups that could not be resolved, no user will be demoted or removed because of it in this run", "ruleIndex", rule.Index, "ruleNote", rule.Note, "unresolvedGroups", unresolved)
+	}
 
 	// 2. update the role in the corrosponding org for each user
 	for _, u := range users {
@@ -315,40 +644,73 @@ func applyRule(userUpdates map[string]*userUpdate, rule *Rule) {
 	}
 }
 
-func fetchGoogleGroups() {
+// applyRestriction lowers the new role of the users of a restriction (in the orgs it applies to) to its limit
+func applyRestriction(userUpdates map[string]*userUpdate, rule *Rule) {
+	users, unresolved := rule.resolveUsers()
 
-	r := googleGroupRefreshRateLimit.Reserve()
+	if len(unresolved) > 0 {
+		// we don't know who is restricted, so nobody may be added or promoted in the orgs the restriction applies to
+		for _, org := range grafana.organizations {
+			if rule.matchesOrg(org.Name) {
+				org.unresolvedRestriction = true
+			}
+		}
+		log.Warnw("restriction depends on groups that could not be resolved, no user will be added or promoted in its orgs in this run", "ruleIndex", rule.Index, "ruleNote", rule.Note, "unresolvedGroups", unresolved)
+	}
+
+	limit := rule.roleLimit()
+	for _, u := range users {
+		update, exists := userUpdates[u]
+		if !exists {
+			continue
+		}
+
+		for _, change := range update.Changes {
+			if rule.matchesOrg(change.Organization.Name) && change.NewRole.isHigherThan(limit) {
+				change.NewRole = limit
+				change.Reason = rule
+			}
+		}
+	}
+}
+
+func fetchGroups() {
+
+	r := groupRefreshRateLimit.Reserve()
 	if r.OK() == false {
 		// should not be possible because we're the only function and go-routine that ever uses this!
-		log.Error("google groups refresh: rateLimit.Reserve().OK() returned false")
+		log.Error("groups refresh: rateLimit.Reserve().OK() returned false")
 		return
 	}
 
 	readyIn := r.Delay()
 	if readyIn > 0 {
 		r.Cancel() // dont actually consume a token
-		log.Debugw("refresh google groups: not ready yet", "nextRefreshAllowedIn", readyIn.String())
+		log.Debugw("refresh groups: not ready yet", "nextRefreshAllowedIn", readyIn.String())
 		return
 	}
 
 	now := time.Now()
-	timeSinceLast := now.Sub(lastGoogleGroupFetch)
-	lastGoogleGroupFetch = now
+	timeSinceLast := now.Sub(lastGroupFetch)
+	lastGroupFetch = now
 
-	groupTree.Clear()
+	clearGroupProviders()
 
 	// prefetch all groups and users
 	distinctGroups := config.getAllGroups()
 
-	log.Infow("Refreshing google groups...", "timeSinceLastGroupFetch", timeSinceLast.String(), "groupCount", len(distinctGroups))
+	log.Infow("Refreshing groups...", "timeSinceLastGroupFetch", timeSinceLast.String(), "groupCount", len(distinctGroups))
 
 	for _, reqGroup := range distinctGroups {
-		log.Debugw("fetching google group", "email", reqGroup)
-		_, err := groupTree.GetGroup(reqGroup)
+		log.Debugw("fetching group", "group", reqGroup)
+		_, err := getGroup(reqGroup)
 		if err != nil {
 			log.Errorw("error fetching group", "error", err)
 		}
 	}
+
+	groupFetchDurationMetric.Observe(time.Since(now).Seconds())
+	updateCacheMetrics()
 }
 
 func printNoNewUpdates() {
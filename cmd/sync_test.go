@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestApplyRestrictions(t *testing.T) {
+	users := []string{"a@corp.com", "b@corp.com", "c@corp.com"}
+	grant := &Rule{Users: FlattenedArray{"a@corp.com", "b@corp.com"}, Organizations: FlattenedArray{"Prod", "Dev"}, Role: "Editor"}
+	restrict := func(maxRole Role, exclude bool, orgs ...string) *Rule {
+		return &Rule{Users: FlattenedArray{"a@corp.com", "c@corp.com"}, Organizations: FlattenedArray(orgs), MaxRole: maxRole, Exclude: exclude}
+	}
+
+	tests := []struct {
+		name           string
+		rules          []*Rule
+		want           []string // email org:role, for every role a user gets
+		unresolvedOrgs []string // orgs where nobody may be added or promoted
+	}{
+		{"no restrictions", []*Rule{grant}, []string{"a@corp.com Dev:Editor", "a@corp.com Prod:Editor", "b@corp.com Dev:Editor", "b@corp.com Prod:Editor"}, nil},
+		{"exclude", []*Rule{grant, restrict("", true, "Prod")}, []string{"a@corp.com Dev:Editor", "b@corp.com Dev:Editor", "b@corp.com Prod:Editor"}, nil},
+		{"maxRole", []*Rule{grant, restrict("Viewer", false, "/.*/")}, []string{"a@corp.com Dev:Viewer", "a@corp.com Prod:Viewer", "b@corp.com Dev:Editor", "b@corp.com Prod:Editor"}, nil},
+		{"maxRole above the granted role", []*Rule{grant, restrict("Admin", false, "Prod")}, []string{"a@corp.com Dev:Editor", "a@corp.com Prod:Editor", "b@corp.com Dev:Editor", "b@corp.com Prod:Editor"}, nil},
+		{"lowest limit wins", []*Rule{grant, restrict("Viewer", false, "Prod"), restrict("", true, "Prod")}, []string{"a@corp.com Dev:Editor", "b@corp.com Dev:Editor", "b@corp.com Prod:Editor"}, nil},
+		{"restrictions before grants", []*Rule{restrict("Viewer", false, "Dev"), grant}, []string{"a@corp.com Dev:Viewer", "a@corp.com Prod:Editor", "b@corp.com Dev:Editor", "b@corp.com Prod:Editor"}, nil},
+		{"unresolved restriction", []*Rule{grant, {Groups: FlattenedArray{"file:missing"}, Organizations: FlattenedArray{"Prod"}, Exclude: true}}, []string{"a@corp.com Dev:Editor", "a@corp.com Prod:Editor", "b@corp.com Dev:Editor", "b@corp.com Prod:Editor"}, []string{"Prod"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Rules: test.rules}
+			setupTestGrafana(c, users...)
+			activeRules = c.Rules
+			addTestOrg(2, "Prod", nil)
+			addTestOrg(3, "Dev", nil)
+
+			updates := make(map[string]*userUpdate)
+			for _, email := range users {
+				updates[email] = newUserUpdate(email)
+			}
+			applyRules(updates)
+
+			var got []string
+			for email, update := range updates {
+				for _, change := range update.Changes {
+					if change.NewRole != "" {
+						got = append(got, fmt.Sprintf("%v %v:%v", email, change.Organization.Name, change.NewRole))
+					}
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("applyRules() = %v, want %v", got, test.want)
+			}
+
+			var unresolved []string
+			for _, org := range grafana.organizations {
+				if org.unresolvedRestriction {
+					unresolved = append(unresolved, org.Name)
+				}
+			}
+			if strings.Join(unresolved, ",") != strings.Join(test.unresolvedOrgs, ",") {
+				t.Errorf("orgs with unresolved restrictions = %v, want %v", unresolved, test.unresolvedOrgs)
+			}
+		})
+	}
+}
+
+func TestKeepChangeWithUnresolvedRestriction(t *testing.T) {
+	setupTestGrafana(&Config{Settings: Settings{CanDemote: true}}, "a@corp.com")
+	prod := addTestOrg(2, "Prod", nil)
+	prod.unresolvedRestriction = true
+
+	tests := []struct {
+		oldRole Role
+		newRole Role
+		want    bool
+	}{
+		{"", "Viewer", false},
+		{"Viewer", "Editor", false},
+		{"Editor", "Editor", false},
+		{"Editor", "Viewer", true}, // the user might not be allowed to have any role, but demoting is fine
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v>%v", test.oldRole, test.newRole), func(t *testing.T) {
+			if got := keepChange(&userRoleChange{prod, test.oldRole, test.newRole, nil}); got != test.want {
+				t.Errorf("keepChange() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeepChange(t *testing.T) {
+	policies := []OrgPolicy{{Organizations: FlattenedArray{"Shared"}, Mode: orgModeAdditive}, {Organizations: FlattenedArray{"Prod"}, Mode: orgModeManaged}}
+
+	tests := []struct {
+		name           string
+		canDemote      bool
+		org            string
+		oldRole        Role
+		newRole        Role
+		unresolvedRole Role
+		want           bool
+	}{
+		{"promotion", false, "Shared", "Viewer", "Editor", "", true},
+		{"no change", true, "Prod", "Editor", "Editor", "", false},
+		{"demotion in managed org", false, "Prod", "Editor", "Viewer", "", true},
+		{"removal from managed org", false, "Prod", "Editor", "", "", true},
+		{"demotion in additive org", true, "Shared", "Editor", "Viewer", "", false},
+		{"removal from additive org", true, "Shared", "Viewer", "", "", false},
+		{"demotion without policy, canDemote", true, "Dev", "Editor", "Viewer", "", true},
+		{"demotion without policy", false, "Dev", "Editor", "Viewer", "", false},
+		{"removal from main org", true, "Main Org.", "Viewer", "", "", false},
+		{"demotion below an unresolved rule", false, "Prod", "Admin", "Viewer", "Editor", false},
+		{"demotion to an unresolved rule", false, "Prod", "Admin", "Editor", "Editor", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestGrafana(&Config{Settings: Settings{CanDemote: test.canDemote, OrgPolicies: policies}})
+			orgID := uint(2)
+			if test.org == "Main Org." {
+				orgID = 1
+			}
+			org := addTestOrg(orgID, test.org, nil)
+			org.unresolvedRole = test.unresolvedRole
+
+			if got := keepChange(&userRoleChange{org, test.oldRole, test.newRole, nil}); got != test.want {
+				t.Errorf("keepChange() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
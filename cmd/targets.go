@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rikimaru0345/sdk"
+	"golang.org/x/time/rate"
+)
+
+// grafanaRequestTimeout limits how long a single request against grafana may take, so one unreachable instance can't stall the sync of all others
+const grafanaRequestTimeout = 60 * time.Second
+
+// grafanaTarget is one of the grafana instances that are kept in sync.
+// The groups are fetched once and shared by all targets, everything else (state, plans, approvals, the safety brake) is per target.
+type grafanaTarget struct {
+	Name   string
+	Config GrafanaConfig
+	state  *grafanaState
+
+	// guarded by stateMutex
+	lastPlan    *planFile // the most recent plan created by the sync loop
+	lastError   string    // why the last plan could not be created, empty if it was created
+	lastSync    time.Time // the last run in which all planned changes were applied (or nothing had to be changed)
+	activeRules []*Rule   // the rules the last plan was based on
+
+	// approval workflow (guarded by approvalMutex)
+	pendingPlan     *pendingUpdatePlan
+	approvedChanges map[string]bool // keys of changes that will be applied in the next run (if they are still valid then)
+	rejectedChanges map[string]bool // keys of changes that won't be proposed again (as long as they stay the same)
+
+	// safety brake (guarded by brakeMutex)
+	blockedPlan   *blockedUpdatePlan // the last plan that was stopped by the safety brake
+	brakeOverride string             // id of the blocked plan an operator has let pass the safety brake
+}
+
+var (
+	targets       []*grafanaTarget // guarded by stateMutex
+	currentTarget *grafanaTarget   // the target 'grafana' belongs to (guarded by stateMutex)
+
+	// held while the sync loop creates the plan of a target, and by http handlers while they look at a target (see withTarget),
+	// both use the package globals of the current target then. Lock order: targetMutex before all other mutexes
+	targetMutex sync.Mutex
+)
+
+func newGrafanaTarget(c GrafanaConfig) *grafanaTarget {
+	responses := &statusRecorder{next: instrumentTransport("grafana", nil)}
+	httpClient := &http.Client{Transport: responses, Timeout: grafanaRequestTimeout}
+	grafanaClient := sdk.NewClient(c.URL, c.User+":"+c.Password, httpClient)
+	state := &grafanaState{grafanaClient, nil, nil, make(map[uint]*grafanaOrganization), nil, make(map[string]bool), rate.NewLimiter(rate.Every(time.Second/10), 2), httpClient, c.URL, c.User, c.Password, responses}
+
+	return &grafanaTarget{
+		Name:            c.Name,
+		Config:          c,
+		state:           state,
+		approvedChanges: make(map[string]bool),
+		rejectedChanges: make(map[string]bool),
+	}
+}
+
+// setupTargets creates a target for every grafana instance in the config.
+// Targets that already exist (same name and url) are kept, so pending approvals and the safety brake survive a config reload.
+func setupTargets() {
+	var result []*grafanaTarget
+	for _, c := range config.Grafanas {
+		t := findTarget(c.Name)
+		if t == nil || t.Config != c {
+			t = newGrafanaTarget(c)
+		}
+		result = append(result, t)
+	}
+	targets = result
+	useTarget(targets[0])
+}
+
+// useTarget makes the package globals 'grafana' and 'activeRules' (and everything that depends on them) refer to the given target
+func useTarget(t *grafanaTarget) {
+	currentTarget = t
+	grafana = t.state
+	activeRules = t.activeRules
+}
+
+// findTarget returns the target with the given name, or the first target if the name is empty
+func findTarget(name string) *grafanaTarget {
+	if name == "" && len(targets) > 0 {
+		return targets[0]
+	}
+	for _, t := range targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// withTarget runs fn while 'grafana' refers to the given target.
+// The sync loop holds targetMutex while it creates a plan, so fn might have to wait until the plan is done (but not until it is executed).
+func withTarget(t *grafanaTarget, fn func()) {
+	targetMutex.Lock()
+	defer targetMutex.Unlock()
+
+	stateMutex.Lock()
+	useTarget(t)
+	stateMutex.Unlock()
+
+	fn()
+}
+
+// targetFromRequest returns the target selected by the 'target' query parameter (the first target if there is none).
+// Responds with 404 if there is no such target.
+func targetFromRequest(c *gin.Context) (*grafanaTarget, bool) {
+	stateMutex.Lock()
+	t := findTarget(c.Query("target"))
+	stateMutex.Unlock()
+
+	if t == nil {
+		renderJSON(c, 404, gin.H{"error": "unknown target '" + c.Query("target") + "'"})
+		return nil, false
+	}
+	return t, true
+}
+
+// targetsForDisplay shows the status of every target
+func targetsForDisplay() []map[string]interface{} {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	result := make([]map[string]interface{}, 0, len(targets))
+	for _, t := range targets {
+		element := map[string]interface{}{
+			"name": t.Name,
+			"url":  t.Config.URL,
+		}
+		if t.lastError != "" {
+			element["lastError"] = t.lastError
+		}
+		if !t.lastSync.IsZero() {
+			element["lastSuccessfulSync"] = t.lastSync
+		}
+		result = append(result, element)
+	}
+	return result
+}
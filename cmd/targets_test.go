@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPasswordEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"default", "GRAFANA_PASS_DEFAULT"},
+		{"prod", "GRAFANA_PASS_PROD"},
+		{"eu-west.1", "GRAFANA_PASS_EU_WEST_1"},
+		{"Staging Grafana", "GRAFANA_PASS_STAGING_GRAFANA"},
+	}
+
+	for _, test := range tests {
+		g := &GrafanaConfig{Name: test.name}
+		if got := g.passwordEnv(); got != test.want {
+			t.Errorf("passwordEnv() of %q = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigGrafanas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("GRAFANA_PASS", "fallback")
+	os.Setenv("GRAFANA_PASS_PROD", "prod-secret")
+	os.Setenv("GRAFANA_PASS_EU_WEST", "eu-secret")
+	defer os.Unsetenv("GRAFANA_PASS")
+	defer os.Unsetenv("GRAFANA_PASS_PROD")
+	defer os.Unsetenv("GRAFANA_PASS_EU_WEST")
+
+	tests := []struct {
+		name   string
+		config string
+		want   []string // name url password of every target, nil if the config is invalid
+	}{
+		{"single grafana", "grafana:\n  url: http://grafana.test\n", []string{"default http://grafana.test fallback"}},
+		{"single grafana with a name", "grafana:\n  name: prod\n  url: http://grafana.test\n", []string{"prod http://grafana.test prod-secret"}},
+		{"several grafanas", "grafanas:\n  - {name: prod, url: http://prod.test}\n  - {name: eu-west, url: http://eu.test}\n  - {name: dev, url: http://dev.test}\n", []string{
+			"prod http://prod.test prod-secret",
+			"eu-west http://eu.test eu-secret",
+			"dev http://dev.test fallback",
+		}},
+		{"both grafana and grafanas", "grafana:\n  url: http://grafana.test\ngrafanas:\n  - {name: prod, url: http://prod.test}\n", nil},
+		{"missing name", "grafanas:\n  - {url: http://prod.test}\n", nil},
+		{"duplicate name", "grafanas:\n  - {name: prod, url: http://prod.test}\n  - {name: prod, url: http://other.test}\n", nil},
+		{"rule for a known target", "grafanas:\n  - {name: prod, url: http://prod.test}\nrules:\n  - {users: [a@corp.com], orgs: [Prod], role: Viewer, targets: [prod]}\n", []string{"prod http://prod.test prod-secret"}},
+		{"rule for an unknown target", "grafanas:\n  - {name: prod, url: http://prod.test}\nrules:\n  - {users: [a@corp.com], orgs: [Prod], role: Viewer, targets: [dev]}\n", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "config.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			c := tryLoadConfig(path)
+			if (c != nil) != (test.want != nil) {
+				t.Fatalf("tryLoadConfig() = %v, want a valid config: %v", c, test.want != nil)
+			}
+			if c == nil {
+				return
+			}
+			var got []string
+			for _, g := range c.Grafanas {
+				got = append(got, g.Name+" "+g.URL+" "+g.Password)
+			}
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("grafanas = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetupTargets(t *testing.T) {
+	prod := GrafanaConfig{Name: "prod", URL: "http://prod.test", User: "sync-admin"}
+	dev := GrafanaConfig{Name: "dev", URL: "http://dev.test", User: "sync-admin"}
+	setupTestGrafana(&Config{Grafanas: []GrafanaConfig{prod, dev}})
+
+	oldProd, oldDev := findTarget("prod"), findTarget("dev")
+	if oldProd == nil || oldDev == nil || currentTarget != oldProd || grafana != oldProd.state {
+		t.Fatalf("setupTargets() did not create both targets, and use the first one")
+	}
+	if findTarget("") != oldProd || findTarget("other") != nil {
+		t.Errorf("findTarget() must return the first target for an empty name, and nil for unknown names")
+	}
+
+	// a new config keeps the targets whose settings did not change (with their state), and drops the ones that were removed
+	dev.URL = "http://dev2.test"
+	config = &Config{Grafanas: []GrafanaConfig{dev, prod}}
+	setupTargets()
+
+	if len(targets) != 2 || findTarget("prod") != oldProd {
+		t.Errorf("prod target was replaced, but its config did not change")
+	}
+	if newDev := findTarget("dev"); newDev == oldDev || newDev.Config.URL != dev.URL {
+		t.Errorf("dev target was kept, but its url changed")
+	}
+	if currentTarget != findTarget("dev") {
+		t.Errorf("current target is %v, want the first target (dev)", currentTarget.Name)
+	}
+
+	config = &Config{Grafanas: []GrafanaConfig{prod}}
+	setupTargets()
+	if len(targets) != 1 || findTarget("dev") != nil {
+		t.Errorf("targets = %v, want only prod", targets)
+	}
+}
+
+func TestWithTarget(t *testing.T) {
+	prod := GrafanaConfig{Name: "prod", URL: "http://prod.test", User: "sync-admin"}
+	dev := GrafanaConfig{Name: "dev", URL: "http://dev.test", User: "sync-admin"}
+	setupTestGrafana(&Config{Grafanas: []GrafanaConfig{prod, dev}})
+	devTarget := findTarget("dev")
+	devTarget.activeRules = []*Rule{{Users: FlattenedArray{"a@corp.com"}, Role: "Viewer"}}
+
+	withTarget(devTarget, func() {
+		if currentTarget != devTarget || grafana != devTarget.state || len(activeRules) != 1 {
+			t.Errorf("withTarget() does not use the globals of the target")
+		}
+	})
+}
+
+func TestTargetFromRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prod := GrafanaConfig{Name: "prod", URL: "http://prod.test", User: "sync-admin"}
+	dev := GrafanaConfig{Name: "dev", URL: "http://dev.test", User: "sync-admin"}
+	setupTestGrafana(&Config{Grafanas: []GrafanaConfig{prod, dev}})
+
+	tests := []struct {
+		query  string
+		want   string // name of the selected target, "" if there is none
+		status int
+	}{
+		{"", "prod", 200},
+		{"?target=prod", "prod", 200},
+		{"?target=dev", "dev", 200},
+		{"?target=other", "", 404},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/admin/plan"+test.query, nil)
+
+			target, ok := targetFromRequest(c)
+			if ok != (test.want != "") {
+				t.Fatalf("targetFromRequest() ok = %v, want %v", ok, test.want != "")
+			}
+			if ok && target.Name != test.want {
+				t.Errorf("targetFromRequest() = %v, want %v", target.Name, test.want)
+			}
+			if w.Code != test.status {
+				t.Errorf("response status = %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+)
+
+// grafanaTeam is a team inside a grafana organization.
+// A team with ID 0 does not exist yet, it will be created when the plan is executed.
+type grafanaTeam struct {
+	ID      uint                `json:"id"`
+	OrgID   uint                `json:"orgId"`
+	Name    string              `json:"name"`
+	Members []grafanaTeamMember `json:"-"`
+}
+
+type grafanaTeamMember struct {
+	UserID uint   `json:"userId"`
+	Email  string `json:"email"`
+}
+
+// describes adding a user to a team or removing them from it
+type teamMembershipChange struct {
+	Organization *grafanaOrganization
+	Team         *grafanaTeam
+	UserID       uint
+	Add          bool // true: add user to the team, false: remove user from the team
+	Reason       *Rule
+}
+
+func (g *grafanaState) getTeams(orgID uint) ([]*grafanaTeam, error) {
+	var page struct {
+		Teams []*grafanaTeam `json:"teams"`
+	}
+	g.Wait()
+	err := g.apiRequest("GET", "/api/teams/search?perpage=99999", orgID, nil, &page)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, team := range page.Teams {
+		g.Wait()
+		err := g.apiRequest("GET", fmt.Sprintf("/api/teams/%d/members", team.ID), orgID, nil, &team.Members)
+		if err != nil {
+			return nil, fmt.Errorf("listing members of team '%v': %v", team.Name, err)
+		}
+	}
+
+	return page.Teams, nil
+}
+
+func (g *grafanaState) createTeam(team *grafanaTeam) error {
+	var resp struct {
+		TeamID uint `json:"teamId"`
+	}
+	if team.OrgID == 0 {
+		// without an org id grafana would create the team in the default org of the sync's grafana user
+		return fmt.Errorf("team '%v' has no org, teams in orgs that are created by the same plan are created in the next run", team.Name)
+	}
+	g.Wait()
+	err := g.apiRequest("POST", "/api/teams", team.OrgID, map[string]string{"name": team.Name}, &resp)
+	if err != nil {
+		return err
+	}
+	team.ID = resp.TeamID
+	return nil
+}
+
+func (g *grafanaState) addTeamMember(team *grafanaTeam, userID uint) error {
+	g.Wait()
+	return g.apiRequest("POST", fmt.Sprintf("/api/teams/%d/members", team.ID), team.OrgID, map[string]uint{"userId": userID}, nil)
+}
+
+func (g *grafanaState) removeTeamMember(team *grafanaTeam, userID uint) error {
+	g.Wait()
+	return g.apiRequest("DELETE", fmt.Sprintf("/api/teams/%d/members/%d", team.ID, userID), team.OrgID, nil, nil)
+}
+
+func (g *grafanaOrganization) findTeam(name string) *grafanaTeam {
+	for _, t := range g.Teams {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *grafanaTeam) hasMember(userID uint) bool {
+	for _, m := range t.Members {
+		if m.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedUsers returns the users that are excluded from each org by an 'exclude' restriction: org id -> user email -> excluded
+func excludedUsers() map[uint]map[string]bool {
+	excluded := make(map[uint]map[string]bool)
+	for _, rule := range activeRules {
+		if !rule.Exclude {
+			continue
+		}
+		users, _ := rule.resolveUsers()
+		for _, org := range grafana.organizations {
+			if !rule.matchesOrg(org.Name) {
+				continue
+			}
+			if excluded[org.ID] == nil {
+				excluded[org.ID] = make(map[string]bool)
+			}
+			for _, u := range users {
+				excluded[org.ID][u] = true
+			}
+		}
+	}
+	return excluded
+}
+
+// planTeams computes the team membership changes for every team that is referenced by a rule.
+// Each team mirrors the users of all rules that reference it (in the given org), except users excluded from the org,
+// every other member gets removed (only in orgs where users can be demoted, and never protected users).
+// Users are only added to a team if they are (or will be) a member of its org.
+// Returns the teams that don't exist yet and have to be created.
+func planTeams(userUpdates map[string]*userUpdate) []*grafanaTeam {
+	var newTeams []*grafanaTeam
+
+	excluded := excludedUsers()
+
+	desiredMembers := make(map[*grafanaTeam]map[string]*Rule) // team -> user email -> rule
+	managedBy := make(map[*grafanaTeam]*Rule)                 // first rule that references the team
+	unresolvedTeams := make(map[*grafanaTeam]bool)            // teams with rules that depend on groups that could not be resolved
+
+	// 1. collect the desired members of each team
+	for _, rule := range activeRules {
+		if len(rule.Teams) == 0 {
+			continue
+		}
+		users, unresolved := rule.resolveUsers()
+
+		// orgs that are created by this plan (grafana.newOrganizations) get their teams in the next run, when they have an id
+		for _, org := range grafana.organizations {
+			if !rule.matchesOrg(org.Name) {
+				continue
+			}
+
+			for _, teamName := range rule.Teams {
+				team := org.findTeam(teamName)
+				if team == nil {
+					team = &grafanaTeam{OrgID: org.ID, Name: teamName}
+					org.Teams = append(org.Teams, team)
+					newTeams = append(newTeams, team)
+				}
+
+				members, exists := desiredMembers[team]
+				if !exists {
+					members = make(map[string]*Rule)
+					desiredMembers[team] = members
+					managedBy[team] = rule
+				}
+				for _, u := range users {
+					if excluded[org.ID][u] {
+						continue
+					}
+					if _, exists := members[u]; !exists {
+						members[u] = rule
+					}
+				}
+				if len(unresolved) > 0 {
+					unresolvedTeams[team] = true
+				}
+			}
+		}
+	}
+
+	// 2. compare with the actual members
+	for team, members := range desiredMembers {
+		org := grafana.organizations[team.OrgID]
+
+		for email, rule := range members {
+			if org.unresolvedRestriction {
+				break // a restriction for this org could not be resolved, we don't know who may be added
+			}
+			update, exists := userUpdates[email]
+			if !exists {
+				continue // user has no grafana account yet
+			}
+			if !willBeOrgMember(update, org) {
+				continue // not in the org (and won't be added to it, for example because the change was not allowed or the user is protected)
+			}
+			grafUser := grafana.findUser(email)
+			if team.hasMember(grafUser.ID) {
+				continue
+			}
+			update.TeamChanges = append(update.TeamChanges, &teamMembershipChange{org, team, grafUser.ID, true, rule})
+		}
+
+		if unresolvedTeams[team] {
+			continue // we don't know all the members the team should have, so nobody gets removed
+		}
+		if !config.Settings.canDemoteIn(org.Name) {
+			continue // the org is additive (or 'canDemote' is off), memberships are also managed manually
+		}
+
+		for _, m := range team.Members {
+			if _, isDesired := members[m.Email]; isDesired {
+				continue
+			}
+			update, exists := userUpdates[m.Email]
+			if !exists || protection(m.Email) != "" {
+				continue
+			}
+			update.TeamChanges = append(update.TeamChanges, &teamMembershipChange{org, team, m.UserID, false, managedBy[team]})
+		}
+	}
+
+	return newTeams
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPlanTeams(t *testing.T) {
+	defer setupTestGroups(t, "sre: [a@corp.com, b@corp.com]\n")()
+	sre := &Rule{Groups: FlattenedArray{"file:sre"}, Organizations: FlattenedArray{"Prod"}, Teams: FlattenedArray{"SRE", "Ops"}}
+	unresolved := &Rule{Groups: FlattenedArray{"file:missing"}, Organizations: FlattenedArray{"Prod"}, Teams: FlattenedArray{"SRE"}}
+
+	tests := []struct {
+		name     string
+		rules    []*Rule
+		want     []string // +team or -team for every team change, by email
+		newTeams string
+	}{
+		{"mirror the group", []*Rule{sre}, []string{"a@corp.com +Ops", "b@corp.com +Ops", "b@corp.com +SRE", "old@corp.com -SRE"}, "Ops"},
+		{"unresolved group", []*Rule{sre, unresolved}, []string{"a@corp.com +Ops", "b@corp.com +Ops", "b@corp.com +SRE"}, "Ops"},
+		{"no team rules", []*Rule{{Groups: FlattenedArray{"file:sre"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}}, nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Settings: Settings{CanDemote: true}, Rules: test.rules}
+			setupTestGrafana(c, "a@corp.com", "b@corp.com", "old@corp.com")
+			activeRules = c.Rules
+			prod := addTestOrg(2, "Prod", map[string]Role{"a@corp.com": "Viewer", "b@corp.com": "Viewer", "old@corp.com": "Viewer"})
+			prod.Teams = []*grafanaTeam{{10, 2, "SRE", []grafanaTeamMember{{UserID: 1, Email: "a@corp.com"}, {UserID: 3, Email: "old@corp.com"}}}}
+			addTestOrg(3, "Dev", map[string]Role{"a@corp.com": "Viewer"})
+
+			userUpdates := map[string]*userUpdate{
+				"a@corp.com":   {Email: "a@corp.com"},
+				"b@corp.com":   {Email: "b@corp.com"},
+				"old@corp.com": {Email: "old@corp.com"},
+			}
+			newTeams := planTeams(userUpdates)
+
+			var names []string
+			for _, team := range newTeams {
+				if team.ID != 0 || team.OrgID != 2 {
+					t.Errorf("new team %+v, want id 0 in org 2", team)
+				}
+				names = append(names, team.Name)
+			}
+			if strings.Join(names, ",") != test.newTeams {
+				t.Errorf("planTeams() created %v, want %v", names, test.newTeams)
+			}
+
+			var got []string
+			for email, update := range userUpdates {
+				for _, change := range update.TeamChanges {
+					if change.Organization != prod || change.Reason != sre || change.UserID != grafana.findUser(email).ID {
+						t.Errorf("team change of %v = %+v, want a change in Prod because of the first rule", email, change)
+					}
+					if change.Add {
+						got = append(got, email+" +"+change.Team.Name)
+					} else {
+						got = append(got, email+" -"+change.Team.Name)
+					}
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("team changes = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanTeamsOnlyAddsOrgMembers(t *testing.T) {
+	c := &Config{Rules: []*Rule{{Users: FlattenedArray{"member@corp.com", "joining@corp.com", "outsider@corp.com", "leaving@corp.com"}, Organizations: FlattenedArray{"Prod"}, Teams: FlattenedArray{"SRE"}}}}
+	setupTestGrafana(c, "member@corp.com", "joining@corp.com", "outsider@corp.com", "leaving@corp.com")
+	activeRules = c.Rules
+	org := addTestOrg(2, "Prod", map[string]Role{"member@corp.com": "Viewer", "leaving@corp.com": "Viewer"})
+	org.Teams = []*grafanaTeam{{10, 2, "SRE", nil}}
+
+	userUpdates := map[string]*userUpdate{
+		"member@corp.com":   {Email: "member@corp.com"},
+		"joining@corp.com":  {Email: "joining@corp.com", Changes: []*userRoleChange{{org, "", "Viewer", c.Rules[0]}}},
+		"outsider@corp.com": {Email: "outsider@corp.com"}, // for example: the change that would add them was filtered out
+		"leaving@corp.com":  {Email: "leaving@corp.com", Changes: []*userRoleChange{{org, "Viewer", "", c.Rules[0]}}},
+	}
+
+	if newTeams := planTeams(userUpdates); len(newTeams) != 0 {
+		t.Errorf("planTeams() created %d teams, the team exists already", len(newTeams))
+	}
+
+	tests := []struct {
+		email   string
+		wantAdd bool
+	}{
+		{"member@corp.com", true},
+		{"joining@corp.com", true},
+		{"outsider@corp.com", false},
+		{"leaving@corp.com", false},
+	}
+	for _, test := range tests {
+		changes := userUpdates[test.email].TeamChanges
+		added := len(changes) == 1 && changes[0].Add && changes[0].Team.Name == "SRE"
+		if added != test.wantAdd || len(changes) > 1 {
+			t.Errorf("team changes of %v = %+v, want add: %v", test.email, changes, test.wantAdd)
+		}
+	}
+}
+
+func TestPlanTeamsKeepsProtectedMembers(t *testing.T) {
+	c := &Config{Rules: []*Rule{{Users: FlattenedArray{"member@corp.com"}, Organizations: FlattenedArray{"Prod"}, Teams: FlattenedArray{"SRE"}}}}
+	c.Settings.CanDemote = true
+	c.Settings.ProtectedUsers = FlattenedArray{"/^admin-.*@corp.com$/"}
+	setupTestGrafana(c, "member@corp.com", "admin-1@corp.com", "leaving@corp.com")
+	activeRules = c.Rules
+	org := addTestOrg(2, "Prod", map[string]Role{"member@corp.com": "Viewer", "admin-1@corp.com": "Admin", "leaving@corp.com": "Viewer"})
+	org.Teams = []*grafanaTeam{{10, 2, "SRE", []grafanaTeamMember{{UserID: 2, Email: "admin-1@corp.com"}, {UserID: 3, Email: "leaving@corp.com"}}}}
+
+	userUpdates := map[string]*userUpdate{
+		"member@corp.com":  {Email: "member@corp.com"},
+		"admin-1@corp.com": {Email: "admin-1@corp.com"},
+		"leaving@corp.com": {Email: "leaving@corp.com"},
+	}
+	planTeams(userUpdates)
+
+	tests := []struct {
+		email  string
+		change string
+	}{
+		{"member@corp.com", "add"},
+		{"admin-1@corp.com", ""}, // protected, stays in the team
+		{"leaving@corp.com", "remove"},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, change := range userUpdates[test.email].TeamChanges {
+			if change.Add {
+				got = append(got, "add")
+			} else {
+				got = append(got, "remove")
+			}
+		}
+		if strings.Join(got, ",") != test.change {
+			t.Errorf("team changes of %v = %v, want %q", test.email, got, test.change)
+		}
+	}
+}
+
+func TestPlanTeamsRemovesMembersOnlyIfAllowed(t *testing.T) {
+	policies := []OrgPolicy{{Organizations: FlattenedArray{"Shared"}, Mode: orgModeAdditive}, {Organizations: FlattenedArray{"Prod"}, Mode: orgModeManaged}}
+
+	tests := []struct {
+		name       string
+		canDemote  bool
+		org        string
+		wantRemove bool
+	}{
+		{"managed org", false, "Prod", true},
+		{"additive org", true, "Shared", false},
+		{"no policy, canDemote", true, "Dev", true},
+		{"no policy", false, "Dev", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{Rules: []*Rule{{Users: FlattenedArray{"member@corp.com"}, Organizations: FlattenedArray{test.org}, Teams: FlattenedArray{"SRE"}}}}
+			c.Settings.CanDemote = test.canDemote
+			c.Settings.OrgPolicies = policies
+			setupTestGrafana(c, "member@corp.com", "manual@corp.com")
+			activeRules = c.Rules
+			org := addTestOrg(2, test.org, map[string]Role{"member@corp.com": "Viewer", "manual@corp.com": "Viewer"})
+			org.Teams = []*grafanaTeam{{10, 2, "SRE", []grafanaTeamMember{{UserID: 1, Email: "member@corp.com"}, {UserID: 2, Email: "manual@corp.com"}}}}
+
+			userUpdates := map[string]*userUpdate{
+				"member@corp.com": {Email: "member@corp.com"},
+				"manual@corp.com": {Email: "manual@corp.com"},
+			}
+			planTeams(userUpdates)
+
+			if changes := userUpdates["member@corp.com"].TeamChanges; len(changes) != 0 {
+				t.Errorf("team changes of a desired member = %+v, want none", changes)
+			}
+			changes := userUpdates["manual@corp.com"].TeamChanges
+			removed := len(changes) == 1 && !changes[0].Add
+			if removed != test.wantRemove || len(changes) > 1 {
+				t.Errorf("team changes of manual@corp.com = %+v, want removal: %v", changes, test.wantRemove)
+			}
+		})
+	}
+}
+
+func TestCreateTeamWithoutOrg(t *testing.T) {
+	server := newFakeGrafana()
+	defer server.Close()
+	setupTestGrafana(&Config{Grafanas: server.config()})
+
+	if err := grafana.createTeam(&grafanaTeam{Name: "Platform"}); err == nil {
+		t.Errorf("createTeam() of a team without org returned no error")
+	}
+	if requests := server.receivedRequests(); len(requests) != 0 {
+		t.Errorf("createTeam() sent %v, want no request (the team would end up in the default org)", requests)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// placeholderRegex matches the placeholders in templated org and team names, like the "{1}" in "team-{1}"
+var placeholderRegex = regexp.MustCompile(`\{(\d+)\}`)
+
+// activeRules are the rules the current plan is based on: the rules of the config (that apply to the current target), with every templated rule expanded,
+// and the patterns in groups and users resolved (guarded by stateMutex)
+var activeRules []*Rule
+
+// groupMatch is a group that matches a group pattern
+type groupMatch struct {
+	Ref        string   // reference to the group (with the same provider prefix as the pattern)
+	Submatches []string // [0] is the whole group key, [1...] are the capture groups of the pattern
+}
+
+func isRegex(s string) bool {
+	return len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/")
+}
+
+// isTemplated returns true if any (non-regex) org or team of the rule contains a placeholder
+func (r *Rule) isTemplated() bool {
+	for _, name := range append(append([]string{}, r.Organizations...), r.Teams...) {
+		if !isRegex(name) && placeholderRegex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTemplate checks that a templated rule has exactly one group pattern, with enough capture groups for all placeholders
+func (r *Rule) verifyTemplate(c *Config) error {
+	if len(r.Groups) != 1 {
+		return fmt.Errorf("rules with templated orgs or teams must have exactly one group (a regex pattern like /team-(.*)-admins@my-company.com/)")
+	}
+	_, key := c.parseGroupRef(r.Groups[0])
+	if !isRegex(key) {
+		return fmt.Errorf("the group of a rule with templated orgs or teams must be a regex pattern (enclosed in //), not '%v'", r.Groups[0])
+	}
+
+	pattern, err := regexp.Compile(key[1 : len(key)-1])
+	if err != nil {
+		return fmt.Errorf("group pattern '%v' can not be compiled: %v", key, err)
+	}
+
+	for _, name := range append(append([]string{}, r.Organizations...), r.Teams...) {
+		if isRegex(name) {
+			continue
+		}
+		for _, p := range placeholderRegex.FindAllStringSubmatch(name, -1) {
+			index, _ := strconv.Atoi(p[1])
+			if index > pattern.NumSubexp() {
+				return fmt.Errorf("'%v' uses %v, but the group pattern only has %d capture groups", name, p[0], pattern.NumSubexp())
+			}
+		}
+	}
+	return nil
+}
+
+// matchGroupPattern finds all groups that match a pattern like "/team-(.*)-admins@corp\.com/" (optionally with a provider prefix)
+func matchGroupPattern(ref string) ([]groupMatch, error) {
+	providerName, key := config.parseGroupRef(ref)
+	prefix := strings.TrimSuffix(ref, key)
+
+	p, exists := groupProviders[providerName]
+	if !exists {
+		return nil, fmt.Errorf("group provider '%v' is not set up", providerName)
+	}
+	pattern, err := regexp.Compile(key[1 : len(key)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	groupKeys, err := p.ListGroups() // on error, the last known list might still be returned
+	var matches []groupMatch
+	for _, groupKey := range groupKeys {
+		if submatches := pattern.FindStringSubmatch(groupKey); submatches != nil {
+			submatches[0] = groupKey
+			matches = append(matches, groupMatch{prefix + groupKey, submatches})
+		}
+	}
+	return matches, err
+}
+
+// expand creates one rule for every group that matches the group pattern of a templated rule,
+// with the placeholders in its orgs and teams replaced by the capture groups of the match.
+func (r *Rule) expand() ([]*Rule, error) {
+	matches, err := matchGroupPattern(r.Groups[0])
+
+	var rules []*Rule
+	for _, m := range matches {
+		expanded := *r
+		expanded.Groups = FlattenedArray{m.Ref}
+		expanded.Organizations = fillTemplates(r.Organizations, m.Submatches)
+		expanded.Teams = fillTemplates(r.Teams, m.Submatches)
+		rules = append(rules, &expanded)
+	}
+	return rules, err
+}
+
+func fillTemplates(names []string, submatches []string) FlattenedArray {
+	var result []string
+	for _, name := range names {
+		if !isRegex(name) {
+			name = placeholderRegex.ReplaceAllStringFunc(name, func(p string) string {
+				index, _ := strconv.Atoi(p[1 : len(p)-1])
+				return submatches[index]
+			})
+		}
+		result = append(result, name)
+	}
+	return distinct(result)
+}
+
+// hasPatterns returns true if any group or user of the rule is a regex pattern
+func (r *Rule) hasPatterns() bool {
+	for _, g := range r.Groups {
+		if _, key := config.parseGroupRef(g); isRegex(key) {
+			return true
+		}
+	}
+	for _, u := range r.Users {
+		if isRegex(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) withPatternsResolved() *Rule {
+	if !r.hasPatterns() {
+		return r
+	}
+	return r.resolvePatterns()
+}
+
+// resolvePatterns creates a copy of the rule that knows which groups (of the provider) and which grafana users its patterns match
+func (r *Rule) resolvePatterns() *Rule {
+	resolved := *r
+	resolved.patternMatches = make(map[string][]string)
+	resolved.unresolvedPatterns = nil
+
+	for _, g := range r.Groups {
+		if _, key := config.parseGroupRef(g); !isRegex(key) {
+			continue
+		}
+		matches, err := matchGroupPattern(g)
+		if err != nil {
+			log.Warnw("unable to find all groups matching a group pattern", "ruleIndex", r.Index, "ruleNote", r.Note, "pattern", g, "error", err)
+			resolved.unresolvedPatterns = append(resolved.unresolvedPatterns, g)
+		}
+		refs := make([]string, 0, len(matches))
+		for _, m := range matches {
+			refs = append(refs, m.Ref)
+		}
+		resolved.patternMatches[g] = refs
+	}
+
+	for _, u := range r.Users {
+		if !isRegex(u) {
+			continue
+		}
+		pattern := regexp.MustCompile(u[1 : len(u)-1]) // already verified when the config was loaded
+		emails := make([]string, 0)
+		for _, grafUser := range grafana.allUsers {
+			if pattern.MatchString(grafUser.Email) {
+				emails = append(emails, grafUser.Email)
+			}
+		}
+		resolved.patternMatches[u] = emails
+	}
+
+	return &resolved
+}
+
+// expandRules returns the rules of the config that are active right now (and apply to the current target), with every templated rule replaced by its expansions,
+// and the patterns of every rule resolved
+func expandRules() []*Rule {
+	var result []*Rule
+	now := time.Now()
+
+	for _, rule := range config.Rules {
+		if !rule.appliesTo(currentTarget.Name) {
+			continue
+		}
+		if !rule.isActive(now) {
+			log.Debugw("rule is not active right now", "ruleIndex", rule.Index, "ruleNote", rule.Note, "validFrom", rule.ValidFrom, "validUntil", rule.ValidUntil)
+			continue
+		}
+
+		if !rule.isTemplated() {
+			result = append(result, rule.withPatternsResolved())
+			continue
+		}
+
+		expanded, err := rule.expand()
+		if err != nil {
+			// we don't know all the orgs the rule applies to, so nobody may be demoted below its role in any org
+			for _, org := range grafana.organizations {
+				if rule.Role.isHigherThan(org.unresolvedRole) {
+					org.unresolvedRole = rule.Role
+				}
+			}
+			log.Warnw("unable to find all groups matching the pattern of a templated rule, no user will be demoted or removed because of it in this run", "ruleIndex", rule.Index, "ruleNote", rule.Note, "pattern", rule.Groups[0], "error", err)
+		}
+		log.Debugw("expanded templated rule", "ruleIndex", rule.Index, "matchedGroups", len(expanded))
+		for _, e := range expanded {
+			result = append(result, e.withPatternsResolved())
+		}
+	}
+
+	// just-in-time elevations are applied like any other rule
+	for _, rule := range elevationRules(now) {
+		if rule.appliesTo(currentTarget.Name) {
+			result = append(result, rule)
+		}
+	}
+
+	return result
+}
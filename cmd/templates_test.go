@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyTemplate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  *Rule
+		valid bool
+	}{
+		{"org template", &Rule{Groups: FlattenedArray{`/team-(.*)-admins@corp\.com/`}, Organizations: FlattenedArray{"team-{1}"}, Role: "Admin"}, true},
+		{"team template", &Rule{Groups: FlattenedArray{`file:/team-(.*)-(.*)/`}, Organizations: FlattenedArray{"Prod"}, Teams: FlattenedArray{"{2} of {1}"}, Role: "Viewer"}, true},
+		{"whole group name", &Rule{Groups: FlattenedArray{`/team-.*/`}, Organizations: FlattenedArray{"{0}"}, Role: "Viewer"}, true},
+		{"regex orgs are not templates", &Rule{Groups: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"/team-{1}/"}, Role: "Viewer"}, true},
+		{"no group", &Rule{Users: FlattenedArray{"a@corp.com"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Viewer"}, false},
+		{"several groups", &Rule{Groups: FlattenedArray{"/team-(.*)/", "/ops-(.*)/"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Viewer"}, false},
+		{"group is not a pattern", &Rule{Groups: FlattenedArray{"team-payments@corp.com"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Viewer"}, false},
+		{"invalid group pattern", &Rule{Groups: FlattenedArray{"/team-(.*/"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Viewer"}, false},
+		{"too few capture groups", &Rule{Groups: FlattenedArray{"/team-(.*)/"}, Organizations: FlattenedArray{"team-{1}"}, Teams: FlattenedArray{"{2}"}, Role: "Viewer"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rule.verify(&Config{})
+			if (err == nil) != test.valid {
+				t.Errorf("verify() error = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestFillTemplates(t *testing.T) {
+	submatches := []string{"team-payments-admins", "payments", "admins"}
+
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"team-{1}"}, []string{"team-payments"}},
+		{[]string{"{1} {2}", "{0}"}, []string{"payments admins", "team-payments-admins"}},
+		{[]string{"Prod", "/^{1}$/"}, []string{"Prod", "/^{1}$/"}}, // regex patterns are left as they are
+		{[]string{"{1}", "payments"}, []string{"payments"}},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.names, ","), func(t *testing.T) {
+			got := fillTemplates(test.names, submatches)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("fillTemplates(%v) = %v, want %v", test.names, got, test.want)
+			}
+		})
+	}
+}
+
+// describeRules formats the groups, orgs and teams of rules, like "file:team-a>A[a team]", sorted
+func describeRules(rules []*Rule) []string {
+	var result []string
+	for _, r := range rules {
+		s := fmt.Sprintf("%v>%v", strings.Join(r.Groups, ","), strings.Join(r.Organizations, ","))
+		if len(r.Teams) > 0 {
+			s += "[" + strings.Join(r.Teams, ",") + "]"
+		}
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestExpandRules(t *testing.T) {
+	defer setupTestGroups(t, "team-payments-admins: [a@corp.com]\nteam-search-admins: [b@corp.com]\nteam-search-viewers: [c@corp.com]\n")()
+
+	past := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name           string
+		rule           *Rule
+		want           []string
+		unresolvedRole Role // of every org, if not all groups matching the pattern could be found
+	}{
+		{"org template", &Rule{Groups: FlattenedArray{"file:/team-(.*)-admins/"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Admin"}, []string{
+			"file:team-payments-admins>team-payments",
+			"file:team-search-admins>team-search",
+		}, ""},
+		{"team template", &Rule{Groups: FlattenedArray{"file:/team-(.*)-(.*)/"}, Organizations: FlattenedArray{"Prod", "{1}"}, Teams: FlattenedArray{"{1} {2}"}, Role: "Viewer"}, []string{
+			"file:team-payments-admins>Prod,payments[payments admins]",
+			"file:team-search-admins>Prod,search[search admins]",
+			"file:team-search-viewers>Prod,search[search viewers]",
+		}, ""},
+		{"no matching groups", &Rule{Groups: FlattenedArray{"file:/ops-(.*)/"}, Organizations: FlattenedArray{"{1}"}, Role: "Viewer"}, nil, ""},
+		{"not a template", &Rule{Groups: FlattenedArray{"file:team-payments-admins"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}, []string{
+			"file:team-payments-admins>Prod",
+		}, ""},
+		{"inactive", &Rule{Groups: FlattenedArray{"file:/team-(.*)-admins/"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Admin", ValidUntil: &past}, nil, ""},
+		{"other target", &Rule{Groups: FlattenedArray{"file:/team-(.*)-admins/"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Admin", Targets: FlattenedArray{"other"}}, nil, ""},
+		{"provider not set up", &Rule{Groups: FlattenedArray{"ldap:/team-(.*)/"}, Organizations: FlattenedArray{"team-{1}"}, Role: "Editor"}, nil, "Editor"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestGrafana(&Config{Rules: []*Rule{test.rule}})
+			prod := addTestOrg(2, "Prod", nil)
+
+			got := describeRules(expandRules())
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("expandRules() = %v, want %v", got, test.want)
+			}
+			if prod.unresolvedRole != test.unresolvedRole {
+				t.Errorf("unresolved role = %q, want %q", prod.unresolvedRole, test.unresolvedRole)
+			}
+		})
+	}
+}
+
+func TestIsRegex(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"/team-.*/", true},
+		{"//", true},
+		{"/", false},
+		{"team-a@corp.com", false},
+		{"/team-a", false},
+		{"team-a/", false},
+	}
+
+	for _, test := range tests {
+		if got := isRegex(test.s); got != test.want {
+			t.Errorf("isRegex(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestVerifyPatterns(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  *Rule
+		valid bool
+	}{
+		{"group pattern", &Rule{Groups: FlattenedArray{`/^ops-.*@corp\.com$/`}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}, true},
+		{"group pattern with provider", &Rule{Groups: FlattenedArray{"file:/^ops-/"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}, true},
+		{"user pattern", &Rule{Users: FlattenedArray{`/@corp\.com$/`}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}, true},
+		{"invalid group pattern", &Rule{Groups: FlattenedArray{"/ops-(/"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}, false},
+		{"invalid group pattern with provider", &Rule{Groups: FlattenedArray{"ldap:/ops-[/"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}, false},
+		{"invalid user pattern", &Rule{Users: FlattenedArray{"/a(/"}, Organizations: FlattenedArray{"Prod"}, Role: "Viewer"}, false},
+		{"invalid pattern in a restriction", &Rule{Users: FlattenedArray{"/*/"}, Organizations: FlattenedArray{"Prod"}, Exclude: true}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rule.verify(&Config{})
+			if (err == nil) != test.valid {
+				t.Errorf("verify() error = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestMatchGroupPattern(t *testing.T) {
+	defer setupTestGroups(t, "ops-prod: [a@corp.com]\nops-dev: [b@corp.com]\nsre: [c@corp.com]\n")()
+	setupTestGrafana(&Config{Provider: providerFile})
+
+	tests := []struct {
+		ref     string
+		want    []string // ref and submatches of every match
+		wantErr bool
+	}{
+		{"file:/^ops-(.*)$/", []string{"file:ops-dev dev", "file:ops-prod prod"}, false},
+		{"/^ops-(.*)$/", []string{"ops-dev dev", "ops-prod prod"}, false}, // default provider, no prefix
+		{"file:/sre/", []string{"file:sre"}, false},
+		{"file:/nothing/", nil, false},
+		{"ldap:/ops/", nil, true},
+		{"file:/ops-(/", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			matches, err := matchGroupPattern(test.ref)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("matchGroupPattern() error = %v, want error %v", err, test.wantErr)
+			}
+			var got []string
+			for _, m := range matches {
+				got = append(got, strings.Join(append([]string{m.Ref}, m.Submatches[1:]...), " "))
+			}
+			sort.Strings(got)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("matchGroupPattern() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolvePatterns(t *testing.T) {
+	defer setupTestGroups(t, "ops-prod: [a@corp.com]\nops-dev: [b@corp.com]\n")()
+
+	rule := &Rule{
+		Groups:        FlattenedArray{"file:/^ops-/", "ldap:/^sre-/", "file:sre"},
+		Users:         FlattenedArray{`/@corp\.com$/`, "d@external.com"},
+		Organizations: FlattenedArray{"Prod"},
+		Role:          "Viewer",
+	}
+	setupTestGrafana(&Config{Rules: []*Rule{rule}}, "a@corp.com", "c@corp.com", "d@external.com")
+
+	resolved := rule.withPatternsResolved()
+	if resolved == rule || rule.patternMatches != nil {
+		t.Fatalf("withPatternsResolved() must return a copy of the rule")
+	}
+
+	want := map[string]string{
+		"file:/^ops-/":  "file:ops-dev,file:ops-prod",
+		"ldap:/^sre-/":  "", // the provider is not set up
+		`/@corp\.com$/`: "a@corp.com,c@corp.com",
+	}
+	if len(resolved.patternMatches) != len(want) {
+		t.Errorf("patternMatches = %v, want %v", resolved.patternMatches, want)
+	}
+	for pattern, matches := range want {
+		got := append([]string{}, resolved.patternMatches[pattern]...)
+		sort.Strings(got)
+		if strings.Join(got, ",") != matches {
+			t.Errorf("patternMatches[%v] = %v, want %v", pattern, got, matches)
+		}
+	}
+	if strings.Join(resolved.unresolvedPatterns, ",") != "ldap:/^sre-/" {
+		t.Errorf("unresolvedPatterns = %v, want [ldap:/^sre-/]", resolved.unresolvedPatterns)
+	}
+
+	if got := resolved.userPatternsMatching("c@corp.com"); strings.Join(got, ",") != `/@corp\.com$/` {
+		t.Errorf("userPatternsMatching(c@corp.com) = %v, want [/@corp\\.com$/]", got)
+	}
+	if got := resolved.userPatternsMatching("d@external.com"); len(got) != 0 {
+		t.Errorf("userPatternsMatching(d@external.com) = %v, want none", got)
+	}
+
+	plain := &Rule{Groups: FlattenedArray{"file:ops-prod"}, Users: FlattenedArray{"a@corp.com"}, Role: "Viewer"}
+	if plain.withPatternsResolved() != plain {
+		t.Errorf("withPatternsResolved() of a rule without patterns must return the rule itself")
+	}
+}
@@ -6,12 +6,13 @@ require (
 	github.com/bep/debounce v1.2.0
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gin-gonic/gin v1.5.0
+	github.com/go-ldap/ldap/v3 v3.2.4
 	github.com/go-playground/universal-translator v0.17.0 // indirect
 	github.com/gosimple/slug v1.9.0 // indirect
 	github.com/leodido/go-urn v1.2.0 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/pkg/errors v0.9.1
-	github.com/prometheus/client_golang v1.6.0 // indirect
+	github.com/prometheus/client_golang v1.6.0
 	github.com/rikimaru0345/sdk v0.0.0-20200129142910-2c80f41386a8
 	github.com/sqs/goreturns v0.0.0-20181028201513-538ac6014518 // indirect
 	go.uber.org/atomic v1.5.1 // indirect
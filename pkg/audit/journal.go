@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is a single change that was applied (or attempted) in grafana
+type Entry struct {
+	Time  time.Time `json:"time"`
+	RunID string    `json:"runId"` // all changes of the same plan share the run id
+
+	Target string `json:"target,omitempty"` // name of the grafana instance the change was made in
+
+	Action  string `json:"action"` // add, promote, demote, remove, create_user, disable_user, delete_user, create_team, team_add, team_remove, permission_add, ...
+	User    string `json:"user,omitempty"`
+	Org     string `json:"org,omitempty"`
+	OrgID   uint   `json:"orgId,omitempty"`
+	Team    string `json:"team,omitempty"`
+	OldRole string `json:"oldRole,omitempty"`
+	NewRole string `json:"newRole,omitempty"`
+
+	Folder        string `json:"folder,omitempty"` // title of the folder (or dashboard)
+	FolderUID     string `json:"folderUid,omitempty"`
+	OldPermission string `json:"oldPermission,omitempty"`
+	NewPermission string `json:"newPermission,omitempty"`
+
+	RuleIndex *int   `json:"ruleIndex,omitempty"`
+	RuleNote  string `json:"ruleNote,omitempty"`
+	Reason    string `json:"reason,omitempty"` // for changes that are not caused by a rule (offboarding)
+
+	Outcome    string `json:"outcome"`              // OutcomeOK or OutcomeFailed
+	StatusCode int    `json:"statusCode,omitempty"` // http status code of the last response of the grafana api for this change, 0 if no request was made
+	Status     string `json:"status,omitempty"`     // message returned by the grafana api
+	Error      string `json:"error,omitempty"`
+}
+
+// outcomes of a change
+const (
+	OutcomeOK     = "ok"
+	OutcomeFailed = "failed"
+)
+
+// Filter selects entries in Query. Empty fields match everything.
+type Filter struct {
+	User   string
+	Org    string
+	Target string
+	Action string
+	From   time.Time
+	To     time.Time
+	Limit  int // only return the newest N matching entries
+}
+
+// Journal is an append-only log of entries, stored as one json object per line
+type Journal struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// Open opens (or creates) the journal file at the given path
+func Open(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path, file: file}, nil
+}
+
+// Append writes an entry to the end of the journal
+func (j *Journal) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	_, err = j.file.Write(line)
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Query reads all entries that match the filter (oldest first)
+func (j *Journal) Query(f Filter) ([]Entry, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make([]Entry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // skip damaged lines (for example a partially written line after a crash)
+		}
+		if f.matches(e) {
+			result = append(result, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[len(result)-f.Limit:]
+	}
+	return result, nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+func (f Filter) matches(e Entry) bool {
+	if f.User != "" && f.User != e.User {
+		return false
+	}
+	if f.Org != "" && f.Org != e.Org {
+		return false
+	}
+	if f.Target != "" && f.Target != e.Target {
+		return false
+	}
+	if f.Action != "" && f.Action != e.Action {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+	return true
+}
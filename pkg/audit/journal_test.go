@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer j.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: start, Target: "main", Action: "add", User: "a@corp.com", Org: "Main", Outcome: OutcomeOK},
+		{Time: start.Add(time.Hour), Target: "main", Action: "promote", User: "b@corp.com", Org: "Main", Outcome: OutcomeOK},
+		{Time: start.Add(2 * time.Hour), Target: "other", Action: "add", User: "a@corp.com", Org: "Dev", Outcome: OutcomeFailed, StatusCode: 500},
+		{Time: start.Add(3 * time.Hour), Target: "main", Action: "remove", User: "a@corp.com", Org: "Dev", Outcome: OutcomeOK},
+	}
+	for _, e := range entries {
+		if err := j.Append(e); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+
+	// a damaged line (for example after a crash) is skipped
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("{\"time\":\n")
+	file.Close()
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []int // indices into entries, oldest first
+	}{
+		{"everything", Filter{}, []int{0, 1, 2, 3}},
+		{"user", Filter{User: "a@corp.com"}, []int{0, 2, 3}},
+		{"org", Filter{Org: "Dev"}, []int{2, 3}},
+		{"target", Filter{Target: "other"}, []int{2}},
+		{"action", Filter{Action: "add"}, []int{0, 2}},
+		{"from", Filter{From: start.Add(time.Hour)}, []int{1, 2, 3}},
+		{"to", Filter{To: start.Add(time.Hour)}, []int{0, 1}},
+		{"from and to", Filter{From: start.Add(time.Hour), To: start.Add(2 * time.Hour)}, []int{1, 2}},
+		{"limit keeps the newest", Filter{Limit: 2}, []int{2, 3}},
+		{"limit larger than result", Filter{User: "b@corp.com", Limit: 5}, []int{1}},
+		{"combined", Filter{User: "a@corp.com", Action: "add", Target: "main"}, []int{0}},
+		{"no match", Filter{User: "nobody@corp.com"}, []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := j.Query(test.filter)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("Query() returned %d entries, want %d: %v", len(got), len(test.want), got)
+			}
+			for i, index := range test.want {
+				want := entries[index]
+				if !got[i].Time.Equal(want.Time) || got[i].Action != want.Action || got[i].User != want.User || got[i].Org != want.Org || got[i].Target != want.Target {
+					t.Errorf("entry %d = %v, want %v", i, got[i], want)
+				}
+				if got[i].Outcome != want.Outcome || got[i].StatusCode != want.StatusCode {
+					t.Errorf("entry %d has outcome %v (%d), want %v (%d)", i, got[i].Outcome, got[i].StatusCode, want.Outcome, want.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+func TestJournalReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for i, user := range []string{"a@corp.com", "b@corp.com"} {
+		j, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		if err := j.Append(Entry{Time: time.Now(), Action: "add", User: user, Outcome: OutcomeOK}); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+		got, err := j.Query(Filter{})
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		if len(got) != i+1 || got[i].User != user {
+			t.Errorf("after opening %d times, Query() = %v, want %d entries ending with %v", i+1, got, i+1, user)
+		}
+		j.Close()
+	}
+}
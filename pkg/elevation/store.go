@@ -0,0 +1,154 @@
+package elevation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Grant gives a user a role in an org for a limited time
+type Grant struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Org         string    `json:"org"`
+	Target      string    `json:"target,omitempty"` // the grafana instance the org belongs to
+	Role        string    `json:"role"`
+	Previous    string    `json:"previousRole,omitempty"` // the role the user had in the org before the grant (empty: not a member)
+	Reason      string    `json:"reason"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// IsActive returns true if the grant has not expired at the given time
+func (g *Grant) IsActive(t time.Time) bool {
+	return t.Before(g.Expires)
+}
+
+// Store keeps all grants in a json file, so they survive restarts
+type Store struct {
+	path   string
+	mutex  sync.Mutex
+	grants []Grant
+}
+
+// Open loads the grants from the file at the given path (the file is created when the first grant is added)
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &s.grants); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add stores a new grant, its ID and creation time are filled in
+func (s *Store) Add(g Grant) (Grant, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Grant{}, err
+	}
+	g.ID = hex.EncodeToString(id)
+	g.Created = time.Now().UTC()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.grants = append(s.grants, g)
+	if err := s.save(); err != nil {
+		s.grants = s.grants[:len(s.grants)-1]
+		return Grant{}, err
+	}
+	return g, nil
+}
+
+// Expire ends a grant right now, it is then revoked just like a grant that expired on its own.
+// Returns false if there is no active grant with the given ID.
+func (s *Store) Expire(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UTC()
+	for i := range s.grants {
+		if s.grants[i].ID == id && s.grants[i].IsActive(now) {
+			previous := s.grants[i].Expires
+			s.grants[i].Expires = now
+			if err := s.save(); err != nil {
+				s.grants[i].Expires = previous
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Grants returns all grants (active and expired ones)
+func (s *Store) Grants() []Grant {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Grant{}, s.grants...)
+}
+
+// Prune removes grants that expired before the given time
+func (s *Store) Prune(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var kept []Grant
+	for _, g := range s.grants {
+		if !g.Expires.Before(before) {
+			kept = append(kept, g)
+		}
+	}
+	if len(kept) == len(s.grants) {
+		return nil
+	}
+
+	previous := s.grants
+	s.grants = kept
+	if err := s.save(); err != nil {
+		s.grants = previous
+		return err
+	}
+	return nil
+}
+
+// save replaces the file with the current grants (by writing a temporary file and renaming it, so the file is never half written)
+func (s *Store) save() error {
+	bytes, err := json.MarshalIndent(s.grants, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,86 @@
+package elevation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elevation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "elevations.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() of a missing file error = %v", err)
+	}
+	if len(s.Grants()) != 0 {
+		t.Fatalf("Grants() = %v, want none", s.Grants())
+	}
+
+	now := time.Now().UTC()
+	old, err := s.Add(Grant{User: "a@corp.com", Org: "Prod", Role: "Admin", Expires: now.Add(-48 * time.Hour)})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	active, err := s.Add(Grant{User: "b@corp.com", Org: "Prod", Role: "Editor", Previous: "Viewer", Expires: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if old.ID == "" || old.ID == active.ID || active.Created.IsZero() {
+		t.Errorf("Add() did not fill in a unique id and the creation time: %+v, %+v", old, active)
+	}
+
+	// the grants survive a restart
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	grants := s.Grants()
+	if len(grants) != 2 || grants[1].ID != active.ID || grants[1].Previous != "Viewer" || !grants[1].IsActive(now) || grants[0].IsActive(now) {
+		t.Fatalf("Grants() after reopening = %+v", grants)
+	}
+
+	if expired, err := s.Expire(old.ID); err != nil || expired {
+		t.Errorf("Expire() of an expired grant = %v, %v; want false", expired, err)
+	}
+	if expired, err := s.Expire(active.ID); err != nil || !expired {
+		t.Errorf("Expire() = %v, %v; want true", expired, err)
+	}
+	if s.Grants()[1].IsActive(time.Now()) {
+		t.Errorf("grant is still active after Expire()")
+	}
+
+	if err := s.Prune(now.Add(-24 * time.Hour)); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if grants := s.Grants(); len(grants) != 1 || grants[0].ID != active.ID {
+		t.Errorf("Grants() after Prune() = %+v, want only %v", grants, active.ID)
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elevation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "elevations.json")
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path); err == nil {
+		t.Errorf("Open() of an invalid file returned no error")
+	}
+}
@@ -0,0 +1,284 @@
+package groups
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// FileConfig -
+type FileConfig struct {
+	Paths []string `yaml:"paths"` // .yaml/.yml or .csv files that define groups
+}
+
+// FileProvider resolves groups that are defined in local files.
+//
+// YAML files map group names to lists of members:
+//
+//	contractors: [alice@external.com, bob@external.com]
+//	break-glass: [emergency@my-company.com, contractors]
+//
+// CSV files contain one group per line, followed by its members:
+//
+//	contractors,alice@external.com,bob@external.com
+//
+// A member that is the name of another group is a nested group, every other member is a user email.
+type FileProvider struct {
+	logger *zap.SugaredLogger
+	paths  []string
+
+	mutex       sync.Mutex
+	definitions map[string][]string // [group name]members, as read from the files
+	groups      map[string]*Group
+	users       map[string]*User
+
+	fetchTracker
+}
+
+// CreateFileProvider creates a provider and loads all group files
+func CreateFileProvider(logger *zap.SugaredLogger, config FileConfig) (*FileProvider, error) {
+	p := &FileProvider{logger: logger, paths: config.Paths, groups: make(map[string]*Group), users: make(map[string]*User), fetchTracker: newFetchTracker()}
+	err := p.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Paths returns the files the groups are loaded from
+func (p *FileProvider) Paths() []string {
+	return p.paths
+}
+
+// Reload reads all group files again. If any of them can't be loaded, the previously loaded groups are kept.
+func (p *FileProvider) Reload() error {
+	definitions := make(map[string][]string)
+
+	for _, path := range p.paths {
+		var err error
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = readYAMLGroupFile(path, definitions)
+		case ".csv":
+			err = readCSVGroupFile(path, definitions)
+		default:
+			err = fmt.Errorf("unsupported file type, must be .yaml, .yml, or .csv")
+		}
+		if err != nil {
+			return fmt.Errorf("loading group file '%v': %v", path, err)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.definitions = definitions
+	p.groups = make(map[string]*Group)
+	p.users = make(map[string]*User)
+	p.clearRound()
+
+	return nil
+}
+
+func readYAMLGroupFile(path string, definitions map[string][]string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var groups map[string][]string
+	err = yaml.Unmarshal(bytes, &groups)
+	if err != nil {
+		return err
+	}
+
+	for name, members := range groups {
+		for _, m := range members {
+			definitions[name] = append(definitions[name], strings.TrimSpace(m))
+		}
+	}
+	return nil
+}
+
+func readCSVGroupFile(path string, definitions map[string][]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1 // every group can have a different number of members
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		name := strings.TrimSpace(record[0])
+		if name == "" {
+			continue
+		}
+		for _, m := range record[1:] {
+			if m = strings.TrimSpace(m); m != "" {
+				definitions[name] = append(definitions[name], m)
+			}
+		}
+		if _, exists := definitions[name]; !exists {
+			definitions[name] = []string{} // group without members
+		}
+	}
+	return nil
+}
+
+// Clear removes all groups and users from the cache
+func (p *FileProvider) Clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.groups = make(map[string]*Group)
+	p.users = make(map[string]*User)
+	p.clearRound()
+}
+
+// CacheSize returns the number of groups and users currently in the cache
+func (p *FileProvider) CacheSize() (groups int, users int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.groups), len(p.users)
+}
+
+// ListGroups returns the names of all groups defined in the group files
+func (p *FileProvider) ListGroups() ([]string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	names := make([]string, 0, len(p.definitions))
+	for name := range p.definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetGroup resolves the group with the given name
+func (p *FileProvider) GetGroup(name string) (*Group, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.getGroup(name)
+}
+
+func (p *FileProvider) getGroup(name string) (*Group, error) {
+	grp, exists := p.groups[name]
+	if exists {
+		return grp, p.roundErrors[name] // return existing
+	}
+
+	members, exists := p.definitions[name]
+	if !exists {
+		// the files are the source of truth, so there is no last good version to fall back to
+		err := fmt.Errorf("group '%v' is not defined in any group file", name)
+		p.recordError(name, err)
+		return nil, err
+	}
+
+	grp = &Group{Email: name} // create new
+	p.groups[name] = grp
+
+	for _, m := range members {
+		if _, isGroup := p.definitions[m]; isGroup {
+			subGroup, err := p.getGroup(m)
+			if err != nil {
+				continue
+			}
+			grp.Groups = append(grp.Groups, subGroup)
+		} else {
+			u, exists := p.users[m]
+			if !exists {
+				u = &User{m, false}
+				p.users[m] = u
+			}
+			grp.Users = append(grp.Users, u)
+		}
+	}
+
+	p.success(name, grp)
+	return grp, nil
+}
+
+// FetchStatus returns the outcome of the last attempt to resolve each group
+func (p *FileProvider) FetchStatus() map[string]FetchStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.fetchTracker.FetchStatus()
+}
+
+// ListGroupMembersForDisplay lists the members of a group
+func (p *FileProvider) ListGroupMembersForDisplay(groupKey string, includeDerived bool) ([]map[string]interface{}, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.listGroupMembersForDisplay(groupKey, includeDerived, map[string]bool{})
+}
+
+func (p *FileProvider) listGroupMembersForDisplay(name string, includeDerived bool, visited map[string]bool) (result []map[string]interface{}, err error) {
+	result = make([]map[string]interface{}, 0)
+	visited[name] = true
+
+	members, exists := p.definitions[name]
+	if !exists {
+		return nil, fmt.Errorf("group '%v' is not defined in any group file", name)
+	}
+
+	for _, m := range members {
+		if _, isGroup := p.definitions[m]; isGroup {
+			element := map[string]interface{}{
+				"type": "GROUP",
+				"name": m,
+			}
+			if includeDerived && !visited[m] {
+				element["items"], _ = p.listGroupMembersForDisplay(m, includeDerived, visited)
+			}
+			result = append(result, element)
+		} else {
+			result = append(result, map[string]interface{}{
+				"type":  "USER",
+				"email": m,
+			})
+		}
+	}
+	return result, nil
+}
+
+// ListUserGroupsForDisplay finds all groups a user is a direct member of
+func (p *FileProvider) ListUserGroupsForDisplay(userKey string) ([]map[string]interface{}, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var names []string
+	for name, members := range p.definitions {
+		for _, m := range members {
+			if m == userKey {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	groups := make([]map[string]interface{}, 0)
+	for _, name := range names {
+		groups = append(groups, map[string]interface{}{
+			"name": name,
+		})
+	}
+	return groups, nil
+}
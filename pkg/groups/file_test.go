@@ -0,0 +1,158 @@
+package groups
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// writeGroupFiles writes the files (name -> content) to a new temporary directory, and returns their paths (sorted by name)
+func writeGroupFiles(t *testing.T, files map[string]string) (dir string, paths []string) {
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return dir, paths
+}
+
+func userEmails(grp *Group) string {
+	var emails []string
+	for _, u := range grp.AllUsers() {
+		emails = append(emails, u.Email)
+	}
+	sort.Strings(emails)
+	return strings.Join(emails, ",")
+}
+
+func TestFileProviderGetGroup(t *testing.T) {
+	dir, paths := writeGroupFiles(t, map[string]string{
+		"a.yaml": "contractors: [alice@external.com, ' bob@external.com ']\n" +
+			"break-glass: [emergency@corp.com, contractors]\n" +
+			"loop-a: [a@corp.com, loop-b]\n" +
+			"loop-b: [b@corp.com, loop-a]\n",
+		"b.csv": "# group,members...\n" +
+			"contractors, carol@external.com\n" +
+			"oncall,dave@corp.com,,break-glass\n" +
+			"empty\n",
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := CreateFileProvider(zap.NewNop().Sugar(), FileConfig{Paths: paths})
+	if err != nil {
+		t.Fatalf("CreateFileProvider() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string // emails of all users
+		wantErr bool
+	}{
+		{"contractors", "alice@external.com,bob@external.com,carol@external.com", false}, // defined in both files
+		{"break-glass", "alice@external.com,bob@external.com,carol@external.com,emergency@corp.com", false},
+		{"oncall", "alice@external.com,bob@external.com,carol@external.com,dave@corp.com,emergency@corp.com", false},
+		{"loop-a", "a@corp.com,b@corp.com", false},
+		{"empty", "", false},
+		{"missing", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grp, err := p.GetGroup(test.name)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("GetGroup() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := userEmails(grp); got != test.want {
+				t.Errorf("GetGroup() has users %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	oncall, _ := p.GetGroup("oncall")
+	if path := strings.Join(oncall.PathTo("alice@external.com"), " > "); path != "oncall > break-glass > contractors" {
+		t.Errorf("PathTo() = %v, want oncall > break-glass > contractors", path)
+	}
+
+	names, err := p.ListGroups()
+	if err != nil || strings.Join(names, ",") != "break-glass,contractors,empty,loop-a,loop-b,oncall" {
+		t.Errorf("ListGroups() = %v, %v; want all groups of both files, sorted", names, err)
+	}
+
+	userGroups, _ := p.ListUserGroupsForDisplay("emergency@corp.com")
+	if len(userGroups) != 1 || userGroups[0]["name"] != "break-glass" {
+		t.Errorf("ListUserGroupsForDisplay() = %v, want only break-glass (direct memberships)", userGroups)
+	}
+	members, err := p.ListGroupMembersForDisplay("loop-a", true)
+	if err != nil || len(members) != 2 {
+		t.Errorf("ListGroupMembersForDisplay() = %v, %v; want a user and a group", members, err)
+	}
+}
+
+func TestFileProviderReload(t *testing.T) {
+	dir, paths := writeGroupFiles(t, map[string]string{"groups.yaml": "contractors: [alice@external.com]\n"})
+	defer os.RemoveAll(dir)
+
+	p, err := CreateFileProvider(zap.NewNop().Sugar(), FileConfig{Paths: paths})
+	if err != nil {
+		t.Fatalf("CreateFileProvider() error = %v", err)
+	}
+	if _, err := p.GetGroup("contractors"); err != nil {
+		t.Fatalf("GetGroup() error = %v", err)
+	}
+
+	if err := ioutil.WriteFile(paths[0], []byte("contractors: [bob@external.com]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	grp, err := p.GetGroup("contractors")
+	if err != nil || userEmails(grp) != "bob@external.com" {
+		t.Errorf("GetGroup() after Reload() = %v, %v; want the members from the changed file", userEmails(grp), err)
+	}
+
+	// a broken file keeps the groups that were loaded before
+	if err := ioutil.WriteFile(paths[0], []byte("contractors: [bob@external.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err == nil {
+		t.Errorf("Reload() of a broken file returned no error")
+	}
+	grp, err = p.GetGroup("contractors")
+	if err != nil || userEmails(grp) != "bob@external.com" {
+		t.Errorf("GetGroup() after a failed Reload() = %v, %v; want the previous members", userEmails(grp), err)
+	}
+}
+
+func TestCreateFileProviderInvalidFiles(t *testing.T) {
+	dir, paths := writeGroupFiles(t, map[string]string{
+		"groups.txt":  "contractors: [alice@external.com]\n",
+		"broken.csv":  "contractors,\"alice@external.com\n",
+		"broken.yaml": "contractors: alice@external.com\n", // members must be a list
+	})
+	defer os.RemoveAll(dir)
+	paths = append(paths, filepath.Join(dir, "missing.yaml"))
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			if _, err := CreateFileProvider(zap.NewNop().Sugar(), FileConfig{Paths: []string{path}}); err == nil {
+				t.Errorf("CreateFileProvider() returned no error")
+			}
+		})
+	}
+}
@@ -2,13 +2,14 @@ package groups
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"regexp"
 	"strings"
 
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/option"
@@ -23,6 +24,8 @@ type GroupTree struct {
 	groups         map[string]*Group
 	users          map[string]*User
 	groupBlacklist []string
+
+	fetchTracker
 }
 
 // Group is a 'google group', but in a more useful format than the original libarary provides
@@ -35,7 +38,8 @@ type Group struct {
 
 // User is a more useful version of a google user
 type User struct {
-	Email string
+	Email     string
+	Suspended bool // the account is suspended in the directory (only known for google)
 	// Groups []*Group // Groups a user is in directly
 	// AllGroups []*Group // Groups + all indirect groups
 }
@@ -87,8 +91,45 @@ func (g *Group) AllUsers() []*User {
 	return result
 }
 
+// PathTo finds out how a user is connected to the group.
+// It returns the emails of all groups from this group down to the (nested) group the user is a direct member of,
+// or nil if the user is not a member at all.
+func (g *Group) PathTo(userEmail string) []string {
+	if g == nil {
+		return nil
+	}
+
+	parents := map[*Group]*Group{g: nil} // group -> group it was reached from
+	openSet := []*Group{g}
+
+	for i := 0; i < len(openSet); i++ {
+		current := openSet[i]
+
+		for _, u := range current.Users {
+			if u != nil && u.Email == userEmail {
+				// walk back up to the root group
+				var path []string
+				for grp := current; grp != nil; grp = parents[grp] {
+					path = append([]string{grp.Email}, path...)
+				}
+				return path
+			}
+		}
+
+		for _, subGroup := range current.Groups {
+			if _, seen := parents[subGroup]; subGroup != nil && !seen {
+				parents[subGroup] = current
+				openSet = append(openSet, subGroup)
+			}
+		}
+	}
+
+	return nil
+}
+
 // CreateGroupTree -
-func CreateGroupTree(logger *zap.SugaredLogger, domain string, userEmail string, serviceAccountFilePath string, groupBlacklist []string, scopes ...string) (*GroupTree, error) {
+// wrapTransport (optional) can be used to wrap the http transport that is used for all requests against the google api
+func CreateGroupTree(logger *zap.SugaredLogger, domain string, userEmail string, serviceAccountFilePath string, groupBlacklist []string, wrapTransport func(http.RoundTripper) http.RoundTripper, scopes ...string) (*GroupTree, error) {
 	ctx := context.Background()
 	log := logger
 
@@ -106,17 +147,28 @@ func CreateGroupTree(logger *zap.SugaredLogger, domain string, userEmail string,
 
 	ts := config.TokenSource(ctx)
 
-	svc, err := admin.NewService(ctx, option.WithTokenSource(ts))
+	httpClient := oauth2.NewClient(ctx, ts)
+	if wrapTransport != nil {
+		httpClient.Transport = wrapTransport(httpClient.Transport)
+	}
+
+	svc, err := admin.NewService(ctx, option.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, fmt.Errorf("NewService: %v", err)
 	}
-	return &GroupTree{svc, logger, domain, map[string]*Group{}, make(map[string]*User), groupBlacklist}, nil
+	return &GroupTree{svc, logger, domain, map[string]*Group{}, make(map[string]*User), groupBlacklist, newFetchTracker()}, nil
 }
 
 // Clear removes all groups and users from the cache
 func (g *GroupTree) Clear() {
 	g.groups = make(map[string]*Group)
 	g.users = make(map[string]*User)
+	g.clearRound()
+}
+
+// CacheSize returns the number of groups and users currently in the cache
+func (g *GroupTree) CacheSize() (groups int, users int) {
+	return len(g.groups), len(g.users)
 }
 
 // ListGroupMembersRaw finds all members in a group
@@ -137,33 +189,66 @@ func (g *GroupTree) ListGroupMembersRaw(groupKey string) (result []*admin.Member
 	return result, nil
 }
 
+// ListGroups returns the emails of all groups in the domain (except blacklisted ones)
+func (g *GroupTree) ListGroups() ([]string, error) {
+	return g.listGroups(func() ([]string, error) {
+		var result []string
+		err := g.svc.Groups.List().Domain(g.domain).Pages(context.Background(), func(page *admin.Groups) error {
+			for _, grp := range page.Groups {
+				if isBlacklisted, _ := g.isGroupInBlacklist(grp.Email); !isBlacklisted {
+					result = append(result, grp.Email)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			g.logger.Warnw("error listing groups", "domain", g.domain, "err", err)
+			return nil, err
+		}
+		return result, nil
+	})
+}
+
 // GetGroup -
 func (g *GroupTree) GetGroup(email string) (*Group, error) {
 	grp, exists := g.groups[email]
 	if exists {
-		return grp, nil // return existing
+		return grp, g.roundErrors[email] // return existing
 	}
 
-	// Check blacklist
+	// Check blacklist: a blacklisted group is empty on purpose, that is not an error (it would stop all demotions in the orgs of its rules)
 	isBlacklisted, reason := g.isGroupInBlacklist(email)
 	if isBlacklisted {
 		g.logger.Infow("Skipping group because it is blacklisted", "groupEmail", email, "pattern", reason)
-		return nil, errors.New("group is blacklisted by: '" + reason + "'")
+		grp = &Group{Email: email}
+		g.groups[email] = grp
+		return grp, nil
 	}
 
 	members, err := g.ListGroupMembersRaw(email)
 	if err != nil {
 		g.logger.Warnw("error listing group members", "groupEmail", email, "err", err)
-		return nil, err // error
+		grp, err = g.failure(email, err)
+		g.groups[email] = grp // keep using the last good version (or nothing) for the rest of this round, don't fetch it again
+		return grp, err
 	}
 
 	grp = &Group{Email: email} // create new
 	g.groups[email] = grp
 
+	var subGroupErr error
 	for _, m := range members {
 		if m.Type == "GROUP" {
+			if isBlacklisted, reason := g.isGroupInBlacklist(m.Email); isBlacklisted {
+				g.logger.Infow("Skipping group because it is blacklisted", "groupEmail", m.Email, "pattern", reason)
+				continue
+			}
+
 			subGroup, err := g.GetGroup(m.Email) // cache that sub group as well
 			if err != nil {
+				subGroupErr = fmt.Errorf("nested group '%v': %v", m.Email, err)
+			}
+			if subGroup == nil {
 				continue
 			}
 			grp.Groups = append(grp.Groups, subGroup) // add it as a child
@@ -171,7 +256,7 @@ func (g *GroupTree) GetGroup(email string) (*Group, error) {
 			// cache user
 			u, exists := g.users[m.Email]
 			if !exists {
-				u = &User{m.Email}
+				u = &User{m.Email, m.Status == "SUSPENDED"}
 				g.users[m.Email] = u
 			}
 
@@ -181,6 +266,13 @@ func (g *GroupTree) GetGroup(email string) (*Group, error) {
 		}
 	}
 
+	if subGroupErr != nil {
+		// the group itself was fetched, but some of its members are missing or stale
+		g.recordError(email, subGroupErr)
+		return grp, subGroupErr
+	}
+
+	g.success(email, grp)
 	return grp, nil
 }
 
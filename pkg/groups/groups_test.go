@@ -0,0 +1,27 @@
+package groups
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestGetGroupBlacklisted(t *testing.T) {
+	tree := &GroupTree{
+		logger:         zap.NewNop().Sugar(),
+		groups:         make(map[string]*Group),
+		users:          make(map[string]*User),
+		groupBlacklist: []string{"external@corp.com", "/@partner\\.com$/"},
+		fetchTracker:   newFetchTracker(),
+	}
+
+	for _, email := range []string{"external@corp.com", "ops@partner.com"} {
+		grp, err := tree.GetGroup(email) // the api is never called (svc is nil)
+		if err != nil {
+			t.Errorf("GetGroup(%v) error = %v, blacklisted groups are not an error", email, err)
+		}
+		if grp == nil || len(grp.AllUsers()) != 0 {
+			t.Errorf("GetGroup(%v) = %v, want an empty group", email, grp)
+		}
+	}
+}
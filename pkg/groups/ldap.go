@@ -0,0 +1,384 @@
+package groups
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+// LDAPConfig -
+type LDAPConfig struct {
+	URL          string `yaml:"url"`      // ldap://host:389 or ldaps://host:636
+	StartTLS     bool   `yaml:"startTLS"` // upgrade a ldap:// connection using StartTLS
+	BindDN       string `yaml:"bindDN"`
+	BindPassword string `yaml:"-"` // password is retrieved from LDAP_BIND_PASSWORD
+
+	BaseDN     string `yaml:"baseDN"`     // where to search for users
+	UserFilter string `yaml:"userFilter"` // default: (objectClass=person)
+
+	MailAttribute         string   `yaml:"mailAttribute"`         // default: mail
+	MemberAttribute       string   `yaml:"memberAttribute"`       // default: member
+	UniqueMemberAttribute string   `yaml:"uniqueMemberAttribute"` // default: uniqueMember (the members of groupOfUniqueNames)
+	MemberOfAttribute     string   `yaml:"memberOfAttribute"`     // default: memberOf
+	GroupObjectClasses    []string `yaml:"groupObjectClasses"`    // default: [groupOfNames, groupOfUniqueNames]
+}
+
+// LDAPConn is the part of an ldap connection the LDAPProvider needs.
+// It is implemented by *ldap.Conn, but can also be an in-process stand-in.
+type LDAPConn interface {
+	Search(*ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// LDAPProvider resolves groups (groupOfNames and similar) from an ldap server.
+// Groups are identified by their DN, nested groups are resolved recursively.
+type LDAPProvider struct {
+	logger *zap.SugaredLogger
+	config LDAPConfig
+	dial   func() (LDAPConn, error)
+	conn   LDAPConn
+
+	groups map[string]*Group // [lowercase dn]Group
+	users  map[string]*User  // [lowercase dn]User
+
+	fetchTracker
+}
+
+// CreateLDAPProvider creates a provider that connects to the configured ldap server (the connection is established on first use)
+func CreateLDAPProvider(logger *zap.SugaredLogger, config LDAPConfig) (*LDAPProvider, error) {
+	serverURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldap url: %v", err)
+	}
+
+	dial := func() (LDAPConn, error) {
+		conn, err := ldap.DialURL(config.URL)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(30 * time.Second)
+
+		if config.StartTLS {
+			err = conn.StartTLS(&tls.Config{ServerName: serverURL.Hostname()})
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("StartTLS: %v", err)
+			}
+		}
+
+		if config.BindDN != "" {
+			err = conn.Bind(config.BindDN, config.BindPassword)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("Bind: %v", err)
+			}
+		}
+
+		return conn, nil
+	}
+
+	return NewLDAPProvider(logger, config, dial), nil
+}
+
+// NewLDAPProvider creates a provider that uses the given function to open connections
+func NewLDAPProvider(logger *zap.SugaredLogger, config LDAPConfig, dial func() (LDAPConn, error)) *LDAPProvider {
+	if config.UserFilter == "" {
+		config.UserFilter = "(objectClass=person)"
+	}
+	if config.MailAttribute == "" {
+		config.MailAttribute = "mail"
+	}
+	if config.MemberAttribute == "" {
+		config.MemberAttribute = "member"
+	}
+	if config.UniqueMemberAttribute == "" {
+		config.UniqueMemberAttribute = "uniqueMember"
+	}
+	if config.MemberOfAttribute == "" {
+		config.MemberOfAttribute = "memberOf"
+	}
+	if len(config.GroupObjectClasses) == 0 {
+		config.GroupObjectClasses = []string{"groupOfNames", "groupOfUniqueNames"}
+	}
+
+	return &LDAPProvider{logger, config, dial, nil, make(map[string]*Group), make(map[string]*User), newFetchTracker()}
+}
+
+// Clear removes all groups and users from the cache
+func (p *LDAPProvider) Clear() {
+	p.groups = make(map[string]*Group)
+	p.users = make(map[string]*User)
+	p.clearRound()
+}
+
+// CacheSize returns the number of groups and users currently in the cache
+func (p *LDAPProvider) CacheSize() (groups int, users int) {
+	return len(p.groups), len(p.users)
+}
+
+// GetGroup resolves the group with the given DN
+func (p *LDAPProvider) GetGroup(dn string) (*Group, error) {
+	key := strings.ToLower(dn)
+	grp, exists := p.groups[key]
+	if exists {
+		return grp, p.roundErrors[key] // return existing
+	}
+
+	entry, err := p.getEntry(dn)
+	if err == nil && !p.isGroup(entry) {
+		err = fmt.Errorf("'%v' is not a group", dn)
+	}
+	if err != nil {
+		p.logger.Warnw("error reading ldap group", "dn", dn, "err", err)
+		grp, err = p.failure(key, err)
+		p.groups[key] = grp // keep using the last good version (or nothing) for the rest of this round, don't read it again
+		return grp, err
+	}
+
+	grp = &Group{Email: dn} // create new
+	p.groups[key] = grp
+
+	var memberErr error
+	for _, memberDN := range p.memberDNs(entry) {
+		memberKey := strings.ToLower(memberDN)
+
+		if u, exists := p.users[memberKey]; exists {
+			grp.Users = append(grp.Users, u)
+			continue
+		}
+		if subGroup, exists := p.groups[memberKey]; exists {
+			if err := p.roundErrors[memberKey]; err != nil {
+				memberErr = fmt.Errorf("nested group '%v': %v", memberDN, err)
+			}
+			if subGroup != nil {
+				grp.Groups = append(grp.Groups, subGroup)
+			}
+			continue
+		}
+
+		member, err := p.getEntry(memberDN)
+		if errors.Is(err, errEntryNotFound) {
+			// a member that was deleted without being removed from the group, that is not a reason to distrust the whole group
+			p.logger.Warnw("skipping ldap group member that does not exist", "group", dn, "member", memberDN)
+			continue
+		}
+		if err != nil {
+			p.logger.Warnw("error reading ldap group member", "group", dn, "member", memberDN, "err", err)
+			memberErr = fmt.Errorf("member '%v': %v", memberDN, err)
+			continue
+		}
+
+		if p.isGroup(member) {
+			subGroup, err := p.GetGroup(memberDN) // cache that sub group as well
+			if err != nil {
+				memberErr = fmt.Errorf("nested group '%v': %v", memberDN, err)
+			}
+			if subGroup == nil {
+				continue
+			}
+			grp.Groups = append(grp.Groups, subGroup) // add it as a child
+		} else {
+			mail := member.GetAttributeValue(p.config.MailAttribute)
+			if mail == "" {
+				p.logger.Debugw("skipping ldap group member without mail attribute", "group", dn, "member", memberDN)
+				continue
+			}
+			u := &User{mail, false}
+			p.users[memberKey] = u
+			grp.Users = append(grp.Users, u)
+		}
+	}
+
+	if memberErr != nil {
+		// the group itself was read, but some of its members are missing or stale
+		p.recordError(key, memberErr)
+		return grp, memberErr
+	}
+
+	p.success(key, grp)
+	return grp, nil
+}
+
+// ListGroupMembersForDisplay lists the members of the group with the given DN
+func (p *LDAPProvider) ListGroupMembersForDisplay(groupKey string, includeDerived bool) ([]map[string]interface{}, error) {
+	return p.listGroupMembersForDisplay(groupKey, includeDerived, map[string]bool{})
+}
+
+func (p *LDAPProvider) listGroupMembersForDisplay(dn string, includeDerived bool, visited map[string]bool) (result []map[string]interface{}, err error) {
+	result = make([]map[string]interface{}, 0)
+	visited[strings.ToLower(dn)] = true
+
+	entry, err := p.getEntry(dn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, memberDN := range p.memberDNs(entry) {
+		element := map[string]interface{}{
+			"dn": memberDN,
+		}
+
+		member, err := p.getEntry(memberDN)
+		if err != nil {
+			element["error"] = err.Error()
+			result = append(result, element)
+			continue
+		}
+
+		if p.isGroup(member) {
+			element["type"] = "GROUP"
+			if includeDerived && !visited[strings.ToLower(memberDN)] {
+				subGroup, err := p.listGroupMembersForDisplay(memberDN, includeDerived, visited)
+				if err != nil {
+					element["error"] = fmt.Sprintf("cannot resolve subgroup '%v' (in group '%v'): %v", memberDN, dn, err.Error())
+				} else {
+					element["items"] = subGroup
+				}
+			}
+		} else {
+			element["type"] = "USER"
+			element["email"] = member.GetAttributeValue(p.config.MailAttribute)
+		}
+
+		result = append(result, element)
+	}
+	return result, nil
+}
+
+// ListGroups returns the DNs of all groups below the base DN
+func (p *LDAPProvider) ListGroups() ([]string, error) {
+	return p.listGroups(func() ([]string, error) {
+		res, err := p.search(ldap.NewSearchRequest(p.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			p.groupFilter(), []string{"dn"}, nil))
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]string, 0, len(res.Entries))
+		for _, e := range res.Entries {
+			result = append(result, e.DN)
+		}
+		return result, nil
+	})
+}
+
+// ListUserGroupsForDisplay finds all groups a user (specified by their email) is a direct member of
+func (p *LDAPProvider) ListUserGroupsForDisplay(userKey string) (groups []map[string]interface{}, err error) {
+	groups = make([]map[string]interface{}, 0)
+
+	filter := fmt.Sprintf("(&%v(%v=%v))", p.config.UserFilter, p.config.MailAttribute, ldap.EscapeFilter(userKey))
+	res, err := p.search(ldap.NewSearchRequest(p.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{p.config.MemberOfAttribute}, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, fmt.Errorf("no ldap user with %v '%v'", p.config.MailAttribute, userKey)
+	}
+	user := res.Entries[0]
+
+	groupDNs := user.GetAttributeValues(p.config.MemberOfAttribute)
+	if len(groupDNs) == 0 {
+		// server might not maintain memberOf, search the groups instead
+		filter := fmt.Sprintf("(&%v(|(%v=%v)(%v=%v)))", p.groupFilter(),
+			p.config.MemberAttribute, ldap.EscapeFilter(user.DN), p.config.UniqueMemberAttribute, ldap.EscapeFilter(user.DN))
+		res, err := p.search(ldap.NewSearchRequest(p.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter, []string{"dn"}, nil))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range res.Entries {
+			groupDNs = append(groupDNs, e.DN)
+		}
+	}
+
+	for _, dn := range groupDNs {
+		groups = append(groups, map[string]interface{}{
+			"name": firstRDNValue(dn),
+			"dn":   dn,
+		})
+	}
+	return groups, nil
+}
+
+// errEntryNotFound is returned by getEntry when there is no entry with the DN
+var errEntryNotFound = errors.New("ldap entry not found")
+
+// getEntry reads a single entry (only the attributes the provider needs)
+func (p *LDAPProvider) getEntry(dn string) (*ldap.Entry, error) {
+	res, err := p.search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"objectClass", p.config.MailAttribute, p.config.MemberAttribute, p.config.UniqueMemberAttribute}, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && len(res.Entries) == 0) {
+		return nil, fmt.Errorf("%w: '%v'", errEntryNotFound, dn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries[0], nil
+}
+
+// memberDNs returns the DNs of the direct members of a group.
+// groupOfNames lists them in 'member', groupOfUniqueNames in 'uniqueMember' (optionally followed by a uid, like "cn=bob,dc=corp#'0101'B").
+func (p *LDAPProvider) memberDNs(entry *ldap.Entry) []string {
+	result := entry.GetAttributeValues(p.config.MemberAttribute)
+	for _, value := range entry.GetAttributeValues(p.config.UniqueMemberAttribute) {
+		if i := strings.LastIndex(value, "#'"); i >= 0 && strings.HasSuffix(value, "'B") {
+			value = value[:i]
+		}
+		result = append(result, value)
+	}
+	return result
+}
+
+func (p *LDAPProvider) search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if p.conn == nil {
+		conn, err := p.dial()
+		if err != nil {
+			return nil, fmt.Errorf("connecting to ldap server: %v", err)
+		}
+		p.conn = conn
+	}
+
+	res, err := p.conn.Search(req)
+	if err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		// connection is broken, reconnect on the next search
+		p.conn.Close()
+		p.conn = nil
+	}
+	return res, err
+}
+
+// groupFilter matches entries that have any of the group object classes
+func (p *LDAPProvider) groupFilter() string {
+	var classFilter string
+	for _, c := range p.config.GroupObjectClasses {
+		classFilter += "(objectClass=" + ldap.EscapeFilter(c) + ")"
+	}
+	return "(|" + classFilter + ")"
+}
+
+func (p *LDAPProvider) isGroup(entry *ldap.Entry) bool {
+	for _, class := range entry.GetAttributeValues("objectClass") {
+		for _, groupClass := range p.config.GroupObjectClasses {
+			if strings.EqualFold(class, groupClass) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstRDNValue returns the value of the first part of a DN, "cn=ops,ou=groups,dc=corp" -> "ops"
+func firstRDNValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
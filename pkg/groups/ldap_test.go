@@ -0,0 +1,287 @@
+package groups
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+// fakeLDAP is an in-process stand-in for an ldap server, it answers searches from a fixed list of entries
+type fakeLDAP struct {
+	entries  []*ldap.Entry
+	fail     map[string]bool // lowercase DNs that can't be read
+	searches map[string]int  // lowercase base DN -> number of searches
+}
+
+func (f *fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	base := strings.ToLower(req.BaseDN)
+	if f.searches == nil {
+		f.searches = make(map[string]int)
+	}
+	f.searches[base]++
+	if f.fail[base] {
+		return nil, fmt.Errorf("reading '%v' failed", req.BaseDN)
+	}
+
+	res := &ldap.SearchResult{}
+	for _, e := range f.entries {
+		dn := strings.ToLower(e.DN)
+		if req.Scope == ldap.ScopeBaseObject && dn != base {
+			continue
+		}
+		if !strings.HasSuffix(dn, base) {
+			continue
+		}
+
+		match, rest, err := evalFilter(req.Filter, e)
+		if err == nil && rest != "" {
+			err = fmt.Errorf("unexpected '%v' at the end of the filter", rest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter '%v': %v", req.Filter, err)
+		}
+		if match {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeLDAP) Close() {}
+
+// evalFilter evaluates the first filter in f (only &, |, !, equality and presence are supported), and returns the rest of f
+func evalFilter(f string, e *ldap.Entry) (bool, string, error) {
+	if !strings.HasPrefix(f, "(") || len(f) < 3 {
+		return false, "", fmt.Errorf("expected '(' at '%v'", f)
+	}
+	f = f[1:]
+
+	if op := f[0]; op == '&' || op == '|' || op == '!' {
+		f = f[1:]
+		result := op != '|'
+		for strings.HasPrefix(f, "(") {
+			match, rest, err := evalFilter(f, e)
+			if err != nil {
+				return false, "", err
+			}
+			switch op {
+			case '&':
+				result = result && match
+			case '|':
+				result = result || match
+			case '!':
+				result = !match
+			}
+			f = rest
+		}
+		if !strings.HasPrefix(f, ")") {
+			return false, "", fmt.Errorf("expected ')' at '%v'", f)
+		}
+		return result, f[1:], nil
+	}
+
+	end := strings.Index(f, ")")
+	if end < 0 {
+		return false, "", fmt.Errorf("expected ')' at '%v'", f)
+	}
+	parts := strings.SplitN(f[:end], "=", 2)
+	if len(parts) != 2 {
+		return false, "", fmt.Errorf("invalid comparison at '%v'", f)
+	}
+	values := e.GetAttributeValues(parts[0])
+	if parts[1] == "*" {
+		return len(values) > 0, f[end+1:], nil
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, parts[1]) {
+			return true, f[end+1:], nil
+		}
+	}
+	return false, f[end+1:], nil
+}
+
+func newFakeLDAPProvider(server *fakeLDAP) *LDAPProvider {
+	config := LDAPConfig{BaseDN: "dc=corp"}
+	return NewLDAPProvider(zap.NewNop().Sugar(), config, func() (LDAPConn, error) { return server, nil })
+}
+
+func person(cn string, memberOf ...string) *ldap.Entry {
+	return ldap.NewEntry("cn="+cn+",ou=people,dc=corp", map[string][]string{
+		"objectClass": {"person"},
+		"mail":        {cn + "@corp.com"},
+		"memberOf":    memberOf,
+	})
+}
+
+func groupOfNames(cn string, members ...string) *ldap.Entry {
+	return ldap.NewEntry("cn="+cn+",ou=groups,dc=corp", map[string][]string{
+		"objectClass": {"top", "groupOfNames"},
+		"member":      members,
+	})
+}
+
+func groupOfUniqueNames(cn string, members ...string) *ldap.Entry {
+	return ldap.NewEntry("cn="+cn+",ou=groups,dc=corp", map[string][]string{
+		"objectClass":  {"top", "groupOfUniqueNames"},
+		"uniqueMember": members,
+	})
+}
+
+func userDN(cn string) string  { return "cn=" + cn + ",ou=people,dc=corp" }
+func groupDN(cn string) string { return "cn=" + cn + ",ou=groups,dc=corp" }
+
+func emails(users []*User) []string {
+	var result []string
+	for _, u := range users {
+		result = append(result, u.Email)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestLDAPGetGroup(t *testing.T) {
+	server := &fakeLDAP{entries: []*ldap.Entry{
+		person("alice"), person("bob"), person("carol"), person("dave"),
+		groupOfNames("ops", userDN("alice"), groupDN("sre")),
+		groupOfUniqueNames("sre", userDN("bob"), userDN("carol")+"#'0101'B"),
+		groupOfNames("cycle-a", userDN("alice"), groupDN("cycle-b")),
+		groupOfUniqueNames("cycle-b", userDN("dave"), groupDN("cycle-a")),
+		groupOfNames("dangling", userDN("alice"), userDN("deleted")),
+		groupOfNames("unreadable", userDN("alice"), userDN("locked")),
+	}, fail: map[string]bool{strings.ToLower(userDN("locked")): true}}
+
+	tests := []struct {
+		name    string
+		group   string
+		want    []string
+		wantErr bool
+	}{
+		{"groupOfNames with nested groupOfUniqueNames", "ops", []string{"alice@corp.com", "bob@corp.com", "carol@corp.com"}, false},
+		{"groupOfUniqueNames", "sre", []string{"bob@corp.com", "carol@corp.com"}, false},
+		{"membership cycle", "cycle-a", []string{"alice@corp.com", "dave@corp.com"}, false},
+		{"member that does not exist", "dangling", []string{"alice@corp.com"}, false},
+		{"member that can't be read", "unreadable", []string{"alice@corp.com"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newFakeLDAPProvider(server)
+			grp, err := p.GetGroup(groupDN(test.group))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("GetGroup() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if grp == nil {
+				t.Fatalf("GetGroup() returned no group")
+			}
+			if got := emails(grp.AllUsers()); strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("GetGroup() users = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLDAPGetGroupFallsBackToLastGood(t *testing.T) {
+	server := &fakeLDAP{entries: []*ldap.Entry{person("alice"), groupOfNames("ops", userDN("alice"))}}
+	p := newFakeLDAPProvider(server)
+
+	if _, err := p.GetGroup(groupDN("ops")); err != nil {
+		t.Fatalf("first GetGroup() error = %v", err)
+	}
+
+	p.Clear()
+	server.fail = map[string]bool{strings.ToLower(groupDN("ops")): true}
+	grp, err := p.GetGroup(groupDN("ops"))
+	if _, isStale := err.(*StaleError); !isStale {
+		t.Fatalf("GetGroup() error = %v, want a StaleError", err)
+	}
+	if got := emails(grp.AllUsers()); len(got) != 1 || got[0] != "alice@corp.com" {
+		t.Errorf("GetGroup() users = %v, want the last good members", got)
+	}
+}
+
+func TestLDAPGetGroupCachesFailuresForTheRound(t *testing.T) {
+	sre := strings.ToLower(groupDN("sre"))
+	server := &fakeLDAP{entries: []*ldap.Entry{
+		person("alice"),
+		groupOfNames("ops", userDN("alice"), groupDN("sre")),
+		groupOfNames("sre", userDN("alice")),
+	}, fail: map[string]bool{sre: true}}
+	p := newFakeLDAPProvider(server)
+
+	for i := 0; i < 3; i++ {
+		grp, err := p.GetGroup(groupDN("sre"))
+		if err == nil || grp != nil {
+			t.Errorf("GetGroup() of a group that can't be read = %v, %v; want an error and no group", grp, err)
+		}
+		if _, err := p.GetGroup(groupDN("ops")); err == nil {
+			t.Errorf("GetGroup() of a group with a nested group that can't be read returned no error")
+		}
+	}
+	if server.searches[sre] != 1 {
+		t.Errorf("the group was read %d times in one round, want once", server.searches[sre])
+	}
+
+	p.Clear()
+	p.GetGroup(groupDN("sre"))
+	if server.searches[sre] != 2 {
+		t.Errorf("the group was read %d times after Clear(), want it to be read again", server.searches[sre])
+	}
+}
+
+func TestLDAPListUserGroups(t *testing.T) {
+	server := &fakeLDAP{entries: []*ldap.Entry{
+		person("alice", groupDN("ops")), // the server maintains memberOf for alice
+		person("bob"),                   // but not for bob
+		groupOfNames("ops", userDN("alice")),
+		groupOfNames("dev", userDN("bob")),
+		groupOfUniqueNames("sre", userDN("bob")),
+	}}
+
+	tests := []struct {
+		email string
+		want  []string
+	}{
+		{"alice@corp.com", []string{"ops"}},
+		{"bob@corp.com", []string{"dev", "sre"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.email, func(t *testing.T) {
+			p := newFakeLDAPProvider(server)
+			groups, err := p.ListUserGroupsForDisplay(test.email)
+			if err != nil {
+				t.Fatalf("ListUserGroupsForDisplay() error = %v", err)
+			}
+			var got []string
+			for _, g := range groups {
+				got = append(got, g["name"].(string))
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("ListUserGroupsForDisplay() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLDAPListGroups(t *testing.T) {
+	server := &fakeLDAP{entries: []*ldap.Entry{
+		person("alice"),
+		groupOfNames("ops", userDN("alice")),
+		groupOfUniqueNames("sre", userDN("alice")),
+	}}
+
+	got, err := newFakeLDAPProvider(server).ListGroups()
+	if err != nil {
+		t.Fatalf("ListGroups() error = %v", err)
+	}
+	sort.Strings(got)
+	want := []string{groupDN("ops"), groupDN("sre")}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("ListGroups() = %v, want %v", got, want)
+	}
+}
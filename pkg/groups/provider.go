@@ -0,0 +1,35 @@
+package groups
+
+// Provider is a source of groups (for example the google admin directory, or an ldap server).
+// Providers cache the groups they resolve until Clear() is called.
+type Provider interface {
+	// GetGroup resolves a group, including all of its nested groups.
+	// When the group (or one of its nested groups) can not be fetched, an error is returned.
+	// The group might still be returned along with the error, it then contains the last known good members (see StaleError).
+	GetGroup(key string) (*Group, error)
+
+	// ListGroups returns the keys of all groups the provider knows about (used to match group patterns).
+	// Just like groups, the list is cached until Clear() is called.
+	ListGroups() ([]string, error)
+
+	// ListGroupMembersForDisplay lists the direct members of a group (and optionally all nested members) in an easily serializable format
+	ListGroupMembersForDisplay(groupKey string, includeDerived bool) ([]map[string]interface{}, error)
+
+	// ListUserGroupsForDisplay finds all groups a user is a member of
+	ListUserGroupsForDisplay(userKey string) ([]map[string]interface{}, error)
+
+	// Clear removes all groups and users from the cache
+	Clear()
+
+	// FetchStatus returns the outcome of the last attempt to fetch each group
+	FetchStatus() map[string]FetchStatus
+
+	// CacheSize returns the number of groups and users currently in the cache
+	CacheSize() (groups int, users int)
+}
+
+var (
+	_ Provider = (*GroupTree)(nil)
+	_ Provider = (*LDAPProvider)(nil)
+	_ Provider = (*FileProvider)(nil)
+)
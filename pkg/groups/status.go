@@ -0,0 +1,122 @@
+package groups
+
+import (
+	"fmt"
+	"time"
+)
+
+// FetchStatus is the result of the attempts to fetch a group
+type FetchStatus struct {
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	Error       string    `json:"error,omitempty"` // error of the last attempt, empty if it was successful
+}
+
+// StaleError is returned together with the last successfully fetched version of a group, when the group could not be fetched again
+type StaleError struct {
+	Group       string
+	LastSuccess time.Time
+	Err         error
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("unable to fetch group '%v', using members from %v: %v", e.Group, e.LastSuccess.Format(time.RFC3339), e.Err)
+}
+
+// groupListKey is the key the status of listing all groups (see Provider.ListGroups) is tracked under
+const groupListKey = "(all groups)"
+
+// fetchTracker remembers the outcome of every group fetch, and the last good version of each group (which survives Clear())
+type fetchTracker struct {
+	status      map[string]*FetchStatus
+	lastGood    map[string]*Group
+	roundErrors map[string]error // errors since the last Clear()
+
+	groupList        []string // last good list of all groups
+	groupListFetched bool     // the list has been fetched since the last Clear()
+}
+
+func newFetchTracker() fetchTracker {
+	return fetchTracker{make(map[string]*FetchStatus), make(map[string]*Group), make(map[string]error), nil, false}
+}
+
+func (t *fetchTracker) clearRound() {
+	t.roundErrors = make(map[string]error)
+	t.groupListFetched = false
+}
+
+func (t *fetchTracker) getStatus(key string) *FetchStatus {
+	s, exists := t.status[key]
+	if !exists {
+		s = &FetchStatus{}
+		t.status[key] = s
+	}
+	return s
+}
+
+// success records a complete fetch of a group
+func (t *fetchTracker) success(key string, grp *Group) {
+	now := time.Now()
+	s := t.getStatus(key)
+	s.LastAttempt = now
+	s.LastSuccess = now
+	s.Error = ""
+	t.lastGood[key] = grp
+}
+
+// recordError records an unsuccessful fetch of a group (for example because some of its nested groups are missing or stale)
+func (t *fetchTracker) recordError(key string, err error) {
+	s := t.getStatus(key)
+	s.LastAttempt = time.Now()
+	s.Error = err.Error()
+	t.roundErrors[key] = err
+}
+
+// failure records a failed fetch of a group.
+// It returns the last good version of the group (if there is one), and the error the caller should return.
+func (t *fetchTracker) failure(key string, err error) (*Group, error) {
+	grp, exists := t.lastGood[key]
+	if exists {
+		err = &StaleError{key, t.getStatus(key).LastSuccess, err}
+	}
+	t.recordError(key, err)
+	return grp, err
+}
+
+// listGroups returns the list of all groups, it is only fetched (using 'fetch') once until the next Clear().
+// When fetching fails, the last good list is returned along with a StaleError.
+func (t *fetchTracker) listGroups(fetch func() ([]string, error)) ([]string, error) {
+	if t.groupListFetched {
+		return t.groupList, t.roundErrors[groupListKey]
+	}
+	t.groupListFetched = true
+
+	list, err := fetch()
+	if err != nil {
+		s := t.getStatus(groupListKey)
+		if s.LastSuccess.IsZero() {
+			t.groupList = nil
+		} else {
+			err = &StaleError{groupListKey, s.LastSuccess, err}
+		}
+		t.recordError(groupListKey, err)
+		return t.groupList, err
+	}
+
+	now := time.Now()
+	s := t.getStatus(groupListKey)
+	s.LastAttempt = now
+	s.LastSuccess = now
+	s.Error = ""
+	t.groupList = list
+	return list, nil
+}
+
+// FetchStatus returns the status of every group that has been fetched so far
+func (t *fetchTracker) FetchStatus() map[string]FetchStatus {
+	result := make(map[string]FetchStatus, len(t.status))
+	for key, s := range t.status {
+		result[key] = *s
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package groups
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFetchTrackerFailure(t *testing.T) {
+	tracker := newFetchTracker()
+	fetchErr := errors.New("backend error")
+
+	// without a good version, the error is returned as it is
+	grp, err := tracker.failure("ops", fetchErr)
+	if grp != nil || err != fetchErr {
+		t.Errorf("failure() without last good = (%v, %v), want (nil, %v)", grp, err, fetchErr)
+	}
+	if s := tracker.FetchStatus()["ops"]; s.Error == "" || !s.LastSuccess.IsZero() {
+		t.Errorf("status after failure = %+v, want an error and no success", s)
+	}
+
+	good := &Group{Email: "ops", Users: []*User{{"alice@corp.com", false}}}
+	tracker.success("ops", good)
+	if s := tracker.FetchStatus()["ops"]; s.Error != "" || s.LastSuccess.IsZero() {
+		t.Errorf("status after success = %+v, want a success and no error", s)
+	}
+
+	// with a good version, it is used (and the error says it is stale)
+	tracker.clearRound()
+	grp, err = tracker.failure("ops", fetchErr)
+	if grp != good {
+		t.Errorf("failure() group = %v, want the last good version", grp)
+	}
+	stale, isStale := err.(*StaleError)
+	if !isStale {
+		t.Fatalf("failure() error = %v, want a StaleError", err)
+	}
+	if stale.Err != fetchErr || stale.Group != "ops" || !stale.LastSuccess.Equal(tracker.FetchStatus()["ops"].LastSuccess) {
+		t.Errorf("StaleError = %+v, does not describe the failure", stale)
+	}
+	if tracker.roundErrors["ops"] == nil {
+		t.Error("failure is not remembered for the rest of the round")
+	}
+
+	tracker.clearRound()
+	if tracker.roundErrors["ops"] != nil {
+		t.Error("failure is remembered after the round ended")
+	}
+	if tracker.lastGood["ops"] != good {
+		t.Error("last good version did not survive the end of the round")
+	}
+}
+
+func TestFetchTrackerListGroups(t *testing.T) {
+	tracker := newFetchTracker()
+	calls := 0
+	list := func(result []string, err error) func() ([]string, error) {
+		return func() ([]string, error) {
+			calls++
+			return result, err
+		}
+	}
+
+	if _, err := tracker.listGroups(list(nil, errors.New("down"))); err == nil {
+		t.Error("listGroups() without any good list did not fail")
+	} else if _, isStale := err.(*StaleError); isStale {
+		t.Error("listGroups() without any good list returned a StaleError")
+	}
+
+	tracker.clearRound()
+	got, err := tracker.listGroups(list([]string{"ops", "sre"}, nil))
+	if err != nil || len(got) != 2 {
+		t.Errorf("listGroups() = (%v, %v), want the fetched list", got, err)
+	}
+
+	// the list is only fetched once per round
+	got, _ = tracker.listGroups(list(nil, errors.New("must not be called")))
+	if calls != 2 || len(got) != 2 {
+		t.Errorf("listGroups() fetched again in the same round (%d calls, %v)", calls, got)
+	}
+
+	tracker.clearRound()
+	got, err = tracker.listGroups(list(nil, errors.New("down")))
+	if _, isStale := err.(*StaleError); !isStale || len(got) != 2 {
+		t.Errorf("listGroups() after a failure = (%v, %v), want the last good list and a StaleError", got, err)
+	}
+}